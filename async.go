@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the handle based asynchronous request API.
+
+package iris
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Handle of an asynchronous request, allowing its result to be retrieved or the
+// wait for it to be cancelled.
+type PendingRequest struct {
+	reply []byte        // Reply of the remote cluster, if successful
+	err   error         // Failure of the request, if any
+	done  chan struct{} // Channel closed when the request finishes
+
+	cancel     context.CancelFunc // Aborts the wait for the reply
+	cancelled  bool               // Flag whether the request was cancelled
+	cancelLock sync.Mutex         // Mutex to protect the cancellation flag
+}
+
+// Sends a request to be serviced by a member of the specified cluster, without
+// waiting for the reply. The returned handle can be used to retrieve the result,
+// or to cancel the request if it's no longer needed.
+func (c *Connection) RequestAsync(cluster string, request []byte, timeout time.Duration) *PendingRequest {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := &PendingRequest{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go func() {
+		defer close(req.done)
+		defer cancel()
+
+		req.reply, req.err = c.request(ctx, cluster, request, timeout)
+	}()
+	return req
+}
+
+// Blocks until the request completes, returning the reply or failure. If the
+// request was cancelled, ErrCancelled is returned.
+func (r *PendingRequest) Reply() ([]byte, error) {
+	<-r.done
+
+	r.cancelLock.Lock()
+	defer r.cancelLock.Unlock()
+
+	if r.cancelled {
+		return nil, ErrCancelled
+	}
+	return r.reply, r.err
+}
+
+// Cancels the request, releasing its pending slot. Any reply arriving afterwards
+// is discarded.
+//
+// Since the relay protocol cannot revoke a request once sent, the remote member
+// might still process it; only the local wait is aborted.
+func (r *PendingRequest) Cancel() {
+	r.cancelLock.Lock()
+	select {
+	case <-r.done:
+		// Already finished, only mark the result as discarded
+	default:
+		r.cancel()
+	}
+	r.cancelled = true
+	r.cancelLock.Unlock()
+
+	<-r.done
+}
+
+// Result of an asynchronous request delivered through a future channel.
+type RequestResult struct {
+	Reply []byte // Reply of the remote cluster, if successful
+	Err   error  // Failure of the request, if any
+}
+
+// Sends a request to be serviced by a member of the specified cluster, without
+// waiting for the reply. The result is delivered on the returned channel, which
+// is buffered so that abandoning it doesn't leak the request.
+func (c *Connection) RequestFuture(cluster string, request []byte, timeout time.Duration) <-chan RequestResult {
+	result := make(chan RequestResult, 1)
+	go func() {
+		reply, err := c.request(context.Background(), cluster, request, timeout)
+		result <- RequestResult{Reply: reply, Err: err}
+	}()
+	return result
+}
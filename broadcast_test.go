@@ -161,6 +161,39 @@ func (b *broadcastLimitTestHandler) HandleBroadcast(msg []byte) {
 	b.delivers <- msg
 }
 
+// Tests that self-broadcasts reach the connection's own cluster.
+func TestBroadcastSelf(t *testing.T) {
+	// Register a new service to the relay
+	handler := &broadcastTestHandler{delivers: make(chan []byte, 1)}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	if err := handler.conn.BroadcastSelf([]byte{0x42}); err != nil {
+		t.Fatalf("self-broadcast failed: %v.", err)
+	}
+	select {
+	case msg := <-handler.delivers:
+		if len(msg) != 1 || msg[0] != 0x42 {
+			t.Fatalf("broadcast mismatch: have %v, want %v.", msg, []byte{0x42})
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("self-broadcast not received.")
+	}
+	// Verify that simple clients are rejected
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	if err := conn.BroadcastSelf([]byte{0x42}); err != ErrNotService {
+		t.Fatalf("client self-broadcast error mismatch: have %v, want %v.", err, ErrNotService)
+	}
+}
+
 // Tests the broadcast thread limitation.
 func TestBroadcastThreadLimit(t *testing.T) {
 	// Test specific configurations
@@ -340,3 +373,35 @@ func benchmarkBroadcastThroughput(threads int, b *testing.B) {
 	// Stop the timer (don't measure deferred cleanup)
 	b.StopTimer()
 }
+
+// Tests that time limited broadcasts are delivered if the relay keeps up.
+func TestBroadcastTimeout(t *testing.T) {
+	// Register a new service to the relay
+	handler := &broadcastTestHandler{
+		delivers: make(chan []byte, 1),
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Broadcast with a deadline and verify the delivery
+	if err := handler.conn.BroadcastTimeout(config.cluster, []byte{0x00}, time.Second); err != nil {
+		t.Fatalf("timed broadcast failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("timed broadcast not received.")
+	}
+	// Verify that the link remains usable for later broadcasts
+	if err := handler.conn.Broadcast(config.cluster, []byte{0x01}); err != nil {
+		t.Fatalf("broadcast failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("broadcast not received.")
+	}
+}
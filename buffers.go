@@ -0,0 +1,74 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the opt-in reuse of the inbound broadcast and request bodies, and of
+// the tunnel messages consumed via RecvInto.
+
+package iris
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Largest buffer kept for reuse, bigger ones are left to the garbage collector.
+var maxPooledBuffer = 1024 * 1024
+
+// Pool of the released inbound message buffers.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// Retrieves a length-tagged binary blob from the relay connection, placing it in
+// a pooled buffer if buffer reuse is enabled.
+func (c *Connection) recvBuffer() ([]byte, error) {
+	if !c.opts.ReuseBuffers {
+		return c.recvBinary()
+	}
+	// Fetch the length of the binary blob
+	size, err := c.recvVarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(c.opts.MaxMsgSize) {
+		return nil, fmt.Errorf("%w: inbound blob of %d bytes", ErrMsgTooLarge, size)
+	}
+	// Fetch the blob itself into a recycled buffer
+	buf := bufferPool.Get().(*[]byte)
+	if uint64(cap(*buf)) < size {
+		*buf = make([]byte, size)
+	}
+	data := (*buf)[:size]
+	if _, err := io.ReadFull(c.sockBuf, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Allocates an empty buffer with the capacity of an inbound message, recycling a
+// pooled one if buffer reuse is enabled.
+func (c *Connection) allocBuffer(size int) []byte {
+	if !c.opts.ReuseBuffers || size > maxPooledBuffer {
+		return make([]byte, 0, size)
+	}
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		bufferPool.Put(buf)
+		return make([]byte, 0, size)
+	}
+	return (*buf)[:0:size]
+}
+
+// Returns an inbound message buffer to the pool once its handler finished, if
+// buffer reuse is enabled.
+func (c *Connection) releaseBuffer(data []byte) {
+	if !c.opts.ReuseBuffers || cap(data) == 0 || cap(data) > maxPooledBuffer {
+		return
+	}
+	data = data[:0]
+	bufferPool.Put(&data)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the bulk transfer helpers, splitting an arbitrarily large stream into
+// framed tunnel messages and reassembling it on the remote side.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Frame types of a bulk transfer.
+const (
+	bulkData    byte = 'D' // Frame carrying a piece of the stream
+	bulkTrailer byte = 'T' // Frame closing the stream with its length and checksum
+)
+
+// Default size of the bulk transfer frames, if not specified otherwise.
+var defaultBulkChunk = 64 * 1024
+
+// Reads the entire stream and sends it over the tunnel as a sequence of framed
+// messages of at most chunkSize bytes (0 = 64KB), followed by a trailer with the
+// total length and checksum. The timeout applies to each message separately.
+//
+// The remote side must use RecvWriter to reassemble the stream.
+func (t *Tunnel) SendReader(r io.Reader, chunkSize int, timeout time.Duration) error {
+	if chunkSize < 0 {
+		return fmt.Errorf("invalid chunk size %d < 0", chunkSize)
+	}
+	if chunkSize == 0 {
+		chunkSize = defaultBulkChunk
+	}
+	// Stream the data frames until the reader is exhausted
+	var length uint64
+	checksum := crc32.NewIEEE()
+
+	frame := make([]byte, 1+chunkSize)
+	frame[0] = bulkData
+	for {
+		n, err := io.ReadFull(r, frame[1:])
+		if n > 0 {
+			checksum.Write(frame[1 : 1+n])
+			length += uint64(n)
+
+			if err := t.Send(frame[:1+n], timeout); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// Close the transfer with the trailer
+	trailer := make([]byte, 1+8+4)
+	trailer[0] = bulkTrailer
+	binary.BigEndian.PutUint64(trailer[1:], length)
+	binary.BigEndian.PutUint32(trailer[9:], checksum.Sum32())
+
+	return t.Send(trailer, timeout)
+}
+
+// Receives a stream sent via SendReader and writes it into w, verifying its length
+// and checksum against the trailer. The timeout applies to each message separately.
+func (t *Tunnel) RecvWriter(w io.Writer, timeout time.Duration) error {
+	var length uint64
+	checksum := crc32.NewIEEE()
+
+	for {
+		frame, err := t.Recv(timeout)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch frame[0] {
+		case bulkData:
+			checksum.Write(frame[1:])
+			length += uint64(len(frame) - 1)
+
+			if _, err := w.Write(frame[1:]); err != nil {
+				return err
+			}
+		case bulkTrailer:
+			if len(frame) != 1+8+4 {
+				return errors.New("malformed bulk transfer trailer")
+			}
+			if want := binary.BigEndian.Uint64(frame[1:]); length != want {
+				return fmt.Errorf("bulk transfer truncated: have %d bytes, want %d", length, want)
+			}
+			if want := binary.BigEndian.Uint32(frame[9:]); checksum.Sum32() != want {
+				return fmt.Errorf("bulk transfer checksum mismatch: have %08x, want %08x", checksum.Sum32(), want)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown bulk transfer frame type %#x", frame[0])
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Package codec uses Iris request/reply as the transport of typed values, encoded
+// into binary messages with pluggable serialization formats (JSON and gob built
+// in), keeping the encoding concerns out of the core binding.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/project-iris/iris-go.v1"
+)
+
+// Returned (wrapped) if the request couldn't be encoded, before anything was sent
+// to the relay.
+var ErrEncode = errors.New("failed to encode request")
+
+// Returned (wrapped) if the reply couldn't be decoded, after the request was
+// serviced remotely.
+var ErrDecode = errors.New("failed to decode reply")
+
+// Serialization format to convert between typed values and binary messages.
+type Codec interface {
+	// Encodes a value into its binary representation.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Decodes a binary representation into the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codec serializing values with the encoding/json package.
+var JSONCodec Codec = jsonCodec{}
+
+// Codec serializing values with the encoding/gob package. Interface values need
+// their concrete types registered beforehand via gob.Register.
+var GobCodec Codec = gobCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Executes a synchronous request, encoding the typed request and decoding the
+// received reply with the given codec.
+func TypedRequest[Req, Rep any](conn *iris.Connection, cluster string, request Req, codec Codec, timeout time.Duration) (Rep, error) {
+	var reply Rep
+	err := execute(conn, codec, cluster, request, &reply, timeout)
+	return reply, err
+}
+
+// Wraps a typed request handler into one operating on binary blobs encoded with
+// the given codec, suitable for servicing ServiceHandler.HandleRequest calls:
+//
+//	handle := codec.HandleTypedRequest(codec.JSONCodec, func(req Query) (Result, error) { ... })
+func HandleTypedRequest[Req, Rep any](codec Codec, handler func(Req) (Rep, error)) func([]byte) ([]byte, error) {
+	return func(request []byte) ([]byte, error) {
+		var req Req
+		if err := codec.Unmarshal(request, &req); err != nil {
+			return nil, fmt.Errorf("failed to decode request: %v", err)
+		}
+		rep, err := handler(req)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Marshal(rep)
+	}
+}
+
+// Executes a synchronous request, JSON encoding the request value and decoding
+// the received reply into the value pointed to by reply.
+func RequestJSON(conn *iris.Connection, cluster string, request interface{}, reply interface{}, timeout time.Duration) error {
+	return execute(conn, JSONCodec, cluster, request, reply, timeout)
+}
+
+// Wraps a typed request handler into one operating on JSON encoded binary blobs,
+// suitable for servicing ServiceHandler.HandleRequest invocations.
+func HandleRequestJSON[Req, Rep any](handler func(Req) (Rep, error)) func([]byte) ([]byte, error) {
+	return HandleTypedRequest(JSONCodec, handler)
+}
+
+// Executes a synchronous request, gob encoding the request value and decoding
+// the received reply into the value pointed to by reply. Interface values need
+// their concrete types registered beforehand via gob.Register on both sides.
+//
+// A reply not matching the type of reply fails with ErrDecode.
+func RequestGob(conn *iris.Connection, cluster string, request interface{}, reply interface{}, timeout time.Duration) error {
+	return execute(conn, GobCodec, cluster, request, reply, timeout)
+}
+
+// Wraps a typed request handler into one operating on gob encoded binary blobs,
+// suitable for servicing ServiceHandler.HandleRequest invocations.
+func HandleRequestGob[Req, Rep any](handler func(Req) (Rep, error)) func([]byte) ([]byte, error) {
+	return HandleTypedRequest(GobCodec, handler)
+}
+
+// Executes a synchronous request, encoding the request value and decoding the
+// received reply into the value pointed to by reply with the given codec.
+func execute(conn *iris.Connection, codec Codec, cluster string, request interface{}, reply interface{}, timeout time.Duration) error {
+	req, err := codec.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEncode, err)
+	}
+	rep, err := conn.Request(cluster, req, timeout)
+	if err != nil {
+		return err
+	}
+	if err := codec.Unmarshal(rep, reply); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package codec
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/project-iris/iris-go.v1"
+	"gopkg.in/project-iris/iris-go.v1/iristest"
+)
+
+// Request and reply types of the codec tests.
+type testRequest struct {
+	Client  int
+	Request int
+}
+
+type testReply struct {
+	Sum int
+}
+
+// Service handler servicing the requests with the wrapped request handler.
+type testHandler struct {
+	handle func([]byte) ([]byte, error)
+}
+
+func (h *testHandler) Init(conn *iris.Connection) error         { return nil }
+func (h *testHandler) HandleBroadcast(msg []byte)               { panic("not implemented") }
+func (h *testHandler) HandleRequest(req []byte) ([]byte, error) { return h.handle(req) }
+func (h *testHandler) HandleTunnel(tun *iris.Tunnel)            { panic("not implemented") }
+func (h *testHandler) HandleDrop(reason error)                  { panic("not implemented") }
+
+// Adds the two fields of a test request.
+func sum(req testRequest) (testReply, error) {
+	return testReply{Sum: req.Client + req.Request}, nil
+}
+
+// Starts a fake relay with a service registered into the given cluster, and
+// connects a client to it.
+func newTestConn(t *testing.T, cluster string, handle func([]byte) ([]byte, error)) *iris.Connection {
+	relay, err := iristest.NewFakeRelay()
+	if err != nil {
+		t.Fatalf("failed to start fake relay: %v.", err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	serv, err := iris.Register(relay.Port(), cluster, &testHandler{handle: handle}, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	t.Cleanup(func() { serv.Unregister() })
+
+	conn, err := iris.Connect(relay.Port())
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Tests the JSON request/reply wrappers.
+func TestRequestJSON(t *testing.T) {
+	conn := newTestConn(t, "json", HandleRequestJSON(sum))
+
+	// Execute a few typed requests and verify the replies
+	for i := 0; i < 10; i++ {
+		var reply testReply
+		if err := RequestJSON(conn, "json", testRequest{i, 2 * i}, &reply, time.Second); err != nil {
+			t.Fatalf("request failed: %v.", err)
+		}
+		if reply.Sum != 3*i {
+			t.Fatalf("reply mismatch: have %v, want %v.", reply.Sum, 3*i)
+		}
+	}
+	// Verify that unencodable requests fail locally
+	if err := RequestJSON(conn, "json", make(chan int), new(testReply), time.Second); !errors.Is(err, ErrEncode) {
+		t.Fatalf("unencodable request error mismatch: have %v, want %v.", err, ErrEncode)
+	}
+}
+
+// Tests the gob request/reply wrappers.
+func TestRequestGob(t *testing.T) {
+	conn := newTestConn(t, "gob", HandleRequestGob(sum))
+
+	// Execute a few typed requests and verify the replies
+	for i := 0; i < 10; i++ {
+		var reply testReply
+		if err := RequestGob(conn, "gob", testRequest{i, 2 * i}, &reply, time.Second); err != nil {
+			t.Fatalf("request failed: %v.", err)
+		}
+		if reply.Sum != 3*i {
+			t.Fatalf("reply mismatch: have %v, want %v.", reply.Sum, 3*i)
+		}
+	}
+	// Verify that decoding into a mismatching type fails gracefully
+	var wrong string
+	if err := RequestGob(conn, "gob", testRequest{1, 2}, &wrong, time.Second); !errors.Is(err, ErrDecode) {
+		t.Fatalf("mismatching reply error mismatch: have %v, want %v.", err, ErrDecode)
+	}
+}
+
+// Tests the generic typed requests with the built in codecs.
+func TestTypedRequest(t *testing.T) {
+	echo := func(req []byte) ([]byte, error) { return req, nil }
+	conn := newTestConn(t, "echo", echo)
+
+	// Send typed values through the echo service and verify them
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		request := testRequest{Client: 1, Request: 2}
+		reply, err := TypedRequest[testRequest, testRequest](conn, "echo", request, codec, time.Second)
+		if err != nil {
+			t.Fatalf("codec %T: request failed: %v.", codec, err)
+		}
+		if reply != request {
+			t.Fatalf("codec %T: reply mismatch: have %v, want %v.", codec, reply, request)
+		}
+	}
+}
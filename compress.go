@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the optional payload compression of tunnels. The relay protocol has
+// no notion of it, so the two endpoints agree on the algorithm while negotiating
+// the tunnel features: the acceptor only confirms an identical algorithm.
+
+package iris
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Compression algorithm of the messages passing through a tunnel.
+type Compression int
+
+const (
+	NoCompression Compression = iota // Messages are sent as is
+	Gzip                             // Messages are compressed with gzip
+)
+
+// Time allowance of the tunnel negotiation messages to be sent.
+var compressionTimeout = 5 * time.Second
+
+// Returns the textual name of the compression algorithm.
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// Compresses a message according to the negotiated algorithm.
+func (t *Tunnel) compress(message []byte) ([]byte, error) {
+	if t.comp == NoCompression {
+		return message, nil
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(message); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompresses a message according to the negotiated algorithm.
+func (t *Tunnel) decompress(message []byte) ([]byte, error) {
+	if t.comp == NoCompression {
+		return message, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt compressed message: %v", err)
+	}
+	defer zr.Close()
+
+	message, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt compressed message: %v", err)
+	}
+	return message, nil
+}
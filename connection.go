@@ -8,26 +8,39 @@ package iris
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/pool"
+	"golang.org/x/time/rate"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 // Client connection to the Iris network.
+//
+// All the methods of a connection are safe for concurrent use by multiple go-
+// routines. Close may be invoked while other operations are still in progress,
+// which are then aborted with ErrClosed (or rejected if they start afterwards).
 type Connection struct {
 	// Application layer fields
-	handler ServiceHandler // Handler for connection events
+	handler  ServiceHandler                                // Handler for connection events
+	reqServe func(context.Context, []byte) ([]byte, error) // Request handler wrapped by the inbound interceptors
 
-	reqIdx  uint64                 // Index to assign the next request
-	reqReps map[uint64]chan []byte // Reply channels for active requests
-	reqErrs map[uint64]chan error  // Error channels for active requests
-	reqLock sync.RWMutex           // Mutex to protect the result channel maps
+	reqIdx    uint64                   // Index to assign the next request
+	reqReps   map[uint64]chan []byte   // Reply channels for active requests
+	reqErrs   map[uint64]chan error    // Error channels for active requests
+	reqDepth  map[string]int           // Number of active requests per target cluster
+	reqTrace  map[uint64]*RequestTrace // Timing traces of the active traced requests
+	reqTraced int32                    // Number of active traced requests (stamp packets if non-zero)
+	reqLock   sync.RWMutex             // Mutex to protect the result channel maps
 
 	subIdx  uint64            // Index to assign the next subscription (logging purposes)
 	subLive map[string]*topic // Active subscriptions
@@ -46,17 +59,51 @@ type Connection struct {
 
 	reqPool *pool.ThreadPool // Queue and concurrency limiter for the request handlers
 	reqUsed int32            // Actual memory usage of the request queue
+	reqPend int32            // Number of requests queued or being handled
+	reqDups *dedupCache      // Replies of recent idempotent requests (nil = no deduplication)
+
+	drainPend  sync.WaitGroup // Inbound operations still pending processing
+	drainCount int32          // Number of inbound operations still pending (reporting purposes)
+	drainFlag  bool           // Flag whether new inbound operations are rejected
+	drainLock  sync.RWMutex   // Mutex to protect the drain flag
 
 	// Network layer fields
-	sock     net.Conn          // Network connection to the iris node
-	sockBuf  *bufio.ReadWriter // Buffered access to the network socket
-	sockLock sync.Mutex        // Mutex to atomize message sending
-	sockWait int32             // Counter for the pending writes (batch before flush)
+	port    int          // Port of the local relay endpoint
+	cluster string       // Cluster registered as (empty for simple clients)
+	opts    *ConnectOpts // Options the connection was established with
+
+	sock      net.Conn          // Network connection to the iris node
+	sockBuf   *bufio.ReadWriter // Buffered access to the network socket
+	sockLock  sync.Mutex        // Mutex to atomize message sending
+	sockWait  int32             // Counter for the pending writes (batch before flush)
+	sockFlush bool              // Flag whether the batched writes need a flush
+	sockDown  bool              // Flag whether the relay link is down (reconnecting)
+	sockUp    chan struct{}     // Signaler closed when a dropped relay link is restored
+	sockEpoch uint64            // Index of the current relay link, bumped on reconnect
+	sockDrop  atomic.Value      // Reason of the binding dropping the current link itself (string)
+
+	relayVersion atomic.Value  // Protocol version reported by the relay handshake
+	relayAddr    atomic.Value  // Resolved endpoint of the relay the link was dialed to
+	connStats    atomic.Value  // Timings of the most recent relay link establishment
+	pubLimit     *rate.Limiter // Rate limiter of the outbound publishes and broadcasts (nil = unlimited)
+
+	readErrs chan error // Non-fatal protocol violations of the relay (drops if full)
+
+	recvStamp time.Time // Arrival of the packet being processed (only stamped while requests are traced)
+
+	pingTopic string             // Private topic of the keepalive pings (empty if disabled)
+	pong      chan time.Duration // Round-trip times of the arrived keepalive pongs
 
 	// Bookkeeping fields
-	init chan struct{}   // Init channel to receive a success signal
-	quit chan chan error // Quit channel to synchronize receiver termination
-	term chan struct{}   // Channel to signal termination to blocked go-routines
+	stats  metrics         // Activity counters of the connection
+	state  int32           // Current life-cycle state of the connection
+	init   chan struct{}   // Init channel to receive a success signal
+	quit   chan chan error // Quit channel to synchronize receiver termination
+	term   chan struct{}   // Channel to signal termination to blocked go-routines
+	detach chan struct{}   // Channel to signal a user requested tear-down
+
+	closeOnce sync.Once // Guard making the user requested tear-down idempotent
+	closeErr  error     // Result of the first tear-down, for concurrent callers
 
 	Log log15.Logger // Logger with connection id injected
 }
@@ -66,72 +113,320 @@ var nextConnId uint64
 
 // Connects to the Iris network as a simple client.
 func Connect(port int) (*Connection, error) {
-	logger := Log.New("client", atomic.AddUint64(&nextConnId, 1))
-	logger.Info("connecting new client", "relay_port", port)
+	return ConnectWith(port, "", nil, nil)
+}
 
-	conn, err := newConnection(port, "", nil, nil, logger)
+// Connects to the Iris network as a simple client, executes a single synchronous
+// request and tears the connection down, for short lived tools issuing a single
+// call. The timeout bounds the whole exchange, including the relay handshake.
+func QuickRequest(port int, cluster string, request []byte, timeout time.Duration) ([]byte, error) {
+	if timeout < time.Millisecond {
+		return nil, fmt.Errorf("%w: %v < 1ms", ErrInvalidTimeout, timeout)
+	}
+	deadline := time.Now().Add(timeout)
+
+	conn, err := ConnectWith(port, "", nil, &ConnectOpts{DialTimeout: timeout})
 	if err != nil {
-		logger.Warn("failed to connect new client", "reason", err)
-	} else {
-		logger.Info("client connection established")
+		return nil, err
 	}
-	return conn, err
+	defer conn.Close()
+
+	// Fail as timed out if the handshake consumed (nearly) the entire budget
+	left := time.Until(deadline)
+	if left < time.Millisecond {
+		return nil, fmt.Errorf("%w: handshake left %v of %v", ErrTimeout, left, timeout)
+	}
+	return conn.Request(cluster, request, left)
 }
 
-// Connects to a local relay endpoint on port and registers as cluster.
-func newConnection(port int, cluster string, handler ServiceHandler, limits *ServiceLimits, logger log15.Logger) (*Connection, error) {
-	// Connect to the iris relay node
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+// Connects to the Iris network using the specified options. If the cluster is
+// empty, a simple client connection is established, otherwise a new service is
+// registered as a member of the specified cluster, the handler processing all
+// inbound messages (analogous to Register, but returning the connection).
+//
+// If reconnection is enabled, a dropped relay link will be re-established with
+// exponential backoff, restoring the cluster registration and all the active
+// topic subscriptions. Operations pending or requested during the outage fail
+// fast with iris.ErrReconnecting, and tunnels are torn down as the relay loses
+// their state. The handler is notified of a drop only if reconnecting gives up.
+func ConnectWith(port int, cluster string, handler ServiceHandler, opts *ConnectOpts) (*Connection, error) {
+	// Make sure the connection options have valid values
+	opts = finalizeConnectOpts(opts)
+	start := time.Now()
+
+	// Simple clients need neither a handler, nor any service limits
+	if len(cluster) == 0 {
+		logger := opts.Logger.New("client", atomic.AddUint64(&nextConnId, 1))
+		logger.Info("connecting new client", "relay_port", port)
+
+		conn, err := newConnection(port, "", nil, opts, logger)
+		if err != nil {
+			logger.Warn("failed to connect new client", "reason", err)
+		} else {
+			conn.finishConnectStats(start, 0)
+			logger.Info("client connection established")
+		}
+		return conn, err
+	}
+	// Sanity check on the service arguments
+	if handler == nil {
+		return nil, errors.New("nil service handler")
+	}
+	limits := opts.Limits
+
+	logger := opts.Logger.New("service", atomic.AddUint64(&nextServId, 1))
+	logger.Info("registering new service", "relay_port", port, "cluster", cluster,
+		"broadcast_limits", log15.Lazy{func() string {
+			return fmt.Sprintf("%dT|%dB", limits.BroadcastThreads, limits.BroadcastMemory)
+		}},
+		"request_limits", log15.Lazy{func() string {
+			return fmt.Sprintf("%dT|%dB", limits.RequestThreads, limits.RequestMemory)
+		}})
+
+	// Connect to the Iris relay as a service
+	conn, err := newConnection(port, cluster, handler, opts, logger)
 	if err != nil {
+		logger.Warn("failed to register new service", "reason", err)
 		return nil, err
 	}
-	sock, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
+	// Initialize the service handler
+	initStart := time.Now()
+	if err := handler.Init(conn); err != nil {
+		logger.Warn("user failed to initialize service", "reason", err)
+		conn.Close()
 		return nil, err
 	}
+	conn.finishConnectStats(start, time.Since(initStart))
+	logger.Info("service registration completed")
+
+	// Start the handler pools
+	conn.bcastPool.Start()
+	conn.reqPool.Start()
+
+	return conn, nil
+}
+
+// Connects to a local relay endpoint on port and registers as cluster.
+func newConnection(port int, cluster string, handler ServiceHandler, opts *ConnectOpts, logger log15.Logger) (*Connection, error) {
 	// Create the relay object
 	conn := &Connection{
 		// Application layer
 		handler: handler,
 
-		reqReps: make(map[uint64]chan []byte),
-		reqErrs: make(map[uint64]chan error),
-		subLive: make(map[string]*topic),
-		tunLive: make(map[uint64]*Tunnel),
+		reqReps:  make(map[uint64]chan []byte),
+		reqErrs:  make(map[uint64]chan error),
+		reqDepth: make(map[string]int),
+		reqTrace: make(map[uint64]*RequestTrace),
+		subLive:  make(map[string]*topic),
+		tunLive:  make(map[uint64]*Tunnel),
 
 		// Network layer
-		sock:    sock,
-		sockBuf: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
+		port:     port,
+		cluster:  cluster,
+		opts:     opts,
+		pubLimit: newPublishLimiter(opts),
+		readErrs: make(chan error, readErrorBuffer),
 
 		// Bookkeeping
-		quit: make(chan chan error),
-		term: make(chan struct{}),
+		quit:   make(chan chan error),
+		term:   make(chan struct{}),
+		detach: make(chan struct{}),
 
 		Log: logger,
 	}
 	// Initialize service QoS fields
 	if cluster != "" {
-		conn.limits = limits
-		conn.bcastPool = pool.NewThreadPool(limits.BroadcastThreads)
-		conn.reqPool = pool.NewThreadPool(limits.RequestThreads)
+		conn.reqServe = chainContextInterceptors(opts.ContextInterceptors, func(ctx context.Context, request []byte) ([]byte, error) {
+			handle := handler.HandleRequest
+			if handler, ok := handler.(ContextRequestHandler); ok {
+				handle = func(request []byte) ([]byte, error) { return handler.HandleRequestContext(ctx, request) }
+			}
+			return chainInterceptors(opts.RequestInterceptors, handle)(request)
+		})
+		conn.limits = opts.Limits
+		conn.bcastPool = pool.NewThreadPool(conn.limits.BroadcastThreads)
+		conn.reqPool = pool.NewThreadPool(conn.limits.RequestThreads)
+		if opts.DedupTTL > 0 {
+			conn.reqDups = newDedupCache(opts.DedupTTL, opts.DedupSize)
+		}
 	}
-	// Initialize the connection and wait for a confirmation
-	if err := conn.sendInit(cluster); err != nil {
+	// Generate the keepalive topic if liveness checks were requested
+	if opts.KeepAlive > 0 {
+		topic, err := newPingTopic()
+		if err != nil {
+			return nil, err
+		}
+		conn.pingTopic = topic
+		conn.pong = make(chan time.Duration, 1)
+	}
+	// Connect to the relay and wait for a confirmation
+	conn.setState(Connecting)
+	if err := conn.dial(); err != nil {
+		conn.setState(Closed)
 		return nil, err
 	}
-	if _, err := conn.procInit(); err != nil {
+	if err := conn.checkFeatures(); err != nil {
+		conn.sock.Close()
+		conn.setState(Closed)
 		return nil, err
 	}
-	// Start the network receiver and return
+	conn.setState(Connected)
+
+	// Start the network receiver, the write flusher and the liveness checks, then return
 	go conn.process()
+	if opts.FlushInterval > 0 {
+		go conn.flusher()
+	}
+	if opts.KeepAlive > 0 {
+		if err := conn.sendSubscribe(conn.pingTopic); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		go conn.keepalive()
+	}
 	return conn, nil
 }
 
+// Dials the local relay endpoint and executes the initialization handshake. It
+// must only be called while no other goroutine may access the relay socket.
+func (c *Connection) dial() error {
+	// Connect to the iris relay node
+	host := c.opts.Host
+	if host == "" {
+		host = "localhost"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(c.port))
+	if c.opts.DialFunc == nil {
+		resolved, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return err
+		}
+		addr = resolved.String()
+	}
+	stats := new(ConnectStats)
+	start := time.Now()
+
+	var tcp net.Conn
+	var err error
+	if c.opts.DialFunc != nil {
+		tcp, err = c.opts.DialFunc("tcp", addr)
+	} else {
+		tcp, err = net.DialTimeout("tcp", addr, c.opts.DialTimeout)
+	}
+	if err != nil {
+		return dialFailure(err)
+	}
+	stats.Dial = time.Since(start)
+	if tcp, ok := tcp.(*net.TCPConn); ok {
+		tcp.SetNoDelay(!c.opts.Nagle)
+	}
+	// Bound the link setup, lifting the deadline after the handshake completes
+	tcp.SetDeadline(time.Now().Add(c.opts.DialTimeout))
+
+	// Secure the link if requested, before any relay protocol exchange
+	sock := tcp
+	if c.opts.TLSConfig != nil {
+		config := c.opts.TLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		secure, tlsStart := tls.Client(tcp, config), time.Now()
+		if err := secure.Handshake(); err != nil {
+			tcp.Close()
+			if err := dialFailure(err); errors.Is(err, ErrTimeout) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrTLSHandshake, err)
+		}
+		sock = secure
+		stats.TLS = time.Since(tlsStart)
+	}
+	c.sock = sock
+	c.sockBuf = bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriterSize(sock, c.opts.WriteBufferSize))
+	c.sockFlush = false
+
+	// Initialize the connection and wait for a confirmation
+	initStart := time.Now()
+	if err := c.sendInit(c.cluster); err != nil {
+		sock.Close()
+		return err
+	}
+	version, err := c.procInit()
+	if err != nil {
+		sock.Close()
+		return dialFailure(err)
+	}
+	sock.SetDeadline(time.Time{})
+
+	stats.Handshake = time.Since(initStart)
+	stats.Total = time.Since(start)
+	if prev, ok := c.connStats.Load().(*ConnectStats); ok {
+		stats.ServiceInit = prev.ServiceInit
+	}
+	c.connStats.Store(stats)
+
+	c.relayVersion.Store(version)
+	c.relayAddr.Store(addr)
+	c.Log.Debug("relay handshake completed", "relay_addr", addr, "relay_version", version)
+	return nil
+}
+
+// Converts a network timeout during the relay link setup into ErrTimeout, leaving
+// other errors intact.
+func dialFailure(err error) error {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
 // Broadcasts a message to all members of a cluster. No guarantees are made that
 // all recipients receive the message (best effort).
 //
 // The call blocks until the message is forwarded to the local Iris node.
 func (c *Connection) Broadcast(cluster string, message []byte) error {
+	return c.broadcast(context.Background(), cluster, message)
+}
+
+// Broadcasts a message to all members of the connection's own cluster, including
+// itself. Simple clients fail with ErrNotService.
+func (c *Connection) BroadcastSelf(message []byte) error {
+	if c.cluster == "" {
+		return ErrNotService
+	}
+	return c.broadcast(context.Background(), c.cluster, message)
+}
+
+// Broadcasts a message similarly to Broadcast, but failing with ErrTimeout if the
+// message cannot be written to the relay link within the allotted time (e.g. the
+// relay is stuck). Since a timed out write may leave a partial packet behind, the
+// relay link is dropped in that case. A non-positive timeout waits indefinitely.
+func (c *Connection) BroadcastTimeout(cluster string, message []byte, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := c.broadcast(ctx, cluster, message); err != nil {
+		if err == context.DeadlineExceeded {
+			return fmt.Errorf("%w: broadcast not written within %v", ErrTimeout, timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// Broadcasts a message similarly to Broadcast, but aborting the wait for the rate
+// limiter and the relay link write if the context is cancelled, in which case
+// ctx.Err() is returned. Since an aborted write may leave a partial packet behind,
+// the relay link is dropped in that case.
+func (c *Connection) BroadcastContext(ctx context.Context, cluster string, message []byte) error {
+	return c.broadcast(ctx, cluster, message)
+}
+
+// Broadcasts a message to a remote cluster, aborting if the context is cancelled.
+func (c *Connection) broadcast(ctx context.Context, cluster string, message []byte) error {
 	// Sanity check on the arguments
 	if len(cluster) == 0 {
 		return errors.New("empty cluster identifier")
@@ -139,16 +434,104 @@ func (c *Connection) Broadcast(cluster string, message []byte) error {
 	if message == nil || len(message) == 0 {
 		return errors.New("nil or empty message")
 	}
+	if len(message) > c.opts.MaxMsgSize {
+		return ErrMsgTooLarge
+	}
+	if err := c.throttle(ctx); err != nil {
+		return err
+	}
 	// Broadcast and return
 	c.Log.Debug("sending new broadcast", "cluster", cluster, "data", logLazyBlob(message))
-	return c.sendBroadcast(cluster, message)
+	if err := c.sendBroadcast(ctx, cluster, message); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.bcastSent, 1)
+	return nil
 }
 
 // Executes a synchronous request to be serviced by a member of the specified
 // cluster, load-balanced between all participant, returning the received reply.
 //
-// The timeout unit is in milliseconds. Anything lower will fail with an error.
+// The timeout unit is in milliseconds. Anything lower will fail with an error
+// wrapping ErrInvalidTimeout.
 func (c *Connection) Request(cluster string, request []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(context.Background(), cluster, request, timeout)
+}
+
+// Executes a synchronous request to be serviced by a member of the connection's
+// own cluster (possibly itself). Simple clients fail with ErrNotService.
+func (c *Connection) RequestSelf(request []byte, timeout time.Duration) ([]byte, error) {
+	if c.cluster == "" {
+		return nil, ErrNotService
+	}
+	return c.request(context.Background(), c.cluster, request, timeout)
+}
+
+// Executes a synchronous request similarly to Request, using the connection's
+// default request timeout.
+func (c *Connection) RequestDefault(cluster string, request []byte) ([]byte, error) {
+	return c.request(context.Background(), cluster, request, c.opts.DefaultRequestTimeout)
+}
+
+// Executes a synchronous request to be serviced by a member of the specified
+// cluster, sending the metadata alongside the request and returning the one
+// attached to the reply (nil if none). Requests without metadata are sent as is,
+// without any envelope.
+//
+// Replies served within the requesting process are flagged with the
+// LoopbackMetadata entry if the request carried metadata. To detect loopbacks
+// without any other entries, opt in by setting LoopbackMetadata in the request
+// metadata; the entry itself is not sent to the remote handler.
+//
+// The remote handler can access the metadata if it implements the optional
+// ContextRequestHandler interface, or through context aware interceptors.
+func (c *Connection) RequestMeta(cluster string, request []byte, meta Metadata, timeout time.Duration) ([]byte, Metadata, error) {
+	sink := new(metadataSink)
+	ctx := context.WithValue(context.Background(), replyMetadataKey{}, sink)
+	if len(meta) > 0 {
+		// Metadata is framed anyway, tag it with the origin for loopback detection
+		outgoing := Metadata{originMetadata: processOrigin}
+		for key, value := range meta {
+			if key != LoopbackMetadata {
+				outgoing[key] = value
+			}
+		}
+		ctx = WithOutgoingMetadata(ctx, outgoing)
+	}
+
+	reply, err := c.request(ctx, cluster, request, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, sink.md, nil
+}
+
+// Executes a synchronous request to be serviced by a member of the specified
+// cluster, aborting the wait for the reply if the context is cancelled. Should
+// the context's deadline expire earlier than the timeout, the former is used.
+//
+// Since the relay protocol cannot revoke a request once sent, the remote member
+// might still process it, only its reply will be discarded locally.
+func (c *Connection) RequestContext(ctx context.Context, cluster string, request []byte, timeout time.Duration) ([]byte, error) {
+	// Abort early if the context is already done
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("request aborted: %w", err)
+	}
+	// Shorten the timeout if the context expires sooner
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			if left < time.Millisecond {
+				return nil, fmt.Errorf("request aborted: %w", context.DeadlineExceeded)
+			}
+			timeout = left
+		}
+	}
+	return c.request(ctx, cluster, request, timeout)
+}
+
+// Executes a synchronous request, waiting for the reply, a failure, or the user
+// context to be cancelled.
+func (c *Connection) request(ctx context.Context, cluster string, request []byte, timeout time.Duration) ([]byte, error) {
 	// Sanity check on the arguments
 	if len(cluster) == 0 {
 		return nil, errors.New("empty cluster identifier")
@@ -156,19 +539,59 @@ func (c *Connection) Request(cluster string, request []byte, timeout time.Durati
 	if request == nil || len(request) == 0 {
 		return nil, errors.New("nil or empty request")
 	}
+	if len(request) > c.opts.MaxMsgSize {
+		return nil, ErrMsgTooLarge
+	}
 	timeoutms := int(timeout.Nanoseconds() / 1000000)
 	if timeoutms < 1 {
-		return nil, fmt.Errorf("invalid timeout %v < 1ms", timeout)
+		return nil, fmt.Errorf("%w: %v < 1ms", ErrInvalidTimeout, timeout)
+	}
+	if max := c.opts.MaxRequestTimeout; max > 0 && timeout > max {
+		return nil, fmt.Errorf("%w: %v > %v", ErrTimeoutTooLong, timeout, max)
 	}
+	// Run the request through the outbound interceptors and onto the network
+	invoke := chainContextInterceptors(c.opts.OutboundContextInterceptors, func(ctx context.Context, request []byte) ([]byte, error) {
+		return chainInterceptors(c.opts.OutboundInterceptors, func(request []byte) ([]byte, error) {
+			framed, err := frameMetadata(c.opts.MetadataCodec, OutgoingMetadata(ctx), request)
+			if err != nil {
+				return nil, err
+			}
+			reply, err := c.roundtrip(ctx, cluster, framed, timeoutms)
+			if err != nil {
+				return nil, err
+			}
+			md, reply := parseMetadata(c.opts.MetadataCodec, reply)
+			if sink, ok := ctx.Value(replyMetadataKey{}).(*metadataSink); ok {
+				sink.md = md
+			}
+			return reply, nil
+		})(request)
+	})
+	return invoke(ctx, request)
+}
+
+// Sends a request to the relay and waits for the reply, a failure or an abort.
+func (c *Connection) roundtrip(ctx context.Context, cluster string, request []byte, timeoutms int) ([]byte, error) {
 	// Create a reply and error channel for the results
 	repc := make(chan []byte, 1)
 	errc := make(chan error, 1)
 
 	c.reqLock.Lock()
+	if max := c.opts.MaxPending; max > 0 && len(c.reqReps) >= max {
+		c.reqLock.Unlock()
+		return nil, ErrTooManyPending
+	}
 	reqId := c.reqIdx
 	c.reqIdx++
 	c.reqReps[reqId] = repc
 	c.reqErrs[reqId] = errc
+	c.reqDepth[cluster]++
+	trace := requestTraceFrom(ctx)
+	if trace != nil {
+		trace.Sent, trace.FirstByte = time.Time{}, time.Time{}
+		c.reqTrace[reqId] = trace
+		atomic.AddInt32(&c.reqTraced, 1)
+	}
 	c.reqLock.Unlock()
 
 	// Make sure the result channels are cleaned up
@@ -176,15 +599,30 @@ func (c *Connection) Request(cluster string, request []byte, timeout time.Durati
 		c.reqLock.Lock()
 		delete(c.reqReps, reqId)
 		delete(c.reqErrs, reqId)
+		if c.reqDepth[cluster]--; c.reqDepth[cluster] == 0 {
+			delete(c.reqDepth, cluster)
+		}
+		if trace != nil {
+			delete(c.reqTrace, reqId)
+			atomic.AddInt32(&c.reqTraced, -1)
+		}
 		close(repc)
 		close(errc)
 		c.reqLock.Unlock()
 	}()
 	// Send the request
-	c.Log.Debug("sending new request", "local_request", reqId, "cluster", cluster, "data", logLazyBlob(request), "timeout", timeout)
+	c.Log.Debug("sending new request", "local_request", reqId, "cluster", cluster, "data", logLazyBlob(request), "timeout", time.Duration(timeoutms)*time.Millisecond)
+	start := time.Now()
 	if err := c.sendRequest(reqId, cluster, request, timeoutms); err != nil {
 		return nil, err
 	}
+	atomic.AddUint64(&c.stats.reqSent, 1)
+	if trace != nil {
+		c.reqLock.Lock()
+		trace.Sent = time.Now()
+		c.reqLock.Unlock()
+	}
+
 	// Retrieve the results or fail if terminating
 	var reply []byte
 	var err error
@@ -192,19 +630,79 @@ func (c *Connection) Request(cluster string, request []byte, timeout time.Durati
 	select {
 	case <-c.term:
 		err = ErrClosed
+	case <-ctx.Done():
+		err = fmt.Errorf("request aborted: %w", ctx.Err())
 	case reply = <-repc:
 	case err = <-errc:
 	}
+	if err == ErrTimeout {
+		atomic.AddUint64(&c.stats.reqTime, 1)
+	} else if err == nil {
+		c.stats.observeLatency(time.Since(start))
+	}
 	c.Log.Debug("request completed", "local_request", reqId, "data", logLazyBlob(reply), "error", err)
 	return reply, err
 }
 
-// Subscribes to a topic, using handler as the callback for arriving events.
+// Subscribes to a topic, using handler as the callback for arriving events. If the
+// topic is already subscribed to, ErrAlreadySubscribed is returned.
 //
 // The method blocks until the subscription is forwarded to the relay. There
 // might be a small delay between subscription completion and start of event
 // delivery. This is caused by subscription propagation through the network.
 func (c *Connection) Subscribe(topic string, handler TopicHandler, limits *TopicLimits) error {
+	return c.SubscribeWith(topic, handler, SubscribeOpts{Limits: limits})
+}
+
+// Subscribes to a topic similarly to Subscribe, but using a plain function as the
+// callback for arriving events.
+func (c *Connection) SubscribeFunc(topic string, handler func(event []byte)) error {
+	if handler == nil {
+		return errors.New("nil subscription handler")
+	}
+	return c.SubscribeWith(topic, TopicHandlerFunc(handler), SubscribeOpts{})
+}
+
+// Subscribes to a topic similarly to SubscribeFunc, but passing the name of the
+// topic to the callback along with each event.
+func (c *Connection) SubscribeFuncOn(topic string, handler func(topic string, event []byte)) error {
+	if handler == nil {
+		return errors.New("nil subscription handler")
+	}
+	return c.SubscribeWith(topic, TopicEventHandlerFunc(handler), SubscribeOpts{})
+}
+
+// Replaces the handler and options of an existing subscription. The relay side of
+// the subscription is left intact, so no events are lost during the swap, but the
+// ones still queued for the old handler are discarded.
+func (c *Connection) Resubscribe(topic string, handler TopicHandler, opts SubscribeOpts) error {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return errors.New("empty topic identifier")
+	}
+	if handler == nil {
+		return errors.New("nil subscription handler")
+	}
+	opts = finalizeSubscribeOpts(opts)
+
+	// Swap out the local subscription if it exists
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+
+	old, ok := c.subLive[topic]
+	if !ok {
+		return errors.New("not subscribed")
+	}
+	old.logger.Info("replacing topic subscription")
+	old.terminate()
+
+	c.subLive[topic] = newTopic(topic, handler, opts, !c.opts.PropagateEventPanics, old.logger)
+	return nil
+}
+
+// Subscribes to a topic similarly to Subscribe, but allowing the inbound event
+// buffer and its overflow policy to be customized.
+func (c *Connection) SubscribeWith(topic string, handler TopicHandler, opts SubscribeOpts) error {
 	// Sanity check on the arguments
 	if len(topic) == 0 {
 		return errors.New("empty topic identifier")
@@ -212,22 +710,31 @@ func (c *Connection) Subscribe(topic string, handler TopicHandler, limits *Topic
 	if handler == nil {
 		return errors.New("nil subscription handler")
 	}
-	// Make sure the subscription limits have valid values
-	limits = finalizeTopicLimits(limits)
+	if opts.ReplayLast < 0 {
+		return errors.New("negative replay count")
+	}
+	if opts.ReplayLast > 0 {
+		if err := c.require(FeatureRetention); err != nil {
+			return err
+		}
+	}
+	// Make sure the subscription options have valid values
+	opts = finalizeSubscribeOpts(opts)
+	limits := opts.Limits
 
 	// Subscribe locally
 	c.subLock.Lock()
 	if _, ok := c.subLive[topic]; ok {
 		c.subLock.Unlock()
-		return errors.New("already subscribed")
+		return ErrAlreadySubscribed
 	}
 	logger := c.Log.New("topic", atomic.AddUint64(&c.subIdx, 1))
 	logger.Info("subscribing to new topic", "name", topic,
 		"limits", log15.Lazy{func() string {
-			return fmt.Sprintf("%dT|%dB", limits.EventThreads, limits.EventMemory)
+			return fmt.Sprintf("%dT|%dB|%dE", limits.EventThreads, limits.EventMemory, opts.BufferSize)
 		}})
 
-	c.subLive[topic] = newTopic(handler, limits, logger)
+	c.subLive[topic] = newTopic(topic, handler, opts, !c.opts.PropagateEventPanics, logger)
 	c.subLock.Unlock()
 
 	// Send the subscription request
@@ -243,11 +750,157 @@ func (c *Connection) Subscribe(topic string, handler TopicHandler, limits *Topic
 	return err
 }
 
+// Retrieves the number of events dropped from a live subscription due to its
+// inbound queue overflowing.
+func (c *Connection) DroppedEvents(topic string) (uint64, error) {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	top, ok := c.subLive[topic]
+	if !ok {
+		return 0, errors.New("not subscribed")
+	}
+	return top.dropped(), nil
+}
+
+// Retrieves the number of outbound requests currently awaiting a reply.
+func (c *Connection) Pending() int {
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
+
+	return len(c.reqReps)
+}
+
+// Retrieves the number of live tunnels of the connection, both inbound and
+// outbound, to help track down tunnels leaked without being closed.
+func (c *Connection) OpenTunnels() int {
+	c.tunLock.RLock()
+	defer c.tunLock.RUnlock()
+
+	return len(c.tunLive)
+}
+
+// Retrieves the number of outbound requests issued through this connection to the
+// specified cluster that haven't completed yet (replied, failed, timed out or been
+// aborted), for adaptive concurrency limiting in front of Request.
+//
+// The relay protocol doesn't report the load of remote clusters, so this is only
+// the local view: requests of other clients and the queueing inside the cluster
+// are not accounted for.
+func (c *Connection) QueueDepth(cluster string) (int, error) {
+	if len(cluster) == 0 {
+		return 0, errors.New("empty cluster identifier")
+	}
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
+
+	return c.reqDepth[cluster], nil
+}
+
+// Reports whether the specified cluster currently has any members, allowing the
+// callers to fail fast instead of waiting for a request timeout.
+//
+// If the relay can't report membership, this returns an error wrapping
+// ErrFeatureUnavailable, and callers should fall back to the request timeouts.
+// Relays speaking v1.0-draft2 have no membership query, so it always fails.
+func (c *Connection) HasMembers(cluster string) (bool, error) {
+	if len(cluster) == 0 {
+		return false, errors.New("empty cluster identifier")
+	}
+	if err := c.require(FeatureMembership); err != nil {
+		return false, err
+	}
+	// No known relay protocol carries a membership query yet
+	return false, fmt.Errorf("%w: %v", ErrFeatureUnavailable, FeatureMembership)
+}
+
+// Retrieves the topics the connection is currently subscribed to, in sorted
+// order. Subscriptions restored after a reconnect are included too.
+func (c *Connection) Subscriptions() []string {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	topics := make([]string, 0, len(c.subLive))
+	for topic := range c.subLive {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
 // Publishes an event asynchronously to topic. No guarantees are made that all
 // subscribers receive the message (best effort).
 //
 // The method blocks until the message is forwarded to the local Iris node.
 func (c *Connection) Publish(topic string, event []byte) error {
+	return c.publish(context.Background(), topic, event)
+}
+
+// Publishes an event similarly to Publish, but aborting the wait for the rate
+// limiter and the relay link write if the context is cancelled, in which case
+// ctx.Err() is returned. Since an aborted write may leave a partial packet behind,
+// the relay link is dropped in that case.
+func (c *Connection) PublishContext(ctx context.Context, topic string, event []byte) error {
+	return c.publish(ctx, topic, event)
+}
+
+// Publishes a batch of events to a topic, preserving their order. As opposed to
+// calling Publish in a loop, the events are written to the relay link in one go,
+// with a single flush at the end. If any of the events is invalid, none are sent.
+func (c *Connection) PublishBatch(topic string, events [][]byte) error {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return errors.New("empty topic identifier")
+	}
+	for i, event := range events {
+		if event == nil || len(event) == 0 {
+			return fmt.Errorf("nil or empty event #%d", i)
+		}
+		if len(event) > c.opts.MaxMsgSize {
+			return fmt.Errorf("%w: event #%d", ErrMsgTooLarge, i)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	for range events {
+		if err := c.throttle(context.Background()); err != nil {
+			return err
+		}
+	}
+	// Publish the whole batch and return
+	c.Log.Debug("publishing event batch", "topic", topic, "events", len(events))
+	if err := c.sendPublishBatch(topic, events); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.pubSent, uint64(len(events)))
+	return nil
+}
+
+// Publishes an event to a topic similarly to Publish, asking the relay to retain
+// the last keep events of the topic for replaying them to new subscribers that
+// request it via SubscribeOpts.ReplayLast.
+//
+// If the relay doesn't support retention, nothing is published and an error
+// wrapping ErrFeatureUnavailable is returned, so callers can fall back to plain
+// publishing. Relays speaking v1.0-draft2 retain no events, so it always fails.
+func (c *Connection) PublishRetained(topic string, event []byte, keep int) error {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return errors.New("empty topic identifier")
+	}
+	if keep <= 0 {
+		return errors.New("non-positive retention count")
+	}
+	if err := c.require(FeatureRetention); err != nil {
+		return err
+	}
+	// No known relay protocol carries a retention count yet
+	return fmt.Errorf("%w: %v", ErrFeatureUnavailable, FeatureRetention)
+}
+
+// Publishes an event to a topic, aborting if the context is cancelled.
+func (c *Connection) publish(ctx context.Context, topic string, event []byte) error {
 	// Sanity check on the arguments
 	if len(topic) == 0 {
 		return errors.New("empty topic identifier")
@@ -255,9 +908,31 @@ func (c *Connection) Publish(topic string, event []byte) error {
 	if event == nil || len(event) == 0 {
 		return errors.New("nil or empty event")
 	}
+	if len(event) > c.opts.MaxMsgSize {
+		return ErrMsgTooLarge
+	}
+	if err := c.throttle(ctx); err != nil {
+		return err
+	}
 	// Publish and return
 	c.Log.Debug("publishing new event", "topic", topic, "data", logLazyBlob(event))
-	return c.sendPublish(topic, event)
+	if err := c.sendPublish(ctx, topic, event); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.pubSent, 1)
+	return nil
+}
+
+// Unsubscribes from all the topics the connection is subscribed to. All of them
+// are attempted even if some fail, and the first failure is returned.
+func (c *Connection) UnsubscribeAll() error {
+	var failure error
+	for _, topic := range c.Subscriptions() {
+		if err := c.Unsubscribe(topic); err != nil && failure == nil {
+			failure = fmt.Errorf("failed to unsubscribe from %s: %w", topic, err)
+		}
+	}
+	return failure
 }
 
 // Unsubscribes from topic, receiving no more event notifications for it.
@@ -300,24 +975,65 @@ func (c *Connection) Unsubscribe(topic string) error {
 // The timeout unit is in milliseconds. Anything lower will fail with an error.
 func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
 	// Simple call indirection to move into the tunnel source file
-	return c.initTunnel(cluster, timeout)
+	return c.initTunnel(context.Background(), cluster, timeout, finalizeTunnelOpts(nil))
+}
+
+// Opens a direct tunnel to a member of a remote cluster, similarly to Tunnel,
+// but allowing the tunnel's options to be customized.
+func (c *Connection) TunnelWith(cluster string, timeout time.Duration, opts *TunnelOpts) (*Tunnel, error) {
+	return c.initTunnel(context.Background(), cluster, timeout, finalizeTunnelOpts(opts))
+}
+
+// Opens a direct tunnel to a member of a remote cluster similarly to Tunnel, but
+// abandoning the construction if the context is cancelled. A tunnel confirmed by
+// the relay after the abandonment is closed automatically.
+func (c *Connection) TunnelContext(ctx context.Context, cluster string, timeout time.Duration) (*Tunnel, error) {
+	return c.initTunnel(ctx, cluster, timeout, finalizeTunnelOpts(nil))
 }
 
 // Gracefully terminates the connection removing all subscriptions and closing
 // all active tunnels.
 //
+// Every failure during the tear-down is reported, joined into a single error via
+// errors.Join (e.g. a tunnel failing to close along with the relay link). Nil is
+// returned only if all of them succeeded.
+//
 // The call blocks until the connection tear-down is confirmed by the Iris node.
+// It is idempotent and safe to call concurrently: subsequent calls wait for the
+// first one to finish, returning nil.
 func (c *Connection) Close() error {
+	first := false
+	c.closeOnce.Do(func() {
+		first = true
+		c.closeErr = c.close()
+	})
+	if !first {
+		return nil
+	}
+	return c.closeErr
+}
+
+// Tears down the connection, invoked exactly once by Close.
+func (c *Connection) close() error {
 	c.Log.Info("detaching from relay")
 
-	// Send a graceful close to the relay node
-	if err := c.sendClose(); err != nil {
-		return err
+	// Abort any reconnection attempts and send a graceful close to the relay node
+	select {
+	case <-c.detach:
+	default:
+		close(c.detach)
 	}
-	// Wait till the close syncs and return
-	errc := make(chan error, 1)
-	c.quit <- errc
+	// Tear down the live tunnels, so the remote pairs see a graceful closure
+	failures := []error{c.closeTunnels()}
 
+	// Wait till the close syncs, unless it could not even be sent
+	var errc chan error
+	if err := c.sendClose(); err != nil && err != ErrReconnecting {
+		failures = append(failures, err)
+	} else {
+		errc = make(chan error, 1)
+		c.quit <- errc
+	}
 	// Terminate all running subscription handlers
 	c.subLock.Lock()
 	for _, topic := range c.subLive {
@@ -326,5 +1042,130 @@ func (c *Connection) Close() error {
 	}
 	c.subLock.Unlock()
 
-	return <-errc
+	// Stop all the service thread pools (drop unprocessed messages)
+	if c.reqPool != nil {
+		c.reqPool.Terminate(true)
+		c.bcastPool.Terminate(true)
+	}
+	if errc != nil {
+		failures = append(failures, <-errc)
+	}
+	return errors.Join(failures...)
+}
+
+// Closes all the live tunnels concurrently, waiting for the relay to acknowledge
+// the tear-downs for up to a bounded time. The failures of the individual tunnels
+// are joined into the returned error, nil if every tear-down succeeded.
+func (c *Connection) closeTunnels() error {
+	c.tunLock.RLock()
+	tunnels := make([]*Tunnel, 0, len(c.tunLive))
+	for _, tun := range c.tunLive {
+		tunnels = append(tunnels, tun)
+	}
+	c.tunLock.RUnlock()
+
+	var (
+		pend     sync.WaitGroup
+		failures []error
+		failLock sync.Mutex
+	)
+	for _, tun := range tunnels {
+		pend.Add(1)
+		go func(tun *Tunnel) {
+			defer pend.Done()
+			if err := tun.Close(); err != nil {
+				tun.Log.Warn("failed to close tunnel", "reason", err)
+
+				failLock.Lock()
+				failures = append(failures, fmt.Errorf("tunnel %d: %w", tun.id, err))
+				failLock.Unlock()
+			}
+		}(tun)
+	}
+	done := make(chan struct{})
+	go func() {
+		pend.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(tunnelCloseTimeout):
+		c.Log.Warn("tunnel closures timed out", "timeout", tunnelCloseTimeout)
+
+		failLock.Lock()
+		failures = append(failures, fmt.Errorf("closing tunnels: %w", ErrTimeout))
+		failLock.Unlock()
+	}
+	failLock.Lock()
+	defer failLock.Unlock()
+
+	return errors.Join(failures...)
+}
+
+// Retrieves the number of inbound requests currently queued or being handled by
+// the service. The concurrently running handlers are capped by the RequestThreads
+// service limit, whereas requests overflowing the RequestMemory limit of the queue
+// are rejected with a "service busy" remote error.
+func (c *Connection) InFlight() int {
+	return int(atomic.LoadInt32(&c.reqPend))
+}
+
+// Retrieves the cluster the connection is registered as, or an empty string for
+// simple clients.
+func (c *Connection) Cluster() string {
+	return c.cluster
+}
+
+// Gracefully terminates the connection similarly to Close, but beforehand stops
+// accepting new inbound broadcasts, requests and tunnels, waiting for up to the
+// timeout for the already accepted ones to be processed. If the timeout elapses,
+// the connection is forcefully closed and the abandoned operations reported.
+//
+// Requests arriving during the drain are rejected with a remote error, whereas
+// inbound broadcasts and tunnels are dropped.
+func (c *Connection) Drain(timeout time.Duration) error {
+	c.Log.Info("draining inbound operations", "timeout", timeout)
+
+	// Reject any new inbound operations
+	c.drainLock.Lock()
+	c.drainFlag = true
+	c.drainLock.Unlock()
+
+	// Wait for the pending ones to finish, or the timeout to expire
+	done := make(chan struct{})
+	go func() {
+		c.drainPend.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return c.Close()
+	case <-time.After(timeout):
+		abandoned := atomic.LoadInt32(&c.drainCount)
+		c.Log.Warn("drain timed out", "abandoned", abandoned)
+		if err := c.Close(); err != nil {
+			return err
+		}
+		return fmt.Errorf("drain timed out, %d operations abandoned", abandoned)
+	}
+}
+
+// Registers a new inbound operation for draining purposes, returning false if
+// the connection is already draining and the operation should be rejected.
+func (c *Connection) beginInbound() bool {
+	c.drainLock.RLock()
+	defer c.drainLock.RUnlock()
+
+	if c.drainFlag {
+		return false
+	}
+	c.drainPend.Add(1)
+	atomic.AddInt32(&c.drainCount, 1)
+	return true
+}
+
+// Marks an inbound operation finished for draining purposes.
+func (c *Connection) endInbound() {
+	atomic.AddInt32(&c.drainCount, -1)
+	c.drainPend.Done()
 }
@@ -0,0 +1,277 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the pool of client connections, spreading the operations of highly
+// concurrent clients over multiple relay links.
+
+package iris
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy of a connection pool selecting the member to issue an operation on.
+type PoolStrategy int
+
+const (
+	RoundRobin    PoolStrategy = iota // Cycle through the healthy members in order
+	LeastInFlight                     // Pick the healthy member with the fewest operations in progress
+)
+
+// Returns the textual name of the pool strategy.
+func (s PoolStrategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case LeastInFlight:
+		return "least-in-flight"
+	default:
+		return fmt.Sprintf("PoolStrategy(%d)", int(s))
+	}
+}
+
+// Pool of simple client connections to the local relay, load-balancing requests,
+// broadcasts, publishes and tunnels across the healthy members. Members whose
+// relay link is down (reconnecting) are skipped, and members torn down for good
+// are re-dialed in the background with exponential backoff.
+//
+// The pool is safe for concurrent use.
+type ConnPool struct {
+	port int           // Port of the local relay endpoint
+	opts *ConnPoolOpts // Finalized options of the pool
+
+	members []*poolMember // Pooled connections, replaced when re-dialed
+	next    uint32        // Index of the next member to try (round-robin)
+
+	quit chan struct{}  // Quit channel of the member supervisors
+	done sync.WaitGroup // Termination barrier of the member supervisors
+	once sync.Once      // Guard making the tear-down idempotent
+}
+
+// A single slot of a connection pool.
+type poolMember struct {
+	conn     *Connection  // Current connection of the slot (nil while re-dialing)
+	lock     sync.RWMutex // Mutex protecting the connection during replacement
+	inflight int32        // Number of operations in progress on the slot
+}
+
+// Opens a pool of simple client connections to the local relay on port. If any
+// of the initial connections fails, the ones already opened are closed and the
+// error is returned.
+func NewConnPool(port int, opts *ConnPoolOpts) (*ConnPool, error) {
+	opts = finalizeConnPoolOpts(opts)
+	if opts.Size < 0 {
+		return nil, fmt.Errorf("invalid pool size %d < 0", opts.Size)
+	}
+	pool := &ConnPool{
+		port:    port,
+		opts:    opts,
+		members: make([]*poolMember, opts.Size),
+		quit:    make(chan struct{}),
+	}
+	for i := range pool.members {
+		conn, err := ConnectWith(port, "", nil, opts.Connect)
+		if err != nil {
+			for _, member := range pool.members[:i] {
+				member.conn.Close()
+			}
+			return nil, err
+		}
+		pool.members[i] = &poolMember{conn: conn}
+	}
+	for _, member := range pool.members {
+		pool.done.Add(1)
+		go pool.supervise(member)
+	}
+	return pool, nil
+}
+
+// Executes a synchronous request on a healthy member of the pool, similarly to
+// Connection.Request.
+func (p *ConnPool) Request(cluster string, request []byte, timeout time.Duration) (reply []byte, err error) {
+	err = p.do(func(conn *Connection) error {
+		reply, err = conn.Request(cluster, request, timeout)
+		return err
+	})
+	return reply, err
+}
+
+// Executes a synchronous request on a healthy member of the pool, similarly to
+// Connection.RequestContext.
+func (p *ConnPool) RequestContext(ctx context.Context, cluster string, request []byte, timeout time.Duration) (reply []byte, err error) {
+	err = p.do(func(conn *Connection) error {
+		reply, err = conn.RequestContext(ctx, cluster, request, timeout)
+		return err
+	})
+	return reply, err
+}
+
+// Broadcasts a message through a healthy member of the pool, similarly to
+// Connection.Broadcast.
+func (p *ConnPool) Broadcast(cluster string, message []byte) error {
+	return p.do(func(conn *Connection) error {
+		return conn.Broadcast(cluster, message)
+	})
+}
+
+// Publishes an event through a healthy member of the pool, similarly to
+// Connection.Publish.
+func (p *ConnPool) Publish(topic string, event []byte) error {
+	return p.do(func(conn *Connection) error {
+		return conn.Publish(topic, event)
+	})
+}
+
+// Opens a tunnel through a healthy member of the pool, similarly to
+// Connection.Tunnel. The tunnel is bound to the member's relay link, and it is
+// not counted as in flight after construction.
+func (p *ConnPool) Tunnel(cluster string, timeout time.Duration) (tun *Tunnel, err error) {
+	err = p.do(func(conn *Connection) error {
+		tun, err = conn.Tunnel(cluster, timeout)
+		return err
+	})
+	return tun, err
+}
+
+// Returns the number of members whose relay link is currently up.
+func (p *ConnPool) Healthy() int {
+	healthy := 0
+	for _, member := range p.members {
+		member.lock.RLock()
+		if member.conn != nil && member.conn.State() == Connected {
+			healthy++
+		}
+		member.lock.RUnlock()
+	}
+	return healthy
+}
+
+// Closes all the members of the pool, stopping the re-dialing of dropped ones.
+// Any subsequent operation fails with ErrClosed.
+func (p *ConnPool) Close() error {
+	var errs []error
+	p.once.Do(func() {
+		close(p.quit)
+		p.done.Wait()
+
+		for _, member := range p.members {
+			member.lock.Lock()
+			if member.conn != nil {
+				if err := member.conn.Close(); err != nil {
+					errs = append(errs, err)
+				}
+				member.conn = nil
+			}
+			member.lock.Unlock()
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Runs an operation on a member selected by the pool's strategy, tracking it as
+// in flight. If the pool has no healthy members, ErrReconnecting is returned.
+func (p *ConnPool) do(op func(conn *Connection) error) error {
+	select {
+	case <-p.quit:
+		return ErrClosed
+	default:
+	}
+	member, conn := p.pick()
+	if member == nil {
+		return ErrReconnecting
+	}
+	defer member.lock.RUnlock()
+
+	atomic.AddInt32(&member.inflight, 1)
+	defer atomic.AddInt32(&member.inflight, -1)
+
+	return op(conn)
+}
+
+// Selects a healthy member according to the pool's strategy, returning it with
+// its read lock held so the connection isn't replaced beneath the operation.
+func (p *ConnPool) pick() (*poolMember, *Connection) {
+	size := uint32(len(p.members))
+	if size == 0 {
+		return nil, nil
+	}
+	start := atomic.AddUint32(&p.next, 1) - 1
+
+	var best *poolMember
+	for i := uint32(0); i < size; i++ {
+		member := p.members[(start+i)%size]
+
+		member.lock.RLock()
+		if member.conn == nil || member.conn.State() != Connected {
+			member.lock.RUnlock()
+			continue
+		}
+		if p.opts.Strategy == RoundRobin {
+			return member, member.conn
+		}
+		// Least in-flight, keep the lock of the best candidate only
+		if best == nil || atomic.LoadInt32(&member.inflight) < atomic.LoadInt32(&best.inflight) {
+			if best != nil {
+				best.lock.RUnlock()
+			}
+			best = member
+		} else {
+			member.lock.RUnlock()
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best, best.conn
+}
+
+// Watches a member of the pool, re-dialing it with exponential backoff whenever
+// its connection is torn down for good, until the pool is closed.
+func (p *ConnPool) supervise(member *poolMember) {
+	defer p.done.Done()
+
+	for {
+		member.lock.RLock()
+		conn := member.conn
+		member.lock.RUnlock()
+
+		select {
+		case <-p.quit:
+			return
+		case <-conn.Closed():
+		}
+		conn.Log.Warn("pooled connection dropped, re-dialing")
+
+		member.lock.Lock()
+		member.conn = nil
+		member.lock.Unlock()
+
+		backoff := reconnectBackoff
+		for {
+			select {
+			case <-p.quit:
+				return
+			case <-time.After(backoff):
+			}
+			fresh, err := ConnectWith(p.port, "", nil, p.opts.Connect)
+			if err == nil {
+				member.lock.Lock()
+				member.conn = fresh
+				member.lock.Unlock()
+				break
+			}
+			Log.Warn("pooled connection re-dial failed", "reason", err)
+			if backoff *= 2; backoff > p.opts.MaxBackoff {
+				backoff = p.opts.MaxBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the inbound request deduplication cache, answering retried requests
+// carrying an idempotency key with the reply of the first successful execution.
+
+package iris
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Metadata entry carrying the idempotency key of a request. Requests framed with
+// a key via RetryPolicy.IdempotencyKey are recognized too.
+const IdempotencyKeyMetadata = "iris-idempotency-key"
+
+// Fault message of duplicates whose original is still being processed when the
+// duplicate's requester stops waiting.
+const faultDuplicate = "duplicate request still in progress"
+
+// Cache of the replies to recently served idempotent requests.
+type dedupCache struct {
+	ttl  time.Duration // Time to retain a reply after the request completes
+	size int           // Maximum number of requests tracked
+
+	entries map[string]*list.Element // Tracked requests indexed by their key
+	recency *list.List               // Tracked requests, most recently used first
+	lock    sync.Mutex               // Mutex protecting the index and the recency list
+}
+
+// A single tracked request, either in progress or completed.
+type dedupEntry struct {
+	key    string        // Idempotency key of the request
+	reply  []byte        // Cached reply, if the request succeeded
+	ok     bool          // Flag whether the request succeeded
+	expiry time.Time     // Time when the cached reply expires
+	done   chan struct{} // Signaler of the request completing
+}
+
+// Creates a deduplication cache with the given retention policy.
+func newDedupCache(ttl time.Duration, size int) *dedupCache {
+	return &dedupCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		recency: list.New(),
+	}
+}
+
+// Serves a request keyed by an idempotency key. If a reply is cached, it's
+// returned without running the handler; if the same request is in progress, its
+// outcome is awaited until the deadline. Only successful replies are cached, so
+// failed requests are re-executed by their duplicates.
+func (d *dedupCache) serve(key string, deadline time.Time, run func() ([]byte, string)) ([]byte, string) {
+	d.lock.Lock()
+	if elem, ok := d.entries[key]; ok {
+		entry := elem.Value.(*dedupEntry)
+
+		select {
+		case <-entry.done:
+			if time.Now().After(entry.expiry) {
+				d.remove(elem) // Expired, execute anew below
+				break
+			}
+			d.recency.MoveToFront(elem)
+			d.lock.Unlock()
+			return entry.reply, ""
+		default:
+			d.recency.MoveToFront(elem)
+			d.lock.Unlock()
+
+			// Original still in progress, wait for it to complete
+			wait := time.NewTimer(time.Until(deadline))
+			defer wait.Stop()
+
+			select {
+			case <-entry.done:
+				if entry.ok {
+					return entry.reply, ""
+				}
+				return d.serve(key, deadline, run)
+			case <-wait.C:
+				return nil, faultDuplicate
+			}
+		}
+	}
+	// Unknown (or expired) request, track it and make room if needed
+	entry := &dedupEntry{key: key, done: make(chan struct{})}
+	elem := d.recency.PushFront(entry)
+	d.entries[key] = elem
+	for d.recency.Len() > d.size {
+		d.remove(d.recency.Back())
+	}
+	d.lock.Unlock()
+
+	// Execute the request and cache the reply if successful
+	reply, fault := run()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if fault == "" {
+		// The reply may alias the request (e.g. an echo handler), which is recycled
+		// after the reply is sent if buffer reuse is enabled, so cache a private copy
+		entry.reply = append([]byte(nil), reply...)
+		entry.ok = true
+		entry.expiry = time.Now().Add(d.ttl)
+		reply = entry.reply
+	} else if d.entries[key] == elem {
+		d.remove(elem)
+	}
+	close(entry.done)
+	return reply, fault
+}
+
+// Drops a tracked request from the cache. The lock must be held.
+func (d *dedupCache) remove(elem *list.Element) {
+	entry := d.recency.Remove(elem).(*dedupEntry)
+	if d.entries[entry.key] == elem {
+		delete(d.entries, entry.key)
+	}
+}
+
+// Extracts the idempotency key of an inbound request from its metadata, or from
+// the key framing of the payload. An empty key means the request is not keyed.
+func requestIdempotencyKey(md Metadata, body []byte) string {
+	if key := md[IdempotencyKeyMetadata]; key != "" {
+		return key
+	}
+	key, _ := ParseIdempotencyKey(body)
+	return key
+}
@@ -174,7 +174,13 @@ pending operations terminate with iris.ErrClosed.
 Additionally, the requests/reply pattern supports sending back an error instead of
 a reply to the caller. To enable the originating node to check whether a request
 failed locally or remotely, all remote errors are wrapped in an iris.RemoteError
-type.
+type. If the remote handler panics, the wrapped error is an iris.PanicError with
+the panic value, and - if the service enabled ConnectOpts.PanicStack - the stack
+trace of the handler.
+
+The special values are instances of the iris.TimeoutError and iris.ClosedError
+types, so besides direct comparison, errors.Is, errors.As and type switches all
+work, even if the error was wrapped by an intermediate layer.
 
     _, err := conn.Request("cluster", request, timeout)
     switch err {
@@ -198,7 +204,8 @@ To prevent the network from overwhelming an attached process, the binding places
 thread and memory limits on the broadcasts/requests inbound to a registered
 service as well as on the events received by a topic subscription. The thread
 limit defines the concurrent processing allowance, whereas the memory limit the
-maximal length of the pending queue.
+maximal length of the pending queue. Requests overflowing the queue are rejected
+with a "service busy" remote error, whereas broadcasts and events are dropped.
 
 The default values - listed below - can be overridden during service registration
 and topic subscription via iris.ServiceLimits and iris.TopicLimits. Any unset
@@ -218,9 +225,17 @@ fields (i.e. value of zero) will default to the preset ones.
       EventMemory:  64 * 1024 * 1024,
     }
 
-There is also a sanity limit on the input buffer of a tunnel, but it is not
-exposed through the API as tunnels are meant as structural primitives, not
-sensitive to load. This may change in the future.
+There is also a sanity limit on the input buffer of a tunnel, its flow-control
+window (64MB by default), which can be overridden through iris.TunnelOpts when
+opening a tunnel via conn.TunnelWith, or for the accepted tunnels of a service
+via iris.ConnectOpts. Note, a slow reader may need to buffer an entire window,
+so the memory cost of large windows is per tunnel.
+
+Subscriptions made via conn.SubscribeWith may additionally bound the number of
+pending events through iris.SubscribeOpts, and pick how overflows are handled:
+dropping the newest event (default), dropping the oldest pending ones, or blocking
+until the handler catches up. The number of dropped events of a topic can be
+queried via conn.DroppedEvents.
 
 Logging
 
@@ -264,6 +279,12 @@ arbitrarily many key-value pairs may be included in the entry.
     CRIT[06-22|18:39:49] critical entry                           client=1 bool=false int=1 string=two
     INFO[06-22|18:39:49] detaching from relay                     client=1
 
+Instead of iris.Log, a connection may also derive its logger from any custom
+log15.Logger, specified through the Logger field of iris.ConnectOpts.
+
+    logger := log15.New("app", "gateway")
+    conn, _ := iris.ConnectWith(55555, "", nil, &iris.ConnectOpts{Logger: logger})
+
 For further capabilities, configurations and details about the logger, please
 consult the log15 docs [https://godoc.org/github.com/inconshreveable/log15].
 
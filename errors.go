@@ -6,15 +6,191 @@
 
 package iris
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // Returned whenever a time-limited operation expires.
-var ErrTimeout = errors.New("operation timed out")
+var ErrTimeout error = &TimeoutError{}
 
 // Returned if an operation is requested on a closed entity.
-var ErrClosed = errors.New("entity closed")
+var ErrClosed error = &ClosedError{}
 
-// Wrapper to differentiate between local and remote errors.
+// Returned if an operation is requested during, or interrupted by a relay link
+// outage while the connection is reconnecting. The operation may be retried.
+var ErrReconnecting = errors.New("relay link down, reconnecting")
+
+// Returned when retrieving the result of an asynchronous request after it was
+// cancelled.
+var ErrCancelled = errors.New("request cancelled")
+
+// Returned if the TLS negotiation with the relay failed, as opposed to the relay
+// rejecting the connection initialization.
+var ErrTLSHandshake = errors.New("relay TLS handshake failed")
+
+// Returned if an operation is requested with a timeout below the millisecond
+// resolution of the relay protocol (including zero and negative ones).
+var ErrInvalidTimeout = errors.New("invalid timeout")
+
+// Returned if a request is issued with a timeout exceeding the maximum the relay
+// holds a pending request for (see ConnectOpts.MaxRequestTimeout).
+var ErrTimeoutTooLong = errors.New("timeout exceeds relay maximum")
+
+// Returned if subscribing to a topic the connection is already subscribed to. The
+// existing subscription must be dropped first, or replaced via Resubscribe.
+var ErrAlreadySubscribed = errors.New("already subscribed")
+
+// Returned if an operation targeting the connection's own cluster is requested
+// on a simple client connection, not registered as a service.
+var ErrNotService = errors.New("connection not registered as a service")
+
+// Returned (wrapped in a RelayVersionError) if the relay refuses to speak the
+// protocol version of the binding.
+var ErrUnsupportedRelay = errors.New("unsupported relay protocol version")
+
+// Returned if an optional feature is requested, but the attached relay doesn't
+// support it. The operation may be retried without the feature.
+var ErrFeatureUnavailable = errors.New("feature unavailable on relay")
+
+// Reported (wrapped) on the ReadErrors channel if the relay sends a well-formed
+// packet that makes no sense to the binding, e.g. referencing an id never issued.
+var ErrProtocol = errors.New("relay protocol violation")
+
+// Returned if a message exceeds the maximum size allowed by the connection.
+var ErrMsgTooLarge = errors.New("message too large")
+
+// Returned if a request is issued while the maximum allowed are already pending.
+var ErrTooManyPending = errors.New("too many pending requests")
+
+// Returned if a tunnel is opened while the maximum allowed are already live.
+var ErrTooManyTunnels = errors.New("too many live tunnels")
+
+// Returned if a publish or broadcast exceeds the rate limit of the connection and
+// fail fast throttling was requested.
+var ErrThrottled = errors.New("outbound rate exceeded")
+
+// Returned by a request router if no handler is registered for the request kind.
+var ErrRouteNotFound = errors.New("no route for request kind")
+
+// Returned if a message is sent through a tunnel after half-closing it.
+var ErrSendClosed = errors.New("tunnel send direction closed")
+
+// Returned if a tunnel message cannot be sent without waiting for the remote pair
+// to grant more space allowance.
+var ErrWouldBlock = errors.New("tunnel send would block")
+
+// Returned if the endpoints of a tunnel couldn't agree on the payload compression.
+var ErrCompressionMismatch = errors.New("tunnel compression mismatch")
+
+// Returned if the endpoints of a tunnel couldn't agree on the message size limit.
+var ErrMsgSizeMismatch = errors.New("tunnel message size mismatch")
+
+// Returned if the endpoints of a tunnel couldn't exchange their identities.
+var ErrIdentifyFailed = errors.New("tunnel peer identification failed")
+
+// Error type of time-limited operations that expired before completing.
+type TimeoutError struct{}
+
+// Implements the error interface.
+func (e *TimeoutError) Error() string { return "operation timed out" }
+
+// Reports that the error is a timeout, in line with the net.Error convention.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Error type of operations requested on, or interrupted by a closed entity.
+type ClosedError struct{}
+
+// Implements the error interface.
+func (e *ClosedError) Error() string { return "entity closed" }
+
+// Error type of relay handshakes rejected due to a protocol version mismatch. It
+// wraps ErrUnsupportedRelay, and can be extracted via errors.As. Only denials the
+// relay reports as "have <binding>, want <relay>" are recognized as such; others
+// surface as plain denials with their free text reason.
+type RelayVersionError struct {
+	Binding string // Protocol version offered by the binding
+	Relay   string // Protocol version wanted by the relay
+	Reason  string // Denial reason reported by the relay
+}
+
+// Implements the error interface.
+func (e *RelayVersionError) Error() string {
+	return fmt.Sprintf("%v: binding %s, relay %s: %s", ErrUnsupportedRelay, e.Binding, e.Relay, e.Reason)
+}
+
+// Returns ErrUnsupportedRelay, allowing detection via errors.Is.
+func (e *RelayVersionError) Unwrap() error { return ErrUnsupportedRelay }
+
+// Drop reason of a connection the relay tore down on its own accord (e.g. an admin
+// shutdown), as opposed to the link failing. Such drops are not reconnected.
+type RelayShutdownError struct {
+	Reason string // Tear-down reason reported by the relay, if any
+}
+
+// Implements the error interface.
+func (e *RelayShutdownError) Error() string {
+	if e.Reason == "" {
+		return "relay closed the connection"
+	}
+	return "relay closed the connection: " + e.Reason
+}
+
+// Drop reason of a connection whose relay link failed unexpectedly, either at the
+// network level or by the relay sending undecodable data.
+type NetworkError struct {
+	Err error // Failure the relay link was torn down with
+}
+
+// Implements the error interface.
+func (e *NetworkError) Error() string { return "relay link failed: " + e.Err.Error() }
+
+// Returns the link failure, allowing inspection via errors.Is and errors.As.
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// Drop reason of a connection whose relay link was torn down by the binding itself
+// (e.g. a missed keepalive pong or an aborted stuck write). Tear-downs requested
+// via Close are graceful and not reported as drops.
+type LocalCloseError struct {
+	Reason string // Cause of the binding dropping the link
+	Err    error  // Failure the relay link was torn down with
+}
+
+// Implements the error interface.
+func (e *LocalCloseError) Error() string { return "relay link dropped locally: " + e.Reason }
+
+// Returns the link failure, allowing inspection via errors.Is and errors.As.
+func (e *LocalCloseError) Unwrap() error { return e.Err }
+
+// Wrapper to differentiate between local and remote errors. The message is the
+// error string returned by the remote request handler.
 type RemoteError struct {
 	error
 }
+
+// Returns the wrapped remote failure, allowing inspection via errors.As.
+func (e *RemoteError) Unwrap() error { return e.error }
+
+// Error type of remote request handlers that panicked instead of replying. It is
+// delivered wrapped in a RemoteError, and can be extracted via errors.As.
+type PanicError struct {
+	Value string // Formatted value the remote handler panicked with
+	Stack string // Stack trace of the remote handler (if enabled by the service)
+}
+
+// Implements the error interface.
+func (e *PanicError) Error() string { return faultPanic + e.Value }
+
+// Creates a remote error from the fault message of a failed request, restoring
+// the type of the remote failure where possible.
+func newRemoteError(fault string) *RemoteError {
+	if !strings.HasPrefix(fault, faultPanic) {
+		return &RemoteError{errors.New(fault)}
+	}
+	err := &PanicError{Value: strings.TrimPrefix(fault, faultPanic)}
+	if idx := strings.Index(err.Value, "\n\n"); idx >= 0 {
+		err.Value, err.Stack = err.Value[:idx], err.Value[idx+2:]
+	}
+	return &RemoteError{err}
+}
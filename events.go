@@ -9,47 +9,78 @@
 package iris
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"runtime/debug"
 	"sync/atomic"
 	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
 )
 
 // Schedules an application broadcast message for the service handler to process.
 func (c *Connection) handleBroadcast(message []byte) {
 	id := int(atomic.AddUint64(&c.bcastIdx, 1))
+	atomic.AddUint64(&c.stats.bcastRecv, 1)
 	c.Log.Debug("scheduling arrived broadcast", "broadcast", id, "data", logLazyBlob(message))
 
+	// Drop the broadcast if the connection is draining
+	if !c.beginInbound() {
+		c.Log.Warn("dropping broadcast while draining", "broadcast", id)
+		c.releaseBuffer(message)
+		return
+	}
 	// Make sure there is enough memory for the message
 	used := int(atomic.LoadInt32(&c.bcastUsed)) // Safe, since only 1 thread increments!
 	if used+len(message) <= c.limits.BroadcastMemory {
 		// Increment the memory usage of the queue and schedule the broadcast
 		atomic.AddInt32(&c.bcastUsed, int32(len(message)))
 		c.bcastPool.Schedule(func() {
+			defer c.endInbound()
+
 			// Start the processing by decrementing the memory usage
 			atomic.AddInt32(&c.bcastUsed, -int32(len(message)))
 			c.Log.Debug("handling scheduled broadcast", "broadcast", id)
 			c.handler.HandleBroadcast(message)
+			c.releaseBuffer(message)
 		})
 		return
 	}
 	// Not enough memory in the broadcast queue
+	c.endInbound()
 	c.Log.Error("broadcast exceeded memory allowance", "broadcast", id, "limit", c.limits.BroadcastMemory, "used", used, "size", len(message))
+	c.releaseBuffer(message)
 }
 
 // Schedules an application request for the service handler to process.
 func (c *Connection) handleRequest(id uint64, request []byte, timeout time.Duration) {
+	atomic.AddUint64(&c.stats.reqRecv, 1)
 	logger := c.Log.New("remote_request", id)
 	logger.Debug("scheduling arrived request", "data", logLazyBlob(request), "timeout", timeout)
 
+	// Reject the request if the connection is draining
+	if !c.beginInbound() {
+		logger.Warn("rejecting request while draining")
+		c.releaseBuffer(request)
+		go c.rejectRequest(id, faultDraining, logger)
+		return
+	}
 	// Make sure there is enough memory for the request
 	used := int(atomic.LoadInt32(&c.reqUsed)) // Safe, since only 1 thread increments!
 	if used+len(request) <= c.limits.RequestMemory {
-		// Increment the memory usage of the queue
+		// Increment the memory usage and the pending count of the queue
 		atomic.AddInt32(&c.reqUsed, int32(len(request)))
+		atomic.AddInt32(&c.reqPend, 1)
 
 		// Create the expiration timer and schedule the request
 		expiration := time.After(timeout)
+		deadline := time.Now().Add(timeout)
+		epoch := atomic.LoadUint64(&c.sockEpoch)
 		c.reqPool.Schedule(func() {
+			defer c.endInbound()
+			defer atomic.AddInt32(&c.reqPend, -1)
+			defer c.releaseBuffer(request)
+
 			// Start the processing by decrementing the memory usage
 			atomic.AddInt32(&c.reqUsed, -int32(len(request)))
 
@@ -64,46 +95,145 @@ func (c *Connection) handleRequest(id uint64, request []byte, timeout time.Durat
 			}
 			// Handle the request and return a reply
 			logger.Debug("handling scheduled request")
-			reply, err := c.handler.HandleRequest(request)
-			fault := ""
-			if err != nil {
-				fault = err.Error()
+			reply, fault := c.serveRequest(request, deadline, logger)
+			// Drop the reply if the relay link was re-established meanwhile
+			if atomic.LoadUint64(&c.sockEpoch) != epoch {
+				logger.Warn("dumping reply to request from dropped link")
+				return
+			}
+			// Drop the reply if the requester stopped waiting for it meanwhile
+			if time.Now().After(deadline) {
+				logger.Warn("dumping reply to expired request", "timeout", timeout)
+				return
 			}
-			logger.Debug("replying to handled request", "data", logLazyBlob(reply), "error", err)
+			logger.Debug("replying to handled request", "data", logLazyBlob(reply), "fault", fault)
 			if err := c.sendReply(id, reply, fault); err != nil {
 				logger.Error("failed to send reply", "reason", err)
 			}
 		})
 		return
 	}
-	// Not enough memory in the request queue
+	// Not enough memory in the request queue, reject it
+	c.endInbound()
 	logger.Error("request exceeded memory allowance", "limit", c.limits.RequestMemory, "used", used, "size", len(request))
+	c.releaseBuffer(request)
+	go c.rejectRequest(id, faultBusy, logger)
+}
+
+// Fault messages of the requests rejected or failed without a handler error.
+const (
+	faultBusy     = "service busy"
+	faultDraining = "service draining"
+	faultPanic    = "handler panicked: "
+)
+
+// Serves an inbound request, answering duplicates of recently handled idempotent
+// requests from the deduplication cache if enabled.
+func (c *Connection) serveRequest(request []byte, deadline time.Time, logger log15.Logger) ([]byte, string) {
+	if c.reqDups != nil {
+		if key := requestIdempotencyKey(parseMetadata(c.opts.MetadataCodec, request)); key != "" {
+			return c.reqDups.serve(key, deadline, func() ([]byte, string) {
+				return c.runRequest(request, deadline, logger)
+			})
+		}
+	}
+	return c.runRequest(request, deadline, logger)
+}
+
+// Runs the request handler, converting any returned error or panic into a fault
+// message to send back to the requester. The handler's context expires when the
+// requester stops waiting for the reply.
+func (c *Connection) runRequest(request []byte, deadline time.Time, logger log15.Logger) (reply []byte, fault string) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("request handler panicked", "panic", r)
+			reply, fault = nil, faultPanic+fmt.Sprint(r)
+			if c.opts.PanicStack {
+				fault += "\n\n" + string(debug.Stack())
+			}
+		}
+	}()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	md, body := parseMetadata(c.opts.MetadataCodec, request)
+	sink := new(metadataSink)
+	if stripOrigin(md) {
+		sink.md = Metadata{LoopbackMetadata: "true"}
+	}
+
+	reply, err := c.reqServe(withIncomingMetadata(ctx, md, sink), body)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if reply, err = frameMetadata(c.opts.MetadataCodec, sink.md, reply); err != nil {
+		return nil, err.Error()
+	}
+	return reply, ""
+}
+
+// Sends back a failure reply to an inbound request that cannot be handled.
+func (c *Connection) rejectRequest(id uint64, fault string, logger log15.Logger) {
+	if err := c.sendReply(id, nil, fault); err != nil {
+		logger.Error("failed to send rejection", "reason", err)
+	}
 }
 
 // Looks up a pending request and delivers the result.
 func (c *Connection) handleReply(id uint64, reply []byte, fault string) {
-	c.reqLock.RLock()
-	defer c.reqLock.RUnlock()
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	// Make sure the request is still pending (might have been aborted locally, or
+	// the relay might have sent a spurious duplicate reply)
+	repc, ok := c.reqReps[id]
+	if !ok {
+		c.Log.Warn("dropping reply to unknown or completed request", "local_request", id)
+		if id >= c.reqIdx {
+			c.reportReadError(fmt.Errorf("%w: reply to unissued request #%d", ErrProtocol, id))
+		}
+		return
+	}
+	errc := c.reqErrs[id]
+	if trace, ok := c.reqTrace[id]; ok {
+		trace.FirstByte = c.recvStamp
+	}
+
+	// Retire the request so that any further replies are dropped, not delivered
+	delete(c.reqReps, id)
+	delete(c.reqErrs, id)
 
 	if reply == nil && len(fault) == 0 {
-		c.reqErrs[id] <- ErrTimeout
+		errc <- ErrTimeout
 	} else if reply == nil {
-		c.reqErrs[id] <- &RemoteError{errors.New(fault)}
+		errc <- newRemoteError(fault)
 	} else {
-		c.reqReps[id] <- reply
+		repc <- reply
 	}
 }
 
 // Forwards a topic publish event to the topic subscription.
 func (c *Connection) handlePublish(topic string, event []byte) {
+	// Intercept the keepalive pongs
+	if c.pingTopic != "" && topic == c.pingTopic {
+		c.handlePong(event)
+		return
+	}
+	atomic.AddUint64(&c.stats.pubRecv, 1)
+
 	// Fetch the handler and release the lock fast
 	c.subLock.RLock()
 	top, ok := c.subLive[topic]
 	c.subLock.RUnlock()
 
-	// Make sure the subscription is still live
+	// Make sure the subscription is still live, queueing events inline unless the
+	// overflow policy may block the receiver (ordered ones are queued inline anyway)
 	if ok {
-		top.handlePublish(event)
+		if top.ordered || top.overflow != Block {
+			top.handlePublish(event)
+		} else {
+			go top.handlePublish(event)
+		}
 	} else {
 		c.Log.Warn("stale publish arrived", "topic", topic)
 	}
@@ -129,10 +259,44 @@ func (c *Connection) handleClose(reason error) {
 	c.tunLock.Unlock()
 }
 
+// Fails all operations pending on a dropped relay link: requests are notified to
+// retry, whereas tunnels are torn down as their state was lost relay side.
+func (c *Connection) handleLinkDrop() {
+	c.reqLock.RLock()
+	for _, errc := range c.reqErrs {
+		select {
+		case errc <- ErrReconnecting:
+		default:
+		}
+	}
+	c.reqLock.RUnlock()
+
+	c.tunLock.Lock()
+	for id, tun := range c.tunLive {
+		tun.handleClose("connection dropped")
+		delete(c.tunLive, id)
+	}
+	c.tunLock.Unlock()
+}
+
 // Opens a new local tunnel endpoint and binds it to the remote side.
 func (c *Connection) handleTunnelInit(id uint64, chunkLimit int) {
+	// Drop the tunnel request if the connection is draining
+	if !c.beginInbound() {
+		c.Log.Warn("dropping tunnel request while draining")
+		return
+	}
 	go func() {
+		defer c.endInbound()
+
 		if tun, err := c.acceptTunnel(id, chunkLimit); err == nil {
+			// Serve streaming requests if supported, pass plain tunnels on
+			if handler, ok := c.handler.(StreamRequestHandler); ok {
+				if request, ok := tun.peekStream(); ok {
+					c.serveStream(handler, tun, request)
+					return
+				}
+			}
 			c.handler.HandleTunnel(tun)
 		}
 		// Else: failure already logged by the acceptor
@@ -143,11 +307,15 @@ func (c *Connection) handleTunnelInit(id uint64, chunkLimit int) {
 func (c *Connection) handleTunnelResult(id uint64, chunkLimit int) {
 	// Retrieve the tunnel
 	c.tunLock.RLock()
-	tun := c.tunLive[id]
+	tun, ok := c.tunLive[id]
 	c.tunLock.RUnlock()
 
-	// Finalize initialization
-	tun.handleInitResult(chunkLimit)
+	// Finalize initialization if the tunnel wasn't dropped meanwhile
+	if ok {
+		tun.handleInitResult(chunkLimit)
+	} else {
+		c.checkTunnelId(id, "construction result")
+	}
 }
 
 // Forwards a tunnel data allowance to the requested tunnel.
@@ -160,6 +328,9 @@ func (c *Connection) handleTunnelAllowance(id uint64, space int) {
 	// Notify it of the granted data allowance
 	if ok {
 		tun.handleAllowance(space)
+	} else {
+		c.Log.Debug("dropping allowance of inactive tunnel", "tunnel", id, "space", space)
+		c.checkTunnelId(id, "allowance")
 	}
 }
 
@@ -173,6 +344,32 @@ func (c *Connection) handleTunnelTransfer(id uint64, size int, chunk []byte) {
 	// Notify it of the arrived message chunk
 	if ok {
 		tun.handleTransfer(size, chunk)
+	} else {
+		c.Log.Debug("dropping transfer of inactive tunnel", "tunnel", id, "data", logLazyBlob(chunk))
+		c.checkTunnelId(id, "transfer")
+	}
+}
+
+// Reports a recoverable protocol violation if a tunnel packet references an id
+// never assigned (as opposed to a tunnel closed meanwhile).
+func (c *Connection) checkTunnelId(id uint64, packet string) {
+	c.tunLock.RLock()
+	unissued := id >= c.tunIdx
+	c.tunLock.RUnlock()
+
+	if unissued {
+		c.reportReadError(fmt.Errorf("%w: %s to unissued tunnel #%d", ErrProtocol, packet, id))
+	}
+}
+
+// Queues a recoverable read error for the application, discarding it if the
+// buffer is full.
+func (c *Connection) reportReadError(err error) {
+	c.Log.Warn("relay protocol violation", "reason", err)
+	select {
+	case c.readErrs <- err:
+	default:
+		c.Log.Debug("read error buffer full, discarding", "reason", err)
 	}
 }
 
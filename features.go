@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the relay capability checks, allowing applications to use optional
+// features only if the attached relay supports them.
+
+package iris
+
+import (
+	"fmt"
+	"time"
+)
+
+// Optional capability of the attached relay beyond the base protocol, depending
+// on its version. Features implemented by the bindings themselves, such as tunnel
+// compression, half-closes or keepalives, work through any relay and are hence
+// not listed. Relays speaking v1.0-draft2 provide no optional capabilities.
+type Feature int
+
+const (
+	FeatureMembership Feature = iota // Reporting the presence of cluster members
+	FeatureRetention                 // Retaining recent events for late subscribers
+)
+
+// Optional capabilities provided by each known relay protocol version.
+var relayFeatures = map[string][]Feature{
+	"v1.0-draft2": {},
+}
+
+// Returns the textual name of the feature.
+func (f Feature) String() string {
+	switch f {
+	case FeatureMembership:
+		return "membership"
+	case FeatureRetention:
+		return "retention"
+	default:
+		return fmt.Sprintf("Feature(%d)", int(f))
+	}
+}
+
+// Retrieves the protocol version reported by the relay during the most recent
+// handshake (it may change if the link is re-established to an upgraded relay).
+func (c *Connection) RelayVersion() string {
+	version, _ := c.relayVersion.Load().(string)
+	return version
+}
+
+// Retrieves the resolved relay endpoint (host:port) the most recent relay link was
+// dialed to. Endpoints dialed via ConnectOpts.DialFunc are reported unresolved.
+func (c *Connection) RelayAddr() string {
+	addr, _ := c.relayAddr.Load().(string)
+	return addr
+}
+
+// Retrieves the longest timeout the relay holds a pending request for, as set in
+// the connection options, or zero if unlimited.
+func (c *Connection) MaxRequestTimeout() time.Duration {
+	return c.opts.MaxRequestTimeout
+}
+
+// Checks whether the attached relay supports the requested feature. Unknown relay
+// versions are considered to support none of the optional features, and neither
+// do v1.0-draft2 relays, so the check only matters for future relay versions.
+func (c *Connection) Supports(feature Feature) bool {
+	for _, supported := range relayFeatures[c.RelayVersion()] {
+		if supported == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails with ErrFeatureUnavailable if the attached relay doesn't support the
+// requested feature.
+func (c *Connection) require(feature Feature) error {
+	if !c.Supports(feature) {
+		return fmt.Errorf("%w: %v (relay %s)", ErrFeatureUnavailable, feature, c.RelayVersion())
+	}
+	return nil
+}
+
+// Verifies that the relay supports all the optional features requested by the
+// connection options. Unknown relay versions speaking the binding's protocol are
+// accepted, degrading to the features they are known to support.
+func (c *Connection) checkFeatures() error {
+	if version := c.RelayVersion(); relayFeatures[version] == nil {
+		c.Log.Warn("unknown relay protocol version, optional features disabled", "relay_version", version)
+	}
+	return nil
+}
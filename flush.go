@@ -0,0 +1,49 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the optional write coalescing of outbound publishes and broadcasts,
+// trading a bounded delay for fewer socket writes with bursty senders.
+
+package iris
+
+import "time"
+
+// Flushes any outbound messages buffered by write coalescing to the relay. It is
+// a noop if coalescing is disabled, since messages are flushed immediately then.
+func (c *Connection) Flush() error {
+	// Fail fast if the connection was already torn down
+	select {
+	case <-c.term:
+		return ErrClosed
+	default:
+	}
+	c.sockLock.Lock()
+	defer c.sockLock.Unlock()
+
+	if c.sockDown {
+		return ErrReconnecting
+	}
+	c.sockFlush = false
+	return c.sockBuf.Flush()
+}
+
+// Periodically flushes the buffered outbound messages until the connection is
+// torn down.
+func (c *Connection) flusher() {
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.term:
+			return
+		case <-ticker.C:
+			if err := c.Flush(); err != nil && err != ErrReconnecting && err != ErrClosed {
+				c.Log.Warn("failed to flush buffered writes", "reason", err)
+			}
+		}
+	}
+}
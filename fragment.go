@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the fragmentation of logical messages exceeding the tunnel's message
+// size limit. Each fragment carries its index and the total fragment count, so
+// the receiver can reassemble exactly one complete logical message at a time.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Size of the header prefixed to each fragment: index and total count.
+const fragmentHeader = 4 + 4
+
+// Sends an arbitrarily large logical message over the tunnel, split into as many
+// fragments as needed to fit the tunnel's message size limit. The timeout applies
+// to each fragment separately.
+//
+// The remote side must use RecvMessage to reassemble the message. Concurrent
+// calls are serialized, but plain sends must not be mixed in on the same tunnel.
+func (t *Tunnel) SendMessage(message []byte, timeout time.Duration) error {
+	// Sanity check on the arguments
+	if message == nil || len(message) == 0 {
+		return errors.New("nil or empty message")
+	}
+	size := t.MaxMessageSize() - fragmentHeader
+	if size <= 0 {
+		return fmt.Errorf("%w: message size limit %d below fragment header", ErrMsgTooLarge, t.MaxMessageSize())
+	}
+	total := (len(message) + size - 1) / size
+	if uint64(total) > 1<<32-1 {
+		return fmt.Errorf("%w: %d fragments needed", ErrMsgTooLarge, total)
+	}
+	t.fragSend.Lock()
+	defer t.fragSend.Unlock()
+
+	frame := make([]byte, fragmentHeader+size)
+	binary.BigEndian.PutUint32(frame[4:], uint32(total))
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(message) {
+			end = len(message)
+		}
+		binary.BigEndian.PutUint32(frame, uint32(i))
+		n := copy(frame[fragmentHeader:], message[i*size:end])
+
+		if err := t.Send(frame[:fragmentHeader+n], timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receives a logical message sent via SendMessage, reassembling all its fragments.
+// The timeout applies to each fragment separately; if it expires mid-message, the
+// fragments arrived so far are retained for the next call.
+func (t *Tunnel) RecvMessage(timeout time.Duration) ([]byte, error) {
+	t.fragRecv.Lock()
+	defer t.fragRecv.Unlock()
+
+	for {
+		frame, err := t.Recv(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) <= fragmentHeader {
+			t.fragBuf, t.fragNext = nil, 0
+			return nil, fmt.Errorf("malformed message fragment of %d bytes", len(frame))
+		}
+		index := binary.BigEndian.Uint32(frame)
+		total := binary.BigEndian.Uint32(frame[4:])
+		if index != t.fragNext || index >= total {
+			next := t.fragNext
+			t.fragBuf, t.fragNext = nil, 0
+			return nil, fmt.Errorf("message fragment out of order: have %d/%d, want #%d", index, total, next)
+		}
+		t.fragBuf = append(t.fragBuf, frame[fragmentHeader:]...)
+		if t.fragNext++; t.fragNext == total {
+			message := t.fragBuf
+			t.fragBuf, t.fragNext = nil, 0
+			return message, nil
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the request interceptor chain, allowing cross-cutting concerns such
+// as logging, panic recovery or authorization to be implemented only once.
+
+package iris
+
+import "context"
+
+// Interceptor wrapping the processing of a request. It may inspect or modify the
+// request, invoke next to continue down the chain (eventually reaching the user
+// handler or the network), and inspect or modify the results.
+type RequestInterceptor func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error)
+
+// Wraps the handler into the interceptor chain, the first interceptor running
+// outermost.
+func chainInterceptors(chain []RequestInterceptor, handler func([]byte) ([]byte, error)) func([]byte) ([]byte, error) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], handler
+		handler = func(req []byte) ([]byte, error) {
+			return interceptor(req, next)
+		}
+	}
+	return handler
+}
+
+// Context aware interceptor wrapping the processing of a request. Besides the
+// request body, it has access to the request metadata through the context: the
+// outgoing one via OutgoingMetadata and WithOutgoingMetadata for outbound
+// requests, the incoming one via IncomingMetadata for inbound requests.
+type ContextInterceptor func(ctx context.Context, req []byte, next func(context.Context, []byte) ([]byte, error)) ([]byte, error)
+
+// Wraps the context aware handler into the interceptor chain, the first
+// interceptor running outermost.
+func chainContextInterceptors(chain []ContextInterceptor, handler func(context.Context, []byte) ([]byte, error)) func(context.Context, []byte) ([]byte, error) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], handler
+		handler = func(ctx context.Context, req []byte) ([]byte, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return handler
+}
@@ -7,8 +7,19 @@
 package iris
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/project-iris/iris/pool"
 )
 
 // Tests multiple concurrent client connections.
@@ -92,6 +103,733 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+// Tests that the keepalive pings measure the relay round-trip time.
+func TestConnectKeepAlive(t *testing.T) {
+	// Connect to the local relay with frequent liveness checks
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{KeepAlive: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Wait for a few rounds and verify the link is alive and measured
+	time.Sleep(300 * time.Millisecond)
+	if state := conn.State(); state != Connected {
+		t.Fatalf("live state mismatch: have %v, want %v.", state, Connected)
+	}
+	if rtt := conn.Metrics().KeepAliveRTT; rtt <= 0 {
+		t.Fatalf("keepalive round-trip not measured: %v.", rtt)
+	}
+	// Verify that the keepalive topic is hidden from the subscriptions
+	if subs := conn.Subscriptions(); len(subs) != 0 {
+		t.Fatalf("subscriptions mismatch: have %v, want none.", subs)
+	}
+}
+
+// Tests that a TLS handshake failure is reported distinctly.
+func TestConnectTLSFailure(t *testing.T) {
+	// Connect to the plain text local relay, attempting to negotiate TLS
+	opts := &ConnectOpts{TLSConfig: &tls.Config{}}
+	if conn, err := ConnectWith(config.relay, "", nil, opts); !errors.Is(err, ErrTLSHandshake) {
+		if err == nil {
+			conn.Close()
+		}
+		t.Fatalf("connection error mismatch: have %v, want %v.", err, ErrTLSHandshake)
+	}
+}
+
+// Service handler for the concurrent use tests, accepting all inbound messages.
+type concurrentTestHandler struct {
+	conn *Connection
+}
+
+func (c *concurrentTestHandler) Init(conn *Connection) error              { c.conn = conn; return nil }
+func (c *concurrentTestHandler) HandleBroadcast(msg []byte)               {}
+func (c *concurrentTestHandler) HandleRequest(req []byte) ([]byte, error) { return req, nil }
+func (c *concurrentTestHandler) HandleTunnel(tun *Tunnel)                 { tun.Close() }
+func (c *concurrentTestHandler) HandleDrop(reason error)                  {}
+
+// Topic handler for the concurrent use tests, discarding all events.
+type concurrentTestTopicHandler struct{}
+
+func (c *concurrentTestTopicHandler) HandleEvent(event []byte) {}
+
+// Tests that the public methods of a connection can be used concurrently, even
+// while the connection is being closed. Meant to be run with the race detector.
+func TestConcurrentUse(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		workers int
+		runtime time.Duration
+	}{16, 250 * time.Millisecond}
+
+	// Register a new service to the relay
+	handler := new(concurrentTestHandler)
+	if _, err := ConnectWith(config.relay, config.cluster, handler, nil); err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	conn := handler.conn
+
+	// Hammer the connection from many go-routines, tolerating failures only after
+	// the close was initiated
+	var closing int32
+	errc := make(chan error, conf.workers)
+	for i := 0; i < conf.workers; i++ {
+		go func(id int) {
+			topic := fmt.Sprintf("%s-concurrent-%d", config.topic, id)
+			for atomic.LoadInt32(&closing) == 0 || conn.State() != Closed {
+				err := func() error {
+					if _, err := conn.Request(config.cluster, []byte{byte(id)}, time.Second); err != nil {
+						return fmt.Errorf("request failed: %v", err)
+					}
+					if err := conn.Broadcast(config.cluster, []byte{byte(id)}); err != nil {
+						return fmt.Errorf("broadcast failed: %v", err)
+					}
+					if err := conn.Subscribe(topic, new(concurrentTestTopicHandler), nil); err != nil {
+						return fmt.Errorf("subscription failed: %v", err)
+					}
+					if err := conn.Publish(topic, []byte{byte(id)}); err != nil {
+						return fmt.Errorf("publish failed: %v", err)
+					}
+					if err := conn.Unsubscribe(topic); err != nil {
+						return fmt.Errorf("unsubscription failed: %v", err)
+					}
+					conn.Metrics()
+					conn.Subscriptions()
+					conn.Pending()
+					return nil
+				}()
+				if err != nil {
+					if atomic.LoadInt32(&closing) == 0 {
+						errc <- err
+						return
+					}
+					break
+				}
+			}
+			errc <- nil
+		}(i)
+	}
+	// Close the connection midway and wait for all workers to finish
+	time.Sleep(conf.runtime)
+	atomic.StoreInt32(&closing, 1)
+	if err := conn.Close(); err != nil {
+		t.Fatalf("connection close failed: %v.", err)
+	}
+	for i := 0; i < conf.workers; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatalf("worker failed: %v.", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("worker stuck after close.")
+		}
+	}
+}
+
+// Tests that closing a connection multiple times, even concurrently, is safe.
+func TestConnectDoubleClose(t *testing.T) {
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	// Close the connection from many go-routines at once
+	errc := make(chan error, 8)
+	for i := 0; i < cap(errc); i++ {
+		go func() { errc <- conn.Close() }()
+	}
+	for i := 0; i < cap(errc); i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatalf("connection close failed: %v.", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connection close blocked.")
+		}
+	}
+	// Verify that a subsequent close is a noop
+	if err := conn.Close(); err != nil {
+		t.Fatalf("repeated close failed: %v.", err)
+	}
+}
+
+// Tests that the connection setup phases are timed.
+func TestConnectStats(t *testing.T) {
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	stats := conn.ConnectStats()
+	if stats.Dial <= 0 || stats.Handshake <= 0 {
+		t.Fatalf("phase timings missing: dial %v, handshake %v.", stats.Dial, stats.Handshake)
+	}
+	if stats.TLS != 0 || stats.ServiceInit != 0 {
+		t.Fatalf("unexpected phase timings: tls %v, service init %v.", stats.TLS, stats.ServiceInit)
+	}
+	if stats.Total < stats.Dial+stats.Handshake {
+		t.Fatalf("total below phase sum: have %v, want >= %v.", stats.Total, stats.Dial+stats.Handshake)
+	}
+}
+
+// Tests that a stalling relay handshake times out the connection attempt.
+func TestConnectDialTimeout(t *testing.T) {
+	// Start a listener accepting connections but never responding
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start listener: %v.", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			sock, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer sock.Close()
+		}
+	}()
+	// Connect to it and verify that the handshake is aborted in time
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	start := time.Now()
+	if conn, err := ConnectWith(port, "", nil, &ConnectOpts{DialTimeout: 100 * time.Millisecond}); !errors.Is(err, ErrTimeout) {
+		if err == nil {
+			conn.Close()
+		}
+		t.Fatalf("connection error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("connection attempt took too long: %v.", elapsed)
+	}
+}
+
+// Tests that custom dial functions replace the default TCP transport.
+func TestConnectDialFunc(t *testing.T) {
+	// Route an unresolvable host to the local relay via a custom dialer
+	var dialed []string
+	opts := &ConnectOpts{
+		Host: "relay.invalid",
+		DialFunc: func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+"://"+addr)
+			return net.Dial(network, net.JoinHostPort("localhost", strconv.Itoa(config.relay)))
+		},
+	}
+	conn, err := ConnectWith(config.relay, "", nil, opts)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	want := fmt.Sprintf("tcp://relay.invalid:%d", config.relay)
+	if len(dialed) != 1 || dialed[0] != want {
+		t.Fatalf("dialed endpoints mismatch: have %v, want [%s].", dialed, want)
+	}
+	if addr := conn.RelayAddr(); addr != want[len("tcp://"):] {
+		t.Fatalf("relay address mismatch: have %s, want %s.", addr, want[len("tcp://"):])
+	}
+	if err := conn.Publish(config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("publish through custom transport failed: %v.", err)
+	}
+	// Verify that dial failures are reported
+	failure := errors.New("dial refused")
+	opts.DialFunc = func(network, addr string) (net.Conn, error) { return nil, failure }
+	if _, err := ConnectWith(config.relay, "", nil, opts); !errors.Is(err, failure) {
+		t.Fatalf("connection error mismatch: have %v, want %v.", err, failure)
+	}
+}
+
+// Tests that oversized messages are rejected in both directions.
+func TestMessageSizeLimits(t *testing.T) {
+	// Connect to the local relay with a tiny message limit
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{MaxMsgSize: 16})
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Verify that outbound messages are size checked before sending
+	blob := make([]byte, 17)
+	if _, err := conn.Request(config.cluster, blob, time.Second); err != ErrMsgTooLarge {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrMsgTooLarge)
+	}
+	if err := conn.Broadcast(config.cluster, blob); err != ErrMsgTooLarge {
+		t.Fatalf("broadcast error mismatch: have %v, want %v.", err, ErrMsgTooLarge)
+	}
+	if err := conn.Publish(config.topic, blob); err != ErrMsgTooLarge {
+		t.Fatalf("publish error mismatch: have %v, want %v.", err, ErrMsgTooLarge)
+	}
+	// Verify that an oversized inbound message drops the link
+	handler := &publishTestTopicHandler{delivers: make(chan []byte, 1)}
+	if err := conn.Subscribe(config.topic, handler, nil); err != nil {
+		t.Fatalf("subscription failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	pub, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer pub.Close()
+
+	if err := pub.Publish(config.topic, blob); err != nil {
+		t.Fatalf("publish failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if state := conn.State(); state != Closed {
+		t.Fatalf("state mismatch: have %v, want %v.", state, Closed)
+	}
+}
+
+// Tests that the number of pending requests is capped.
+func TestPendingLimit(t *testing.T) {
+	// Connect to the local relay with a single pending request allowed
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{MaxPending: 1})
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Issue a request to a non-existent cluster and check the cap
+	pend := conn.RequestAsync("non-existent", []byte{0x00}, 250*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if n := conn.Pending(); n != 1 {
+		t.Fatalf("pending count mismatch: have %v, want %v.", n, 1)
+	}
+	if _, err := conn.Request(config.cluster, []byte{0x00}, time.Second); err != ErrTooManyPending {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrTooManyPending)
+	}
+	// Wait for the pending request to time out and verify the slot is freed
+	if _, err := pend.Reply(); err != ErrTimeout {
+		t.Fatalf("pending request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if n := conn.Pending(); n != 0 {
+		t.Fatalf("pending count mismatch: have %v, want %v.", n, 0)
+	}
+}
+
+// Tests that the closed channel fires on connection tear-down.
+func TestConnectClosed(t *testing.T) {
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	select {
+	case <-conn.Closed():
+		t.Fatalf("closed channel fired on live connection.")
+	default:
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("connection close failed: %v.", err)
+	}
+	select {
+	case <-conn.Closed():
+	case <-time.After(time.Second):
+		t.Fatalf("closed channel didn't fire.")
+	}
+}
+
+// Tests that relays denying the protocol version are reported with both versions.
+func TestRelayVersionDenied(t *testing.T) {
+	tests := []struct {
+		reason string
+		relay  string // Expected relay version, empty if not a version denial
+	}{
+		{"unsupported protocol version: have " + protoVersion + ", want v1.1.", "v1.1"},
+		{"unsupported protocol version", ""},
+		{"client version blacklisted by admin", ""},
+	}
+	for i, tt := range tests {
+		// Assemble a denial as the relay would send it
+		buffer := new(bytes.Buffer)
+		relay := &Connection{sockBuf: bufio.NewReadWriter(nil, bufio.NewWriter(buffer))}
+		relay.sendByte(opDeny)
+		relay.sendString(relayMagic)
+		relay.sendString(tt.reason)
+		relay.sockBuf.Flush()
+
+		// Process it through the handshake and verify the reported error
+		conn := &Connection{sockBuf: bufio.NewReadWriter(bufio.NewReader(buffer), nil), opts: finalizeConnectOpts(nil)}
+		_, err := conn.procInit()
+		if err == nil {
+			t.Fatalf("test %d: denied handshake succeeded.", i)
+		}
+		if tt.relay == "" {
+			if errors.Is(err, ErrUnsupportedRelay) {
+				t.Fatalf("test %d: plain denial reported as version mismatch: %v.", i, err)
+			}
+			continue
+		}
+		var version *RelayVersionError
+		if !errors.As(err, &version) || version.Binding != protoVersion || version.Relay != tt.relay {
+			t.Fatalf("test %d: version error mismatch: have %#v, want binding %s, relay %s.", i, err, protoVersion, tt.relay)
+		}
+	}
+}
+
+// Tests that the end-to-end tunnel features work regardless of the relay version.
+func TestFeatureUnknownRelay(t *testing.T) {
+	// Register a new service to the relay, accepting compressed tunnels
+	handler := &tunnelAcceptTestHandler{tunnels: make(chan *Tunnel, 1)}
+	conn, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{Tunnels: &TunnelOpts{Compression: Gzip}})
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Pretend the relay reported an unknown version and verify the tunnel features
+	conn.relayVersion.Store("v0.0-unknown")
+	defer conn.relayVersion.Store(protoVersion)
+
+	tunnel, err := conn.TunnelWith(config.cluster, time.Second, &TunnelOpts{Compression: Gzip})
+	if err != nil {
+		t.Fatalf("compressed tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	if err := tunnel.CloseSend(); err != nil {
+		t.Fatalf("half-close failed: %v.", err)
+	}
+	remote := <-handler.tunnels
+	defer remote.Close()
+
+	if _, err := remote.Recv(time.Second); err != io.EOF {
+		t.Fatalf("half-closed receive error mismatch: have %v, want %v.", err, io.EOF)
+	}
+}
+
+// Tests that the dialed relay endpoint is reported.
+func TestRelayAddr(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Verify that the resolved endpoint points to the relay port
+	_, port, err := net.SplitHostPort(conn.RelayAddr())
+	if err != nil {
+		t.Fatalf("invalid relay address %q: %v.", conn.RelayAddr(), err)
+	}
+	if want := strconv.Itoa(config.relay); port != want {
+		t.Fatalf("relay port mismatch: have %v, want %v.", port, want)
+	}
+}
+
+// Tests that the relay version and capabilities are reported.
+func TestRelayVersion(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Verify the negotiated version and the capabilities derived from it
+	if version := conn.RelayVersion(); version != protoVersion {
+		t.Fatalf("relay version mismatch: have %v, want %v.", version, protoVersion)
+	}
+	if conn.Supports(Feature(-1)) {
+		t.Fatalf("unknown feature supported.")
+	}
+}
+
+// Tests that connection state transitions are reported in order.
+func TestConnectStates(t *testing.T) {
+	// Connect to the local relay, collecting the state changes
+	var states []ConnState
+	opts := &ConnectOpts{
+		OnStateChange: func(state ConnState) { states = append(states, state) },
+	}
+	conn, err := ConnectWith(config.relay, "", nil, opts)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	if state := conn.State(); state != Connected {
+		t.Fatalf("live state mismatch: have %v, want %v.", state, Connected)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("connection close failed: %v.", err)
+	}
+	// Verify the reported transitions
+	want := []ConnState{Connecting, Connected, Closed}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("state transitions mismatch: have %v, want %v.", states, want)
+	}
+}
+
+// Tests that operations on a closed connection fail with the typed errors.
+func TestClosedErrors(t *testing.T) {
+	// Connect to the local relay and tear it down
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("connection close failed: %v.", err)
+	}
+	// Verify that all operations report the closure
+	if err := conn.Broadcast(config.cluster, []byte{0x00}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("broadcast error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+	if _, err := conn.Request(config.cluster, []byte{0x00}, time.Second); !errors.Is(err, ErrClosed) {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+	if _, err := conn.Tunnel(config.cluster, time.Second); !errors.Is(err, ErrClosed) {
+		t.Fatalf("tunnel error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+	var closed *ClosedError
+	if err := conn.Publish(config.topic, []byte{0x00}); !errors.As(err, &closed) {
+		t.Fatalf("publish error type mismatch: have %T, want %T.", err, closed)
+	}
+}
+
+// Tests that the tear-down failures are reported by Close.
+func TestCloseFailures(t *testing.T) {
+	// Register a tunnel endpoint to the relay
+	handler := new(tunnelTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that a clean tear-down reports no failure
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	if _, err := conn.Tunnel(config.cluster, time.Second); err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("connection close failed: %v.", err)
+	}
+	// Verify that tunnels not closing in time are reported
+	defer func(timeout time.Duration) { tunnelCloseTimeout = timeout }(tunnelCloseTimeout)
+	tunnelCloseTimeout = 0
+
+	conn, err = Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	if _, err := conn.Tunnel(config.cluster, time.Second); err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	if err := conn.Close(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("close error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+}
+
+// Tests that recoverable protocol violations are reported without tearing down
+// the connection.
+func TestReadErrors(t *testing.T) {
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Inject packets referencing ids never issued by the connection
+	conn.handleReply(1000, []byte{0xff}, "")
+	conn.handleTunnelAllowance(1000, 1)
+	conn.handleTunnelTransfer(1000, 1, []byte{0xff})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-conn.ReadErrors():
+			if !errors.Is(err, ErrProtocol) {
+				t.Fatalf("read error #%d mismatch: have %v, want %v.", i, err, ErrProtocol)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("read error #%d not reported.", i)
+		}
+	}
+	// Verify that the connection survived and stale ids aren't reported
+	if err := conn.Publish(config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("publish after read errors failed: %v.", err)
+	}
+	if _, err := conn.Request(config.cluster, []byte{0x00}, time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	conn.handleReply(0, []byte{0xff}, "")
+
+	select {
+	case err := <-conn.ReadErrors():
+		t.Fatalf("stale reply reported: %v.", err)
+	default:
+	}
+}
+
+// Tests that connection pools balance operations and replace dropped members.
+func TestConnPool(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	for _, strategy := range []PoolStrategy{RoundRobin, LeastInFlight} {
+		pool, err := NewConnPool(config.relay, &ConnPoolOpts{Size: 3, Strategy: strategy})
+		if err != nil {
+			t.Fatalf("%v: pool creation failed: %v.", strategy, err)
+		}
+		// Verify that requests and publishes are spread over the members
+		for i := 0; i < 9; i++ {
+			if reply, err := pool.Request(config.cluster, []byte{byte(i)}, time.Second); err != nil || !bytes.Equal(reply, []byte{byte(i)}) {
+				t.Fatalf("%v: request #%d mismatch: have %v/%v, want %v/nil.", strategy, i, reply, err, []byte{byte(i)})
+			}
+		}
+		for i, member := range pool.members {
+			if sent := member.conn.Metrics().RequestsSent; sent == 0 {
+				t.Fatalf("%v: member #%d unused.", strategy, i)
+			}
+		}
+		if err := pool.Publish(config.topic, []byte{0x00}); err != nil {
+			t.Fatalf("%v: publish failed: %v.", strategy, err)
+		}
+		// Tear down a member and verify that it's skipped, then replaced
+		pool.members[0].conn.Close()
+		for i := 0; i < 3; i++ {
+			if _, err := pool.Request(config.cluster, []byte{0x00}, time.Second); err != nil {
+				t.Fatalf("%v: request with dropped member failed: %v.", strategy, err)
+			}
+		}
+		for start := time.Now(); pool.Healthy() != 3; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 2*time.Second {
+				t.Fatalf("%v: dropped member not replaced: %d healthy.", strategy, pool.Healthy())
+			}
+		}
+		// Verify that the closed pool rejects operations
+		if err := pool.Close(); err != nil {
+			t.Fatalf("%v: pool close failed: %v.", strategy, err)
+		}
+		if _, err := pool.Request(config.cluster, []byte{0x00}, time.Second); err != ErrClosed {
+			t.Fatalf("%v: closed pool error mismatch: have %v, want %v.", strategy, err, ErrClosed)
+		}
+	}
+}
+
+// Service handler for the drop reason tests, forwarding the drops into a channel.
+type dropTestHandler struct {
+	requestTestHandler
+	drops chan error
+}
+
+func (d *dropTestHandler) HandleDrop(reason error) { d.drops <- reason }
+
+// Creates a dial function connecting to a scripted relay, which accepts the
+// handshake and then runs the tear-down on its end of the link.
+func newDropTestRelay(teardown func(relay *Connection, sock net.Conn)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+		go func() {
+			relay := &Connection{sockBuf: bufio.NewReadWriter(nil, bufio.NewWriter(remote))}
+			relay.sendByte(opInit)
+			relay.sendString(relayMagic)
+			relay.sendString(protoVersion)
+			relay.sockBuf.Flush()
+
+			teardown(relay, remote)
+		}()
+		return local, nil
+	}
+}
+
+// Tests that connection drops are reported with the type of their cause.
+func TestDropReasons(t *testing.T) {
+	tests := []struct {
+		opts     *ConnectOpts
+		teardown func(relay *Connection, sock net.Conn)
+		check    func(reason error) bool
+	}{
+		// Relay closing the connection with a reason
+		{
+			opts: &ConnectOpts{Reconnect: true},
+			teardown: func(relay *Connection, sock net.Conn) {
+				relay.sendByte(opClose)
+				relay.sendString("admin shutdown")
+				relay.sockBuf.Flush()
+			},
+			check: func(reason error) bool {
+				var shutdown *RelayShutdownError
+				return errors.As(reason, &shutdown) && shutdown.Reason == "admin shutdown"
+			},
+		},
+		// Relay link failing at the network level
+		{
+			opts:     &ConnectOpts{},
+			teardown: func(relay *Connection, sock net.Conn) { sock.Close() },
+			check: func(reason error) bool {
+				var network *NetworkError
+				return errors.As(reason, &network)
+			},
+		},
+		// Binding dropping the link after a missed keepalive
+		{
+			opts:     &ConnectOpts{KeepAlive: 50 * time.Millisecond},
+			teardown: func(relay *Connection, sock net.Conn) {},
+			check: func(reason error) bool {
+				var local *LocalCloseError
+				return errors.As(reason, &local) && local.Reason == "keepalive pong missed"
+			},
+		},
+	}
+	for i, tt := range tests {
+		handler := &dropTestHandler{drops: make(chan error, 1)}
+		tt.opts.DialFunc = newDropTestRelay(tt.teardown)
+
+		conn, err := ConnectWith(config.relay, config.cluster, handler, tt.opts)
+		if err != nil {
+			t.Fatalf("test %d: registration failed: %v.", i, err)
+		}
+		select {
+		case reason := <-handler.drops:
+			if !tt.check(reason) {
+				t.Fatalf("test %d: drop reason mismatch: have %T (%v).", i, reason, reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test %d: drop not reported.", i)
+		}
+		conn.Close()
+	}
+}
+
+// Tests that closing a connection with a dead relay link still stops the handlers.
+func TestCloseDroppedLink(t *testing.T) {
+	handler := &dropTestHandler{drops: make(chan error, 1)}
+	opts := &ConnectOpts{DialFunc: newDropTestRelay(func(relay *Connection, sock net.Conn) { sock.Close() })}
+
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	select {
+	case <-handler.drops:
+	case <-time.After(time.Second):
+		t.Fatalf("drop not reported.")
+	}
+	// Close the connection and verify the failed goodbye is reported
+	if err := conn.Close(); err == nil {
+		t.Fatalf("dead link close succeeded.")
+	}
+	// Verify that the service thread pools were terminated nonetheless
+	if err := conn.reqPool.Schedule(func() {}); err != pool.ErrTerminating {
+		t.Fatalf("request pool schedule error mismatch: have %v, want %v.", err, pool.ErrTerminating)
+	}
+	if err := conn.bcastPool.Schedule(func() {}); err != pool.ErrTerminating {
+		t.Fatalf("broadcast pool schedule error mismatch: have %v, want %v.", err, pool.ErrTerminating)
+	}
+}
+
 // Benchmarks client connection.
 func BenchmarkConnect(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Package irisotel propagates OpenTelemetry trace contexts across Iris requests,
+// carrying them in the request metadata through the context aware interceptors.
+//
+//	conn, err := iris.ConnectWith(port, cluster, handler, &iris.ConnectOpts{
+//		ContextInterceptors:         []iris.ContextInterceptor{irisotel.InboundInterceptor()},
+//		OutboundContextInterceptors: []iris.ContextInterceptor{irisotel.OutboundInterceptor()},
+//	})
+package irisotel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/project-iris/iris-go.v1"
+)
+
+// Name of the tracer creating the request spans.
+const tracerName = "gopkg.in/project-iris/iris-go.v1/irisotel"
+
+// Creates an interceptor for outbound requests, starting a client span and
+// injecting its context into the request metadata using the global propagator.
+func OutboundInterceptor() iris.ContextInterceptor {
+	return func(ctx context.Context, req []byte, next func(context.Context, []byte) ([]byte, error)) ([]byte, error) {
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "iris.Request", trace.WithSpanKind(trace.SpanKindClient))
+		defer span.End()
+
+		carrier := propagation.MapCarrier(iris.OutgoingMetadata(ctx))
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+		rep, err := next(iris.WithOutgoingMetadata(ctx, iris.Metadata(carrier)), req)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return rep, err
+	}
+}
+
+// Creates an interceptor for inbound requests, extracting the remote trace context
+// from the request metadata using the global propagator and continuing it with a
+// server span around the handler.
+func InboundInterceptor() iris.ContextInterceptor {
+	return func(ctx context.Context, req []byte, next func(context.Context, []byte) ([]byte, error)) ([]byte, error) {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(iris.IncomingMetadata(ctx)))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "iris.HandleRequest", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		rep, err := next(ctx, req)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return rep, err
+	}
+}
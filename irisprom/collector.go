@@ -0,0 +1,86 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Package irisprom exports the activity metrics of an Iris connection to the
+// Prometheus monitoring system.
+package irisprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/project-iris/iris-go.v1"
+)
+
+// Prometheus collector reporting the activity metrics of an Iris connection.
+type Collector struct {
+	conn *iris.Connection // Connection to collect the metrics of
+
+	counters []*counter       // Descriptors and accessors of the plain counters
+	latency  *prometheus.Desc // Descriptor of the request latency histogram
+	rtt      *prometheus.Desc // Descriptor of the keepalive round-trip gauge
+}
+
+// Descriptor and accessor of a single counter metric.
+type counter struct {
+	desc  *prometheus.Desc
+	value func(m *iris.Metrics) uint64
+}
+
+// Creates a new collector for the connection, tagging all metrics with the given
+// constant labels (e.g. to differentiate multiple connections).
+func NewCollector(conn *iris.Connection, labels prometheus.Labels) *Collector {
+	newCounter := func(name, help string, value func(m *iris.Metrics) uint64) *counter {
+		return &counter{
+			desc:  prometheus.NewDesc("iris_"+name, help, nil, labels),
+			value: value,
+		}
+	}
+	return &Collector{
+		conn: conn,
+		counters: []*counter{
+			newCounter("requests_sent_total", "Outbound requests sent to the relay.", func(m *iris.Metrics) uint64 { return m.RequestsSent }),
+			newCounter("requests_received_total", "Inbound requests received from the relay.", func(m *iris.Metrics) uint64 { return m.RequestsReceived }),
+			newCounter("request_timeouts_total", "Outbound requests that timed out.", func(m *iris.Metrics) uint64 { return m.RequestTimeouts }),
+			newCounter("broadcasts_sent_total", "Outbound broadcasts sent to the relay.", func(m *iris.Metrics) uint64 { return m.BroadcastsSent }),
+			newCounter("broadcasts_received_total", "Inbound broadcasts received from the relay.", func(m *iris.Metrics) uint64 { return m.BroadcastsReceived }),
+			newCounter("publishes_sent_total", "Outbound events published to the relay.", func(m *iris.Metrics) uint64 { return m.PublishesSent }),
+			newCounter("events_received_total", "Inbound topic events received from the relay.", func(m *iris.Metrics) uint64 { return m.EventsReceived }),
+			newCounter("tunnels_opened_total", "Tunnels successfully constructed.", func(m *iris.Metrics) uint64 { return m.TunnelsOpened }),
+			newCounter("messages_throttled_total", "Outbound publishes and broadcasts exceeding the rate limit.", func(m *iris.Metrics) uint64 { return m.MessagesThrottled }),
+		},
+		latency: prometheus.NewDesc("iris_request_latency_seconds", "Latency of the successfully completed outbound requests.", nil, labels),
+		rtt:     prometheus.NewDesc("iris_keepalive_rtt_seconds", "Last measured keepalive round-trip time to the relay.", nil, labels),
+	}
+}
+
+// Implements prometheus.Collector, sending the descriptors of all the metrics.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range c.counters {
+		ch <- counter.desc
+	}
+	ch <- c.latency
+	ch <- c.rtt
+}
+
+// Implements prometheus.Collector, sending a snapshot of all the metrics.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	metrics := c.conn.Metrics()
+
+	for _, counter := range c.counters {
+		ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(counter.value(metrics)))
+	}
+	// Convert the latency histogram into cumulative buckets
+	buckets := make(map[float64]uint64, len(metrics.LatencyBounds))
+
+	var total uint64
+	for i, count := range metrics.LatencyCounts {
+		total += count
+		if i < len(metrics.LatencyBounds) {
+			buckets[metrics.LatencyBounds[i].Seconds()] = total
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(c.latency, total, metrics.LatencySum.Seconds(), buckets)
+	ch <- prometheus.MustNewConstMetric(c.rtt, prometheus.GaugeValue, metrics.KeepAliveRTT.Seconds())
+}
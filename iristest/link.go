@@ -0,0 +1,365 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the relay side of the wire protocol, serving a single binding.
+
+package iristest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet opcodes
+const (
+	opInit  byte = 0x00 // In: connection initiation           | Out: connection acceptance
+	opDeny       = 0x01 // In: <never received>                | Out: connection refusal
+	opClose      = 0x02 // In: connection tear-down initiation | Out: connection tear-down notification
+
+	opBroadcast = 0x03 // In: application broadcast initiation | Out: application broadcast delivery
+	opRequest   = 0x04 // In: application request initiation   | Out: application request delivery
+	opReply     = 0x05 // In: application reply initiation     | Out: application reply delivery
+
+	opSubscribe   = 0x06 // In: topic subscription             | Out: <never sent>
+	opUnsubscribe = 0x07 // In: topic subscription removal     | Out: <never sent>
+	opPublish     = 0x08 // In: topic event publish            | Out: topic event delivery
+
+	opTunInit     = 0x09 // In: tunnel construction request    | Out: tunnel initiation
+	opTunConfirm  = 0x0a // In: tunnel confirmation            | Out: tunnel construction result
+	opTunAllow    = 0x0b // In: tunnel transfer allowance      | Out: <same as in>
+	opTunTransfer = 0x0c // In: tunnel data exchange           | Out: <same as in>
+	opTunClose    = 0x0d // In: tunnel termination request     | Out: tunnel termination notification
+)
+
+// Protocol constants
+var (
+	protoVersion = "v1.0-draft2"
+	clientMagic  = "iris-client-magic"
+	relayMagic   = "iris-relay-magic"
+)
+
+// Maximum size of a binary blob accepted from a binding.
+const maxBlobSize = 256 * 1024 * 1024
+
+// Relay side of a single binding connection.
+type link struct {
+	relay *FakeRelay // Relay routing the messages of the connection
+	conn  net.Conn   // Network connection to the binding
+
+	in      *bufio.Reader // Buffered reader of the inbound packets
+	out     *bufio.Writer // Buffered writer of the outbound packets
+	outLock sync.Mutex    // Mutex serializing the outbound packets
+
+	cluster string              // Cluster the binding registered as, if any
+	topics  map[string]struct{} // Topics subscribed to (relay lock)
+	tunnels map[uint64]*tunnel  // Live tunnels by the binding's ids (relay lock)
+}
+
+// Wraps a freshly accepted network connection into a relay link.
+func newLink(relay *FakeRelay, conn net.Conn) *link {
+	return &link{
+		relay:   relay,
+		conn:    conn,
+		in:      bufio.NewReader(conn),
+		out:     bufio.NewWriter(conn),
+		topics:  make(map[string]struct{}),
+		tunnels: make(map[uint64]*tunnel),
+	}
+}
+
+// Runs the handshake with the binding and processes its packets until it closes
+// the connection or the link drops.
+func (l *link) serve() {
+	defer l.conn.Close()
+
+	if err := l.handshake(); err != nil {
+		l.relay.detach(l, "")
+		return
+	}
+	l.relay.attach(l)
+
+	if err := l.process(); err != nil {
+		l.relay.detach(l, "remote relay link dropped")
+		return
+	}
+	// Graceful close, clean up and acknowledge the tear-down
+	l.relay.detach(l, "")
+	l.send(opClose, "")
+}
+
+// Accepts the connection initiation of the binding if the protocol versions match.
+func (l *link) handshake() error {
+	op, err := l.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	if op != opInit {
+		return fmt.Errorf("protocol violation: invalid init opcode: %v", op)
+	}
+	magic, err := l.recvString()
+	if err != nil {
+		return err
+	}
+	if magic != clientMagic {
+		return fmt.Errorf("protocol violation: invalid client magic: %s", magic)
+	}
+	version, err := l.recvString()
+	if err != nil {
+		return err
+	}
+	if l.cluster, err = l.recvString(); err != nil {
+		return err
+	}
+	if version != protoVersion {
+		l.send(opDeny, relayMagic, "unsupported protocol version: "+version)
+		return fmt.Errorf("unsupported protocol version: %s", version)
+	}
+	return l.send(opInit, relayMagic, protoVersion)
+}
+
+// Retrieves the packets of the binding and routes them until a graceful close
+// (nil result) or a failure.
+func (l *link) process() error {
+	for {
+		op, err := l.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opClose:
+			return nil
+
+		case opBroadcast:
+			cluster, err := l.recvString()
+			if err != nil {
+				return err
+			}
+			message, err := l.recvBinary()
+			if err != nil {
+				return err
+			}
+			l.relay.broadcast(cluster, message)
+
+		case opRequest:
+			id, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			cluster, err := l.recvString()
+			if err != nil {
+				return err
+			}
+			request, err := l.recvBinary()
+			if err != nil {
+				return err
+			}
+			timeout, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			l.relay.request(l, id, cluster, request, time.Duration(timeout)*time.Millisecond)
+
+		case opReply:
+			id, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			success, err := l.recvBool()
+			if err != nil {
+				return err
+			}
+			// The reply and the fault are encoded identically, pass them through
+			result, err := l.recvBinary()
+			if err != nil {
+				return err
+			}
+			l.relay.reply(id, success, result)
+
+		case opSubscribe, opUnsubscribe:
+			topic, err := l.recvString()
+			if err != nil {
+				return err
+			}
+			if op == opSubscribe {
+				l.relay.subscribe(l, topic)
+			} else {
+				l.relay.unsubscribe(l, topic)
+			}
+
+		case opPublish:
+			topic, err := l.recvString()
+			if err != nil {
+				return err
+			}
+			event, err := l.recvBinary()
+			if err != nil {
+				return err
+			}
+			l.relay.publish(topic, event)
+
+		case opTunInit:
+			id, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			cluster, err := l.recvString()
+			if err != nil {
+				return err
+			}
+			timeout, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			l.relay.initTunnel(l, id, cluster, time.Duration(timeout)*time.Millisecond)
+
+		case opTunConfirm:
+			buildId, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			tunId, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			l.relay.confirmTunnel(l, buildId, tunId)
+
+		case opTunAllow:
+			id, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			space, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			l.relay.forward(l, id, opTunAllow, space)
+
+		case opTunTransfer:
+			id, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			size, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			payload, err := l.recvBinary()
+			if err != nil {
+				return err
+			}
+			l.relay.forward(l, id, opTunTransfer, size, payload)
+
+		case opTunClose:
+			id, err := l.recvVarint()
+			if err != nil {
+				return err
+			}
+			l.relay.closeTunnel(l, id)
+
+		default:
+			return fmt.Errorf("protocol violation: unknown opcode: %v", op)
+		}
+	}
+}
+
+// Serializes a packet made of an opcode and a sequence of fields (varints, bools,
+// strings and binary blobs) into the connection.
+func (l *link) send(op byte, fields ...interface{}) error {
+	l.outLock.Lock()
+	defer l.outLock.Unlock()
+
+	if err := l.out.WriteByte(op); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		var err error
+		switch field := field.(type) {
+		case uint64:
+			err = l.sendVarint(field)
+		case bool:
+			if field {
+				err = l.out.WriteByte(1)
+			} else {
+				err = l.out.WriteByte(0)
+			}
+		case string:
+			err = l.sendBinary([]byte(field))
+		case []byte:
+			err = l.sendBinary(field)
+		default:
+			panic(fmt.Sprintf("unsupported field type: %T", field))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return l.out.Flush()
+}
+
+// Serializes a variable int using base 128 encoding into the connection.
+func (l *link) sendVarint(data uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := l.out.Write(buf[:binary.PutUvarint(buf[:], data)])
+	return err
+}
+
+// Serializes a length-tagged binary array into the connection.
+func (l *link) sendBinary(data []byte) error {
+	if err := l.sendVarint(uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := l.out.Write(data)
+	return err
+}
+
+// Retrieves a boolean from the connection.
+func (l *link) recvBool() (bool, error) {
+	b, err := l.in.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, fmt.Errorf("protocol violation: invalid boolean value: %v", b)
+	}
+}
+
+// Retrieves a variable int in base 128 encoding from the connection.
+func (l *link) recvVarint() (uint64, error) {
+	return binary.ReadUvarint(l.in)
+}
+
+// Retrieves a length-tagged binary array from the connection.
+func (l *link) recvBinary() ([]byte, error) {
+	size, err := l.recvVarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > maxBlobSize {
+		return nil, errors.New("protocol violation: binary blob too large")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(l.in, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Retrieves a length-tagged string from the connection.
+func (l *link) recvString() (string, error) {
+	data, err := l.recvBinary()
+	return string(data), err
+}
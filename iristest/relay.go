@@ -0,0 +1,499 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Package iristest provides a fake Iris relay for testing applications without a
+// real relay node running. It speaks enough of the relay protocol on a loopback
+// port for connections, broadcasts, requests, publish/subscribe and tunnels to
+// work, routing the messages between the connections attached to it. Hooks allow
+// injecting failures to exercise the error paths of the application.
+//
+//	relay, err := iristest.NewFakeRelay()
+//	if err != nil {
+//		...
+//	}
+//	defer relay.Close()
+//
+//	conn, err := iris.Connect(relay.Port())
+//
+// There is no network behind the fake: clusters and topics span only the local
+// connections, and events are delivered to the publisher too if subscribed.
+package iristest
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Fate of a message passing through the fake relay, decided by the fault hooks.
+type Fault int
+
+const (
+	Deliver Fault = iota // Forward the message as a real relay would
+	Drop                 // Silently discard the message (requests and tunnels then time out)
+	Timeout              // Report an immediate timeout (requests and tunnels only, others are dropped)
+)
+
+// Maximum data payload of a tunnel transfer, advertised to both tunnel endpoints.
+const chunkLimit = 32 * 1024
+
+// In-process fake of an Iris relay node, accepting binding connections on a
+// loopback port.
+type FakeRelay struct {
+	listener net.Listener // Loopback listener accepting the binding connections
+
+	links    map[*link]struct{}            // Live binding connections
+	clusters map[string][]*link            // Members of each cluster, in joining order
+	topics   map[string]map[*link]struct{} // Subscribers of each topic
+	robin    int                           // Counter rotating the load balancing between members
+
+	reqs   map[uint64]*request // Requests pending a reply, by relay assigned id
+	tuns   map[uint64]*tunnel  // Tunnels pending construction, by relay assigned id
+	nextId uint64              // Next relay assigned request or tunnel id
+
+	onBroadcast func(cluster string, message []byte) Fault // Fault hook of the broadcasts
+	onRequest   func(cluster string, request []byte) Fault // Fault hook of the requests
+	onPublish   func(topic string, event []byte) Fault     // Fault hook of the publishes
+	onTunnel    func(cluster string) Fault                 // Fault hook of the tunnel constructions
+
+	lock   sync.Mutex     // Protects the routing state and the hooks
+	closed bool           // Flag whether the relay was terminated
+	pend   sync.WaitGroup // Running link handlers, waited for on close
+}
+
+// Request routed to a cluster member, waiting for its reply.
+type request struct {
+	origin *link       // Connection the request originated from
+	id     uint64      // Request id assigned by the originator
+	timer  *time.Timer // Timer expiring the request
+}
+
+// Tunnel between two connections, identified by different ids at either end.
+type tunnel struct {
+	id    uint64      // Relay assigned id of the construction
+	ends  [2]*link    // Initiating and accepting connections
+	ids   [2]uint64   // Tunnel ids assigned by the respective ends
+	bound bool        // Flag whether the acceptor confirmed the tunnel
+	timer *time.Timer // Timer expiring the construction (nil once completed)
+}
+
+// Creates a fake relay listening on a random loopback port.
+func NewFakeRelay() (*FakeRelay, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	relay := &FakeRelay{
+		listener: listener,
+		links:    make(map[*link]struct{}),
+		clusters: make(map[string][]*link),
+		topics:   make(map[string]map[*link]struct{}),
+		reqs:     make(map[uint64]*request),
+		tuns:     make(map[uint64]*tunnel),
+	}
+	relay.pend.Add(1)
+	go relay.accept()
+
+	return relay, nil
+}
+
+// Retrieves the port the relay is listening on, to be passed to the binding.
+func (r *FakeRelay) Port() int {
+	return r.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Sets the fault hook of the broadcasts, deciding the fate of each one sent.
+func (r *FakeRelay) OnBroadcast(hook func(cluster string, message []byte) Fault) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onBroadcast = hook
+}
+
+// Sets the fault hook of the requests, deciding the fate of each one sent.
+func (r *FakeRelay) OnRequest(hook func(cluster string, request []byte) Fault) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onRequest = hook
+}
+
+// Sets the fault hook of the publishes, deciding the fate of each one sent.
+func (r *FakeRelay) OnPublish(hook func(topic string, event []byte) Fault) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onPublish = hook
+}
+
+// Sets the fault hook of the tunnels, deciding the fate of each construction.
+func (r *FakeRelay) OnTunnel(hook func(cluster string) Fault) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onTunnel = hook
+}
+
+// Abruptly drops all the live connections, as if the relay crashed. New ones are
+// still accepted, so bindings configured to reconnect will do so.
+func (r *FakeRelay) DropLinks() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for l := range r.links {
+		l.conn.Close()
+	}
+}
+
+// Terminates the relay, dropping all the live connections.
+func (r *FakeRelay) Close() error {
+	err := r.listener.Close()
+
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+
+	r.DropLinks()
+	r.pend.Wait()
+	return err
+}
+
+// Accepts inbound binding connections until the listener is closed.
+func (r *FakeRelay) accept() {
+	defer r.pend.Done()
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		l := newLink(r, conn)
+
+		// Drop the connection if the relay was closed meanwhile, otherwise track it
+		// before Close could start waiting for the pending links
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			conn.Close()
+			continue
+		}
+		r.links[l] = struct{}{}
+		r.pend.Add(1)
+		r.lock.Unlock()
+
+		go func() {
+			defer r.pend.Done()
+			l.serve()
+		}()
+	}
+}
+
+// Joins an initialized connection to its cluster.
+func (r *FakeRelay) attach(l *link) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if l.cluster != "" {
+		r.clusters[l.cluster] = append(r.clusters[l.cluster], l)
+	}
+}
+
+// Removes a terminated connection from all the routing tables, tearing down the
+// tunnels it took part in.
+func (r *FakeRelay) detach(l *link, reason string) {
+	r.lock.Lock()
+	delete(r.links, l)
+	if members := r.clusters[l.cluster]; len(members) > 0 {
+		live := make([]*link, 0, len(members))
+		for _, member := range members {
+			if member != l {
+				live = append(live, member)
+			}
+		}
+		r.clusters[l.cluster] = live
+	}
+	for topic := range l.topics {
+		delete(r.topics[topic], l)
+	}
+	for id, req := range r.reqs {
+		if req.origin == l {
+			req.timer.Stop()
+			delete(r.reqs, id)
+		}
+	}
+	tunnels := l.tunnels
+	l.tunnels = nil
+	for id, tun := range tunnels {
+		peer, peerId := tun.peer(l, id)
+		delete(peer.tunnels, peerId)
+	}
+	r.lock.Unlock()
+
+	// Notify the remote endpoints of the torn down tunnels
+	for id, tun := range tunnels {
+		if peer, peerId := tun.peer(l, id); peer != l {
+			peer.send(opTunClose, peerId, reason)
+		}
+	}
+}
+
+// Picks a member of a cluster to route a request or tunnel to, rotating between
+// them. Must be called with the lock held.
+func (r *FakeRelay) pick(cluster string) *link {
+	members := r.clusters[cluster]
+	if len(members) == 0 {
+		return nil
+	}
+	r.robin++
+	return members[r.robin%len(members)]
+}
+
+// Delivers a broadcast to all the members of a cluster.
+func (r *FakeRelay) broadcast(cluster string, message []byte) {
+	r.lock.Lock()
+	hook := r.onBroadcast
+	members := append([]*link(nil), r.clusters[cluster]...)
+	r.lock.Unlock()
+
+	if hook != nil && hook(cluster, message) != Deliver {
+		return
+	}
+	for _, member := range members {
+		member.send(opBroadcast, message)
+	}
+}
+
+// Routes a request to a member of a cluster, expiring it after the timeout.
+func (r *FakeRelay) request(origin *link, id uint64, cluster string, message []byte, timeout time.Duration) {
+	r.lock.Lock()
+	hook := r.onRequest
+	r.lock.Unlock()
+
+	fault := Deliver
+	if hook != nil {
+		fault = hook(cluster, message)
+	}
+	if fault == Timeout {
+		origin.send(opReply, id, true)
+		return
+	}
+	r.lock.Lock()
+	r.nextId++
+	relayId := r.nextId
+
+	req := &request{origin: origin, id: id}
+	req.timer = time.AfterFunc(timeout, func() { r.expireRequest(relayId) })
+	r.reqs[relayId] = req
+
+	var member *link
+	if fault == Deliver {
+		member = r.pick(cluster)
+	}
+	r.lock.Unlock()
+
+	// Members gone or dropped requests are only notified of when expiring
+	if member != nil {
+		member.send(opRequest, relayId, message, uint64(timeout/time.Millisecond))
+	}
+}
+
+// Forwards the reply of a request to its originator.
+func (r *FakeRelay) reply(id uint64, success bool, result []byte) {
+	r.lock.Lock()
+	req, ok := r.reqs[id]
+	if ok {
+		req.timer.Stop()
+		delete(r.reqs, id)
+	}
+	r.lock.Unlock()
+
+	if ok {
+		req.origin.send(opReply, req.id, false, success, result)
+	}
+}
+
+// Notifies the originator of a request of its expiration.
+func (r *FakeRelay) expireRequest(id uint64) {
+	r.lock.Lock()
+	req, ok := r.reqs[id]
+	delete(r.reqs, id)
+	r.lock.Unlock()
+
+	if ok {
+		req.origin.send(opReply, req.id, true)
+	}
+}
+
+// Delivers a topic event to all the subscribers of the topic.
+func (r *FakeRelay) publish(topic string, event []byte) {
+	r.lock.Lock()
+	hook := r.onPublish
+	subs := make([]*link, 0, len(r.topics[topic]))
+	for sub := range r.topics[topic] {
+		subs = append(subs, sub)
+	}
+	r.lock.Unlock()
+
+	if hook != nil && hook(topic, event) != Deliver {
+		return
+	}
+	for _, sub := range subs {
+		sub.send(opPublish, topic, event)
+	}
+}
+
+// Subscribes a connection to a topic.
+func (r *FakeRelay) subscribe(l *link, topic string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.topics[topic] == nil {
+		r.topics[topic] = make(map[*link]struct{})
+	}
+	r.topics[topic][l] = struct{}{}
+	l.topics[topic] = struct{}{}
+}
+
+// Removes the subscription of a connection from a topic.
+func (r *FakeRelay) unsubscribe(l *link, topic string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.topics[topic], l)
+	delete(l.topics, topic)
+}
+
+// Routes a tunnel construction to a member of a cluster, expiring it after the
+// timeout if not confirmed.
+func (r *FakeRelay) initTunnel(origin *link, id uint64, cluster string, timeout time.Duration) {
+	r.lock.Lock()
+	hook := r.onTunnel
+	r.lock.Unlock()
+
+	fault := Deliver
+	if hook != nil {
+		fault = hook(cluster)
+	}
+	if fault == Timeout {
+		origin.send(opTunConfirm, id, true)
+		return
+	}
+	r.lock.Lock()
+	r.nextId++
+	relayId := r.nextId
+
+	tun := &tunnel{id: relayId, ends: [2]*link{origin, nil}, ids: [2]uint64{id, 0}}
+	tun.timer = time.AfterFunc(timeout, func() { r.expireTunnel(relayId) })
+	r.tuns[relayId] = tun
+
+	var member *link
+	if fault == Deliver {
+		member = r.pick(cluster)
+	}
+	tun.ends[1] = member
+	r.lock.Unlock()
+
+	if member != nil {
+		member.send(opTunInit, relayId, uint64(chunkLimit))
+	}
+}
+
+// Binds a tunnel construction confirmed by the accepting connection. The initiator
+// is only notified when the acceptor's initial allowance arrives, so the tunnel is
+// fully usable by the time its construction completes.
+func (r *FakeRelay) confirmTunnel(l *link, relayId uint64, id uint64) {
+	r.lock.Lock()
+	tun, ok := r.tuns[relayId]
+	if ok && tun.ends[1] == l && !tun.bound && tun.ends[0].tunnels != nil && l.tunnels != nil {
+		tun.ids[1], tun.bound = id, true
+		tun.ends[0].tunnels[tun.ids[0]] = tun
+		l.tunnels[id] = tun
+	} else {
+		ok = false
+	}
+	r.lock.Unlock()
+
+	// Tear down confirmations of expired constructions
+	if !ok {
+		l.send(opTunClose, id, "tunnel construction expired")
+	}
+}
+
+// Notifies the initiator of a tunnel construction of its expiration, tearing down
+// the acceptor's side if it was already bound.
+func (r *FakeRelay) expireTunnel(relayId uint64) {
+	r.lock.Lock()
+	tun, ok := r.tuns[relayId]
+	delete(r.tuns, relayId)
+	if ok && tun.bound {
+		delete(tun.ends[0].tunnels, tun.ids[0])
+		delete(tun.ends[1].tunnels, tun.ids[1])
+	}
+	r.lock.Unlock()
+
+	if ok {
+		tun.ends[0].send(opTunConfirm, tun.ids[0], true)
+		if tun.bound {
+			tun.ends[1].send(opTunClose, tun.ids[1], "tunnel construction expired")
+		}
+	}
+}
+
+// Forwards a tunnel message (allowance or transfer) to the remote endpoint. The
+// first allowance of the acceptor completes the construction at the initiator.
+func (r *FakeRelay) forward(l *link, id uint64, op byte, fields ...interface{}) {
+	r.lock.Lock()
+	tun, ok := l.tunnels[id]
+	var (
+		peer    *link
+		peerId  uint64
+		confirm bool
+	)
+	if ok {
+		peer, peerId = tun.peer(l, id)
+		if tun.timer != nil && op == opTunAllow && tun.ends[1] == l && tun.ids[1] == id {
+			tun.timer.Stop()
+			tun.timer, confirm = nil, true
+			delete(r.tuns, tun.id)
+		}
+	}
+	r.lock.Unlock()
+
+	if ok {
+		peer.send(op, append([]interface{}{peerId}, fields...)...)
+		if confirm {
+			peer.send(opTunConfirm, peerId, false, uint64(chunkLimit))
+		}
+	}
+}
+
+// Tears down a tunnel on the request of one of its endpoints, notifying both.
+func (r *FakeRelay) closeTunnel(l *link, id uint64) {
+	r.lock.Lock()
+	tun, ok := l.tunnels[id]
+	var peer *link
+	var peerId uint64
+	if ok {
+		peer, peerId = tun.peer(l, id)
+		delete(l.tunnels, id)
+		delete(peer.tunnels, peerId)
+	}
+	r.lock.Unlock()
+
+	l.send(opTunClose, id, "")
+	if ok {
+		peer.send(opTunClose, peerId, "")
+	}
+}
+
+// Retrieves the opposite endpoint of a tunnel and the id it knows the tunnel by,
+// given one endpoint and its id (both ends may be the same connection).
+func (t *tunnel) peer(l *link, id uint64) (*link, uint64) {
+	if t.ends[0] == l && t.ids[0] == id {
+		return t.ends[1], t.ids[1]
+	}
+	return t.ends[0], t.ids[0]
+}
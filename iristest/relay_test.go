@@ -0,0 +1,163 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iristest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gopkg.in/project-iris/iris-go.v1"
+)
+
+// Service handler echoing requests and tunnel messages, and forwarding broadcasts.
+type echoTestHandler struct {
+	broadcasts chan []byte
+}
+
+func (e *echoTestHandler) Init(conn *iris.Connection) error         { return nil }
+func (e *echoTestHandler) HandleBroadcast(msg []byte)               { e.broadcasts <- msg }
+func (e *echoTestHandler) HandleRequest(req []byte) ([]byte, error) { return req, nil }
+func (e *echoTestHandler) HandleDrop(reason error)                  {}
+
+func (e *echoTestHandler) HandleTunnel(tun *iris.Tunnel) {
+	defer tun.Close()
+	for {
+		msg, err := tun.Recv(0)
+		if err != nil {
+			return
+		}
+		if err := tun.Send(msg, 0); err != nil {
+			return
+		}
+	}
+}
+
+// Topic handler forwarding the events into a channel.
+type eventTestHandler struct {
+	events chan []byte
+}
+
+func (e *eventTestHandler) HandleEvent(event []byte) { e.events <- event }
+
+// Tests that all the messaging patterns work through the fake relay.
+func TestFakeRelay(t *testing.T) {
+	relay, err := NewFakeRelay()
+	if err != nil {
+		t.Fatalf("failed to start fake relay: %v.", err)
+	}
+	defer relay.Close()
+
+	// Register a service and connect a client
+	handler := &echoTestHandler{broadcasts: make(chan []byte, 1)}
+	serv, err := iris.Register(relay.Port(), "echo", handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	conn, err := iris.Connect(relay.Port())
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Verify broadcasts and requests
+	if err := conn.Broadcast("echo", []byte("broadcast")); err != nil {
+		t.Fatalf("broadcast failed: %v.", err)
+	}
+	select {
+	case msg := <-handler.broadcasts:
+		if !bytes.Equal(msg, []byte("broadcast")) {
+			t.Fatalf("broadcast mismatch: have %q, want %q.", msg, "broadcast")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("broadcast not received.")
+	}
+	if reply, err := conn.Request("echo", []byte("request"), time.Second); err != nil || !bytes.Equal(reply, []byte("request")) {
+		t.Fatalf("request mismatch: have %q/%v, want %q/nil.", reply, err, "request")
+	}
+	// Verify publish/subscribe
+	events := &eventTestHandler{events: make(chan []byte, 1)}
+	if err := conn.Subscribe("topic", events, nil); err != nil {
+		t.Fatalf("subscription failed: %v.", err)
+	}
+	if err := conn.Publish("topic", []byte("event")); err != nil {
+		t.Fatalf("publish failed: %v.", err)
+	}
+	select {
+	case event := <-events.events:
+		if !bytes.Equal(event, []byte("event")) {
+			t.Fatalf("event mismatch: have %q, want %q.", event, "event")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event not received.")
+	}
+	// Verify tunnels, including chunked messages
+	tun, err := conn.Tunnel("echo", time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	for _, size := range []int{1, 4 * chunkLimit} {
+		msg := bytes.Repeat([]byte{0x42}, size)
+		if err := tun.Send(msg, time.Second); err != nil {
+			t.Fatalf("tunnel send failed: %v.", err)
+		}
+		if back, err := tun.Recv(time.Second); err != nil || !bytes.Equal(back, msg) {
+			t.Fatalf("tunnel message mismatch: have %d bytes/%v, want %d bytes/nil.", len(back), err, size)
+		}
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("tunnel close failed: %v.", err)
+	}
+}
+
+// Tests that the fault hooks inject the requested failures.
+func TestFakeRelayFaults(t *testing.T) {
+	relay, err := NewFakeRelay()
+	if err != nil {
+		t.Fatalf("failed to start fake relay: %v.", err)
+	}
+	defer relay.Close()
+
+	serv, err := iris.Register(relay.Port(), "echo", &echoTestHandler{broadcasts: make(chan []byte, 1)}, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	conn, err := iris.Connect(relay.Port())
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Verify that requests and tunnels time out as requested
+	relay.OnRequest(func(cluster string, request []byte) Fault { return Timeout })
+	if _, err := conn.Request("echo", []byte("request"), time.Minute); err != iris.ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, iris.ErrTimeout)
+	}
+	relay.OnRequest(func(cluster string, request []byte) Fault { return Drop })
+	start := time.Now()
+	if _, err := conn.Request("echo", []byte("request"), 100*time.Millisecond); err != iris.ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, iris.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("dropped request expired early: %v.", elapsed)
+	}
+	relay.OnTunnel(func(cluster string) Fault { return Timeout })
+	if _, err := conn.Tunnel("echo", time.Minute); err != iris.ErrTimeout {
+		t.Fatalf("tunnel error mismatch: have %v, want %v.", err, iris.ErrTimeout)
+	}
+	// Verify that dropped links are reported to the binding
+	relay.DropLinks()
+	select {
+	case <-conn.Closed():
+	case <-time.After(time.Second):
+		t.Fatalf("dropped link not detected.")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the keepalive mechanism detecting silently dropped relay links. The
+// relay protocol has no dedicated ping message, so the connection subscribes to
+// a private, randomly named topic and periodically publishes a timestamp to it,
+// the relay delivering it back acting as the pong.
+
+package iris
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// Generates the private topic name used for keepalive pings.
+func newPingTopic() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "iris-keepalive-" + hex.EncodeToString(id), nil
+}
+
+// Periodically pings the relay, force dropping the link if a pong doesn't arrive
+// within the grace period. The link drop is handled by the usual reconnection or
+// closure path.
+func (c *Connection) keepalive() {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.term:
+			return
+		case <-ticker.C:
+		}
+		// Skip the round while the link is being restored
+		if c.State() != Connected {
+			continue
+		}
+		epoch := atomic.LoadUint64(&c.sockEpoch)
+
+		// Drain any stale pong and send a new ping
+		select {
+		case <-c.pong:
+		default:
+		}
+		ping := make([]byte, 8)
+		binary.BigEndian.PutUint64(ping, uint64(time.Now().UnixNano()))
+		if err := c.sendPublish(context.Background(), c.pingTopic, ping); err != nil {
+			continue
+		}
+		if err := c.Flush(); err != nil {
+			continue
+		}
+		// Wait for the pong or drop the link
+		select {
+		case <-c.term:
+			return
+		case rtt := <-c.pong:
+			atomic.StoreInt64(&c.stats.pingRtt, int64(rtt))
+		case <-time.After(c.opts.KeepAliveGrace):
+			c.sockLock.Lock()
+			if !c.sockDown && atomic.LoadUint64(&c.sockEpoch) == epoch {
+				c.Log.Warn("keepalive pong missed, dropping link", "grace", c.opts.KeepAliveGrace)
+				c.dropLink("keepalive pong missed")
+			}
+			c.sockLock.Unlock()
+		}
+	}
+}
+
+// Measures the round-trip time of an arrived keepalive pong.
+func (c *Connection) handlePong(pong []byte) {
+	if len(pong) != 8 {
+		c.Log.Warn("malformed keepalive pong", "size", len(pong))
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(pong)))
+	select {
+	case c.pong <- time.Since(sent):
+	default:
+	}
+}
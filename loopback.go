@@ -0,0 +1,53 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the detection of requests served by the requesting process itself.
+// Requests issued via RequestMeta with metadata carry a random token identifying
+// the process, and the serving binding flags the reply if the token matches its
+// own.
+
+package iris
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Reply metadata entry set to "true" by RequestMeta if the request was served by
+// a member within the requesting process (e.g. a service requesting its own
+// cluster and the relay routing the request back to it). Setting it in the
+// request metadata opts into the detection even without other entries.
+const LoopbackMetadata = "iris-loopback"
+
+// Request metadata entry carrying the token of the requesting process.
+const originMetadata = "iris-origin"
+
+// Random token identifying the current process.
+var processOrigin = newProcessOrigin()
+
+// Generates a random token identifying the current process, falling back to the
+// pid and start time if no randomness is available.
+func newProcessOrigin() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Strips the origin token off the metadata of an inbound request, reporting
+// whether the request was issued by the current process.
+func stripOrigin(md Metadata) bool {
+	origin, ok := md[originMetadata]
+	if !ok {
+		return false
+	}
+	delete(md, originMetadata)
+	return origin == processOrigin
+}
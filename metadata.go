@@ -0,0 +1,196 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the side-channel metadata of requests and replies. The relay protocol
+// has no header fields, so metadata is framed in front of the body and parsed off
+// again by the receiving binding before the handler or requester sees it. Messages
+// without metadata are sent as is.
+
+package iris
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Key/value side-channel data carried alongside a request body (e.g. tracing or
+// authentication headers).
+type Metadata map[string]string
+
+// Context keys of the outgoing and incoming request and reply metadata.
+type (
+	outgoingMetadataKey struct{}
+	incomingMetadataKey struct{}
+	replyMetadataKey    struct{}
+)
+
+// Collector of the metadata attached to a reply, either by the handler of an
+// inbound request or by the remote side of an outbound one.
+type metadataSink struct {
+	md Metadata
+}
+
+// Magic prefix of requests carrying metadata.
+var metadataMagic = []byte("\x00iris-meta\x00")
+
+// Serialization format of the metadata envelope. Both endpoints of a request need
+// to use the same codec; metadata failing to decode is passed on as part of the
+// body, similarly to messages from peers unaware of metadata.
+type MetadataCodec interface {
+	MarshalMetadata(md Metadata) ([]byte, error)
+	UnmarshalMetadata(data []byte) (Metadata, error)
+}
+
+// Default metadata codec, encoding the entries as length-prefixed key/value pairs.
+type pairsCodec struct{}
+
+// Encodes the entry count followed by the length-prefixed keys and values.
+func (pairsCodec) MarshalMetadata(md Metadata) ([]byte, error) {
+	size := binary.MaxVarintLen64
+	for key, value := range md {
+		size += 2*binary.MaxVarintLen64 + len(key) + len(value)
+	}
+	blob := make([]byte, 0, size)
+	blob = binary.AppendUvarint(blob, uint64(len(md)))
+	for key, value := range md {
+		blob = binary.AppendUvarint(blob, uint64(len(key)))
+		blob = append(blob, key...)
+		blob = binary.AppendUvarint(blob, uint64(len(value)))
+		blob = append(blob, value...)
+	}
+	return blob, nil
+}
+
+// Decodes the length-prefixed key/value pairs, requiring all data consumed.
+func (pairsCodec) UnmarshalMetadata(data []byte) (Metadata, error) {
+	// Reads a length-tagged string from the remaining data
+	next := func() (string, bool) {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return "", false
+		}
+		field := string(data[n : n+int(size)])
+		data = data[n+int(size):]
+		return field, true
+	}
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, errors.New("malformed entry count")
+	}
+	data = data[n:]
+
+	md := make(Metadata, count)
+	for i := uint64(0); i < count; i++ {
+		key, ok := next()
+		if !ok {
+			return nil, errors.New("malformed key")
+		}
+		value, ok := next()
+		if !ok {
+			return nil, errors.New("malformed value")
+		}
+		md[key] = value
+	}
+	if len(data) != 0 {
+		return nil, errors.New("trailing data")
+	}
+	return md, nil
+}
+
+// Returns a copy of the context carrying the given metadata for outbound requests,
+// merged over any already attached.
+func WithOutgoingMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := OutgoingMetadata(ctx)
+	for key, value := range md {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, outgoingMetadataKey{}, merged)
+}
+
+// Retrieves a copy of the metadata to be sent with outbound requests executed
+// with the context. The result is never nil.
+func OutgoingMetadata(ctx context.Context) Metadata {
+	return copyMetadata(ctx.Value(outgoingMetadataKey{}))
+}
+
+// Retrieves a copy of the metadata an inbound request arrived with, available to
+// the context aware interceptors and handlers. The result is never nil.
+func IncomingMetadata(ctx context.Context) Metadata {
+	return copyMetadata(ctx.Value(incomingMetadataKey{}))
+}
+
+// Attaches metadata to the reply of the inbound request being handled with the
+// context, merged over any already attached. It has no effect on other contexts.
+//
+// The method is not safe for concurrent use within the same request.
+func SetReplyMetadata(ctx context.Context, md Metadata) {
+	sink, ok := ctx.Value(replyMetadataKey{}).(*metadataSink)
+	if !ok {
+		return
+	}
+	if sink.md == nil {
+		sink.md = make(Metadata, len(md))
+	}
+	for key, value := range md {
+		sink.md[key] = value
+	}
+}
+
+// Returns a copy of the context carrying the metadata of an inbound request and
+// a sink collecting the metadata of its reply.
+func withIncomingMetadata(ctx context.Context, md Metadata, sink *metadataSink) context.Context {
+	ctx = context.WithValue(ctx, incomingMetadataKey{}, md)
+	return context.WithValue(ctx, replyMetadataKey{}, sink)
+}
+
+// Creates a copy of a metadata set stored within a context.
+func copyMetadata(value interface{}) Metadata {
+	md, _ := value.(Metadata)
+
+	copied := make(Metadata, len(md))
+	for key, value := range md {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Prefixes the request or reply body with the metadata encoded by the codec, if
+// there is any metadata.
+func frameMetadata(codec MetadataCodec, md Metadata, body []byte) ([]byte, error) {
+	if len(md) == 0 {
+		return body, nil
+	}
+	blob, err := codec.MarshalMetadata(md)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	framed := append([]byte{}, metadataMagic...)
+	framed = binary.AppendUvarint(framed, uint64(len(blob)))
+	framed = append(framed, blob...)
+	return append(framed, body...), nil
+}
+
+// Splits a request or reply into its metadata and body. Messages without (or with
+// malformed) metadata are returned as is, with nil metadata.
+func parseMetadata(codec MetadataCodec, msg []byte) (Metadata, []byte) {
+	if !bytes.HasPrefix(msg, metadataMagic) {
+		return nil, msg
+	}
+	rest := msg[len(metadataMagic):]
+
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return nil, msg
+	}
+	md, err := codec.UnmarshalMetadata(rest[n : n+int(size)])
+	if err != nil {
+		return nil, msg
+	}
+	return md, rest[n+int(size):]
+}
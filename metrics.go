@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the activity counters maintained by a connection.
+
+package iris
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the request latency histogram buckets.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// Snapshot of the activity counters of a connection.
+type Metrics struct {
+	RequestsSent       uint64 // Outbound requests sent to the relay
+	RequestsReceived   uint64 // Inbound requests received from the relay
+	RequestTimeouts    uint64 // Outbound requests that timed out
+	BroadcastsSent     uint64 // Outbound broadcasts sent to the relay
+	BroadcastsReceived uint64 // Inbound broadcasts received from the relay
+	PublishesSent      uint64 // Outbound events published to the relay
+	EventsReceived     uint64 // Inbound topic events received from the relay
+	TunnelsOpened      uint64 // Tunnels successfully constructed (either direction)
+	MessagesThrottled  uint64 // Outbound publishes and broadcasts exceeding the rate limit
+
+	LatencyBounds []time.Duration // Upper bounds of the request latency buckets
+	LatencyCounts []uint64        // Completed requests per latency bucket (last one is overflow)
+	LatencySum    time.Duration   // Total latency of all completed requests
+
+	KeepAliveRTT time.Duration // Last measured keepalive round-trip time (0 = none yet)
+}
+
+// Timings of establishing a connection to the relay, split by setup phase.
+type ConnectStats struct {
+	Dial        time.Duration // Time spent establishing the TCP connection
+	TLS         time.Duration // Time spent in the TLS handshake (0 = plain TCP)
+	Handshake   time.Duration // Time spent in the relay init, including the cluster registration
+	ServiceInit time.Duration // Time spent in the service handler's Init (services only)
+	Total       time.Duration // Time spent in the whole connection setup
+}
+
+// Activity counters of a connection, updated atomically inline the data paths.
+type metrics struct {
+	reqSent   uint64
+	reqRecv   uint64
+	reqTime   uint64
+	bcastSent uint64
+	bcastRecv uint64
+	pubSent   uint64
+	pubRecv   uint64
+	tunOpen   uint64
+	throttled uint64
+
+	latCounts [len(latencyBuckets) + 1]uint64 // One bucket per latency bound plus an overflow one
+	latSum    int64
+
+	pingRtt int64 // Last measured keepalive round-trip time
+}
+
+// Records the latency of a completed request in the histogram.
+func (m *metrics) observeLatency(latency time.Duration) {
+	bucket := len(latencyBuckets)
+	for i, limit := range latencyBuckets {
+		if latency <= limit {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&m.latCounts[bucket], 1)
+	atomic.AddInt64(&m.latSum, int64(latency))
+}
+
+// Retrieves a snapshot of the connection's activity counters.
+func (c *Connection) Metrics() *Metrics {
+	m := &Metrics{
+		RequestsSent:       atomic.LoadUint64(&c.stats.reqSent),
+		RequestsReceived:   atomic.LoadUint64(&c.stats.reqRecv),
+		RequestTimeouts:    atomic.LoadUint64(&c.stats.reqTime),
+		BroadcastsSent:     atomic.LoadUint64(&c.stats.bcastSent),
+		BroadcastsReceived: atomic.LoadUint64(&c.stats.bcastRecv),
+		PublishesSent:      atomic.LoadUint64(&c.stats.pubSent),
+		EventsReceived:     atomic.LoadUint64(&c.stats.pubRecv),
+		TunnelsOpened:      atomic.LoadUint64(&c.stats.tunOpen),
+		MessagesThrottled:  atomic.LoadUint64(&c.stats.throttled),
+
+		LatencyBounds: append([]time.Duration{}, latencyBuckets[:]...),
+		LatencyCounts: make([]uint64, len(c.stats.latCounts)),
+		LatencySum:    time.Duration(atomic.LoadInt64(&c.stats.latSum)),
+
+		KeepAliveRTT: time.Duration(atomic.LoadInt64(&c.stats.pingRtt)),
+	}
+	for i := range m.LatencyCounts {
+		m.LatencyCounts[i] = atomic.LoadUint64(&c.stats.latCounts[i])
+	}
+	return m
+}
+
+// Retrieves the timings of the connection setup. After a reconnect, the phases of
+// the relay link and the total refer to the most recent link establishment.
+func (c *Connection) ConnectStats() *ConnectStats {
+	stats := *c.connStats.Load().(*ConnectStats)
+	return &stats
+}
+
+// Completes the timings of the initial connection setup with the phases outside
+// of the relay link establishment.
+func (c *Connection) finishConnectStats(start time.Time, serviceInit time.Duration) {
+	stats := *c.connStats.Load().(*ConnectStats)
+	stats.ServiceInit = serviceInit
+	stats.Total = time.Since(start)
+	c.connStats.Store(&stats)
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the optional per-tunnel message size limit. Similarly to compression,
+// the two endpoints agree on it while negotiating the tunnel features: the
+// initiator offers its limit, and the acceptor confirms the smaller of the offered
+// and its own (the connection's if none is set).
+
+package iris
+
+// Retrieves the maximum size of a message that can be sent through the tunnel,
+// either as negotiated with the remote endpoint, or the connection's limit.
+func (t *Tunnel) MaxMessageSize() int {
+	if t.maxMsg > 0 && t.maxMsg < t.conn.opts.MaxMsgSize {
+		return t.maxMsg
+	}
+	return t.conn.opts.MaxMsgSize
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the negotiation of the optional tunnel features. The relay protocol
+// has no notion of them, so right after a tunnel is established the initiator
+// sends a single offer listing the features it requests, which the acceptor
+// answers with the agreed settings or a rejection. Acceptors peek at the first
+// message of every inbound tunnel, so offers are recognized regardless of their
+// own configuration, and plain messages are left to the application.
+
+package iris
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Magic prefix of the negotiation messages, separating them from user data.
+var negotiationMagic = []byte("\x00iris-tunnel\x00")
+
+// Time allowance of an accepted tunnel for the initiator's first message, after
+// which the tunnel is handed to the application as a plain one.
+var tunnelPeekTimeout = time.Second
+
+// Kinds of the negotiation messages.
+const (
+	negotiationOffer  = "offer"
+	negotiationAccept = "accept"
+	negotiationReject = "reject"
+)
+
+// Sentinel errors of the negotiated features, reported if they're rejected.
+var negotiationErrors = map[string]error{
+	"compression": ErrCompressionMismatch,
+	"maxmsg":      ErrMsgSizeMismatch,
+	"peer":        ErrIdentifyFailed,
+}
+
+// Assembles a negotiation message of the given kind, carrying the parameters.
+func negotiationHeader(kind string, params url.Values) []byte {
+	header := append(append([]byte{}, negotiationMagic...), kind...)
+	if len(params) > 0 {
+		header = append(append(header, '?'), params.Encode()...)
+	}
+	return header
+}
+
+// Parses a negotiation message, returning its kind and parameters, or false if
+// the message is not a negotiation one.
+func parseNegotiationHeader(msg []byte) (string, url.Values, bool) {
+	if !bytes.HasPrefix(msg, negotiationMagic) {
+		return "", nil, false
+	}
+	kind, query, _ := strings.Cut(string(msg[len(negotiationMagic):]), "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, false
+	}
+	return kind, params, true
+}
+
+// Offers the requested features to the acceptor and applies the agreed settings.
+// Nothing is sent if no optional feature was requested.
+func (t *Tunnel) offerFeatures(opts *TunnelOpts, timeout time.Duration) error {
+	offer := make(url.Values)
+	if opts.Compression != NoCompression {
+		offer.Set("compression", opts.Compression.String())
+	}
+	if opts.MaxMessageSize != 0 {
+		offer.Set("maxmsg", strconv.Itoa(opts.MaxMessageSize))
+	}
+	if opts.Identify {
+		offer.Set("peer", t.conn.cluster)
+	}
+	if len(offer) == 0 {
+		return nil
+	}
+	t.Log.Debug("offering tunnel features", "offer", offer.Encode())
+
+	if err := t.Send(negotiationHeader(negotiationOffer, offer), timeout); err != nil {
+		return fmt.Errorf("tunnel negotiation failed: offer: %w", err)
+	}
+	msg, err := t.Recv(timeout)
+	if err != nil {
+		return fmt.Errorf("tunnel negotiation failed: no answer: %w", err)
+	}
+	kind, answer, ok := parseNegotiationHeader(msg)
+	switch {
+	case !ok:
+		return fmt.Errorf("tunnel negotiation failed: unexpected answer %q", msg)
+	case kind == negotiationReject:
+		feature, reason := answer.Get("feature"), answer.Get("reason")
+		if err, ok := negotiationErrors[feature]; ok {
+			return fmt.Errorf("%w: %s", err, reason)
+		}
+		return fmt.Errorf("tunnel negotiation rejected: %s", reason)
+	case kind != negotiationAccept:
+		return fmt.Errorf("tunnel negotiation failed: unexpected answer %q", msg)
+	}
+	// Offer accepted, verify and apply the agreed settings
+	if comp := offer.Get("compression"); comp != "" {
+		if agreed := answer.Get("compression"); agreed != comp {
+			return fmt.Errorf("%w: offered %s, agreed %q", ErrCompressionMismatch, comp, agreed)
+		}
+		t.comp = opts.Compression
+	}
+	if size := offer.Get("maxmsg"); size != "" {
+		agreed, err := strconv.Atoi(answer.Get("maxmsg"))
+		if err != nil || agreed <= 0 || agreed > opts.MaxMessageSize {
+			return fmt.Errorf("%w: offered %s, agreed %q", ErrMsgSizeMismatch, size, answer.Get("maxmsg"))
+		}
+		t.maxMsg = agreed
+	}
+	if offer.Has("peer") {
+		if !answer.Has("peer") {
+			return fmt.Errorf("%w: no identity in answer", ErrIdentifyFailed)
+		}
+		t.peer = answer.Get("peer")
+	}
+	return nil
+}
+
+// Answers the feature offer of the initiator if it sent one as its first message,
+// verifying the agreement against the local options. Plain initiators are only
+// accepted if no feature needs their cooperation.
+func (t *Tunnel) answerFeatures(opts *TunnelOpts, timeout time.Duration) error {
+	var offer url.Values
+	if msg := t.peekMessage(tunnelPeekTimeout); msg != nil {
+		if kind, params, ok := parseNegotiationHeader(msg); ok && kind == negotiationOffer {
+			t.fetchMessage()
+			offer = params
+		}
+	}
+	if offer != nil {
+		t.Log.Debug("answering tunnel features", "offer", offer.Encode())
+	}
+	answer := make(url.Values)
+
+	// Both endpoints need to agree on the compression
+	remote := offer.Get("compression")
+	if remote == "" {
+		remote = NoCompression.String()
+	}
+	if local := opts.Compression.String(); remote != local {
+		return t.rejectFeature(offer, "compression", fmt.Sprintf("offered %s, accepting %s", remote, local), timeout)
+	}
+	if opts.Compression != NoCompression {
+		answer.Set("compression", opts.Compression.String())
+	}
+	// Agree on the smaller message size limit, defaulting to the connection's
+	maxMsg := opts.MaxMessageSize
+	if maxMsg == 0 {
+		maxMsg = t.conn.opts.MaxMsgSize
+	}
+	if size := offer.Get("maxmsg"); size != "" {
+		remote, err := strconv.Atoi(size)
+		if err != nil || remote <= 0 {
+			return t.rejectFeature(offer, "maxmsg", fmt.Sprintf("invalid size %q", size), timeout)
+		}
+		if remote < maxMsg {
+			maxMsg = remote
+		}
+		answer.Set("maxmsg", strconv.Itoa(maxMsg))
+	}
+	// Exchange the cluster names if the initiator asked for it
+	if offer.Has("peer") {
+		answer.Set("peer", t.conn.cluster)
+	}
+	// Confirm the agreement and enable the features
+	if offer != nil {
+		if err := t.Send(negotiationHeader(negotiationAccept, answer), timeout); err != nil {
+			return fmt.Errorf("tunnel negotiation failed: answer: %w", err)
+		}
+	}
+	t.comp = opts.Compression
+	if offer.Get("maxmsg") != "" || opts.MaxMessageSize != 0 {
+		t.maxMsg = maxMsg
+	}
+	t.peer = offer.Get("peer")
+	return nil
+}
+
+// Notifies the initiator of a rejected feature if it's waiting for an answer, and
+// returns the local failure.
+func (t *Tunnel) rejectFeature(offer url.Values, feature string, reason string, timeout time.Duration) error {
+	if offer != nil {
+		answer := url.Values{"feature": {feature}, "reason": {reason}}
+		if err := t.Send(negotiationHeader(negotiationReject, answer), timeout); err != nil {
+			t.Log.Warn("failed to reject tunnel features", "reason", err)
+		}
+	}
+	return fmt.Errorf("%w: %s", negotiationErrors[feature], reason)
+}
+
+// Retrieves the first queued message without consuming it, waiting for at most
+// the timeout for one to arrive. Nil is returned if none arrived in time.
+func (t *Tunnel) peekMessage(timeout time.Duration) []byte {
+	deadline := time.After(timeout)
+	for {
+		t.itoaLock.Lock()
+		if !t.itoaBuf.Empty() {
+			msg := t.itoaBuf.Front().([]byte)
+			t.itoaLock.Unlock()
+			return msg
+		}
+		done := t.itoaDone
+		t.itoaLock.Unlock()
+
+		if done {
+			return nil
+		}
+		select {
+		case <-t.itoaSign:
+		case <-t.term:
+			return nil
+		case <-deadline:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the user configurable connection options and their defaults.
+
+package iris
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// User options of a connection to the local relay.
+type ConnectOpts struct {
+	Limits *ServiceLimits // Limits on the inbound message processing (services only)
+	Logger log15.Logger   // Parent logger of the connection (defaults to iris.Log)
+
+	Host        string        // Host of the relay endpoint (defaults to localhost)
+	TLSConfig   *tls.Config   // Configuration to secure the relay link with (nil = plain TCP)
+	DialTimeout time.Duration // Time allowance of the relay dial and init handshake (0 = 10s)
+	Nagle       bool          // Coalesce small writes on the relay link (default sets TCP_NODELAY for latency)
+
+	// Custom transport of the relay link (e.g. unix socket proxies, in-process pipes).
+	// It's called with "tcp" and the unresolved host:port of the relay instead of
+	// the default TCP dial, and should bound its own dial by DialTimeout.
+	DialFunc func(network, addr string) (net.Conn, error)
+
+	MaxMsgSize int // Maximum size of a single message in either direction (0 = 64MB)
+	MaxPending int // Maximum number of outbound requests in flight (0 = unlimited)
+	MaxTunnels int // Maximum number of live tunnels when opening a new one (0 = unlimited)
+
+	// Write coalescing of the outbound publishes and broadcasts. If the interval
+	// is set, they are buffered (up to the buffer size) and flushed periodically,
+	// explicitly via Flush, or along with any other outbound message.
+	WriteBufferSize int           // Size of the relay link write buffer (0 = 4KB)
+	FlushInterval   time.Duration // Maximum delay of buffered writes (0 = flush immediately)
+
+	// Timeout caps of the outbound requests. The relay protocol doesn't advertise
+	// how long the relay holds a pending request, so if it enforces a cap, the max
+	// timeout should mirror it: longer requests are then rejected upfront with
+	// ErrTimeoutTooLong, instead of silently expiring at the relay's cap.
+	DefaultRequestTimeout time.Duration // Timeout of the requests issued via RequestDefault (0 = 10s)
+	MaxRequestTimeout     time.Duration // Longest timeout the relay holds a pending request for (0 = unlimited)
+
+	PublishRate     rate.Limit // Maximum rate of outbound publishes and broadcasts per second (0 = unlimited)
+	PublishBurst    int        // Number of messages allowed in a burst above the rate (0 = 1)
+	PublishFailFast bool       // Fail calls exceeding the rate with ErrThrottled instead of blocking
+
+	Reconnect  bool          // Re-establish the relay link if it drops unexpectedly (not if the relay closes it)
+	MaxBackoff time.Duration // Upper bound of the delay between reconnection attempts
+	MaxRetries int           // Reconnection attempts before giving up (0 = infinite)
+
+	KeepAlive      time.Duration // Interval of the relay link liveness checks (0 = disabled)
+	KeepAliveGrace time.Duration // Time allowance of a liveness check to succeed (0 = KeepAlive)
+
+	OnStateChange func(state ConnState) // Callback notified of connection state transitions
+
+	PanicStack bool // Send the stack trace of panicking request handlers to the requester (services only)
+
+	// Deduplication of inbound requests carrying an idempotency key, either in the
+	// IdempotencyKeyMetadata entry or via RetryPolicy.IdempotencyKey. Repeats of a
+	// request answered successfully within the TTL get the cached reply, without
+	// the handler being invoked again (services only).
+	DedupTTL  time.Duration // Retention of the replies to idempotent requests (0 = disabled)
+	DedupSize int           // Maximum number of idempotent requests remembered (0 = 1024)
+
+	// Let panics of topic event handlers crash the process. By default they are
+	// recovered and logged, losing only the event being handled.
+	PropagateEventPanics bool
+
+	// Reuse the buffers of inbound broadcasts and requests, reducing allocations.
+	// If enabled, the message passed to HandleBroadcast and HandleRequest is only
+	// valid until the handler returns (an echoed request until its reply is sent),
+	// so handlers need to copy any data they retain. The buffers of the tunnel
+	// messages consumed via RecvInto are recycled too.
+	ReuseBuffers bool
+
+	Tunnels *TunnelOpts // Options of the tunnels accepted from remote clusters (services only)
+
+	RequestInterceptors  []RequestInterceptor // Interceptors wrapping the inbound request handler (services only)
+	OutboundInterceptors []RequestInterceptor // Interceptors wrapping the outbound requests
+
+	ContextInterceptors         []ContextInterceptor // Metadata aware interceptors running before the inbound ones (services only)
+	OutboundContextInterceptors []ContextInterceptor // Metadata aware interceptors running before the outbound ones
+
+	MetadataCodec MetadataCodec // Serialization of the request and reply metadata (nil = length-prefixed pairs)
+}
+
+// User options of a single tunnel.
+type TunnelOpts struct {
+	// Flow-control window of the tunnel, i.e. the amount of data the remote side
+	// may send in advance without the local application consuming it. Larger
+	// windows raise the throughput on high latency links, at the cost of memory:
+	// a slow reader may need to buffer an entire window per tunnel.
+	Window int
+
+	// Compression of the messages passing through the tunnel. Both endpoints
+	// need to use the same algorithm, otherwise opening the tunnel fails with
+	// ErrCompressionMismatch. Note, a plain initiator cannot detect a compressing
+	// acceptor; the latter drops the tunnel on its first plain message.
+	Compression Compression
+
+	// Maximum size of a single message passing through the tunnel (0 = connection
+	// limit). If the initiator sets it, the smaller of its and the acceptor's limit
+	// is agreed on, otherwise opening the tunnel fails with ErrMsgSizeMismatch. An
+	// acceptor's limit alone only caps its own sends. Sends over the agreed size
+	// are rejected with ErrMsgTooLarge.
+	MaxMessageSize int
+
+	// Exchange the cluster names of the endpoints when opening the tunnel, which
+	// are then reported by RemoteCluster. Only the initiator needs to set it, as
+	// acceptors always answer identification offers; opening the tunnel fails with
+	// ErrIdentifyFailed if the acceptor's name cannot be obtained.
+	Identify bool
+}
+
+// User options of a pool of reusable tunnels.
+type TunnelPoolOpts struct {
+	Tunnel *TunnelOpts // Options of the tunnels opened by the pool (nil = defaults)
+
+	MaxIdle     int           // Maximum number of idle tunnels retained by the pool
+	IdleTimeout time.Duration // Time after which an unused idle tunnel is closed (0 = never)
+	MaxLifetime time.Duration // Age after which a tunnel is not reused any more (0 = never)
+}
+
+// User options of a pool of client connections.
+type ConnPoolOpts struct {
+	Connect *ConnectOpts // Options of the pooled connections (nil = defaults)
+
+	Size       int           // Number of connections maintained by the pool (0 = 4)
+	Strategy   PoolStrategy  // Selection of the connection to issue an operation on
+	MaxBackoff time.Duration // Upper bound of the delay between re-dialing dropped members (0 = 30s)
+}
+
+// Default options of a connection to the local relay.
+var defaultConnectOpts = ConnectOpts{
+	MetadataCodec:         pairsCodec{},
+	DedupSize:             1024,
+	WriteBufferSize:       4096,
+	DefaultRequestTimeout: 10 * time.Second,
+	DialTimeout:           10 * time.Second,
+	MaxBackoff:            30 * time.Second,
+	MaxMsgSize:            64 * 1024 * 1024,
+}
+
+// Default options of a single tunnel.
+var defaultTunnelOpts = TunnelOpts{
+	Window: defaultTunnelBuffer,
+}
+
+// Default options of a pool of reusable tunnels.
+var defaultTunnelPoolOpts = TunnelPoolOpts{
+	MaxIdle: 8,
+}
+
+// Default options of a pool of client connections.
+var defaultConnPoolOpts = ConnPoolOpts{
+	Size:       4,
+	MaxBackoff: 30 * time.Second,
+}
+
+// Time allowance of the live tunnels to close gracefully when the connection is
+// torn down.
+var tunnelCloseTimeout = time.Second
+
+// Initial delay before the first reconnection attempt, doubled after each failure.
+var reconnectBackoff = 100 * time.Millisecond
+
+// Merges the user requested options with the defaults.
+func finalizeConnectOpts(user *ConnectOpts) *ConnectOpts {
+	// Check each field and merge only non-specified ones
+	opts := new(ConnectOpts)
+	if user == nil {
+		*opts = defaultConnectOpts
+	} else {
+		*opts = *user
+	}
+	opts.Limits = finalizeServiceLimits(opts.Limits)
+	opts.Tunnels = finalizeTunnelOpts(opts.Tunnels)
+
+	if opts.Logger == nil {
+		opts.Logger = Log
+	}
+
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = defaultConnectOpts.DialTimeout
+	}
+	if opts.DefaultRequestTimeout == 0 {
+		opts.DefaultRequestTimeout = defaultConnectOpts.DefaultRequestTimeout
+	}
+	if opts.MetadataCodec == nil {
+		opts.MetadataCodec = defaultConnectOpts.MetadataCodec
+	}
+	if opts.DedupSize == 0 {
+		opts.DedupSize = defaultConnectOpts.DedupSize
+	}
+	if opts.WriteBufferSize == 0 {
+		opts.WriteBufferSize = defaultConnectOpts.WriteBufferSize
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultConnectOpts.MaxBackoff
+	}
+	if opts.MaxMsgSize == 0 {
+		opts.MaxMsgSize = defaultConnectOpts.MaxMsgSize
+	}
+	if opts.KeepAliveGrace == 0 {
+		opts.KeepAliveGrace = opts.KeepAlive
+	}
+	return opts
+}
+
+// Merges the user requested tunnel options with the defaults.
+func finalizeTunnelOpts(user *TunnelOpts) *TunnelOpts {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultTunnelOpts
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(TunnelOpts)
+	*opts = *user
+
+	if user.Window == 0 {
+		opts.Window = defaultTunnelOpts.Window
+	}
+	return opts
+}
+
+// Merges the user requested tunnel pool options with the defaults.
+func finalizeTunnelPoolOpts(user *TunnelPoolOpts) *TunnelPoolOpts {
+	opts := new(TunnelPoolOpts)
+	if user == nil {
+		*opts = defaultTunnelPoolOpts
+	} else {
+		*opts = *user
+	}
+	opts.Tunnel = finalizeTunnelOpts(opts.Tunnel)
+
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = defaultTunnelPoolOpts.MaxIdle
+	}
+	return opts
+}
+
+// Merges the user requested connection pool options with the defaults.
+func finalizeConnPoolOpts(user *ConnPoolOpts) *ConnPoolOpts {
+	opts := new(ConnPoolOpts)
+	if user == nil {
+		*opts = defaultConnPoolOpts
+	} else {
+		*opts = *user
+	}
+	if opts.Size == 0 {
+		opts.Size = defaultConnPoolOpts.Size
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultConnPoolOpts.MaxBackoff
+	}
+	return opts
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the optional tunnel peer identification. The relay doesn't tell the
+// accepting side who opened a tunnel, so similarly to compression, the endpoints
+// exchange their cluster names while negotiating the tunnel features: the
+// initiator offers its own, and the acceptor answers with its own.
+
+package iris
+
+// Retrieves the cluster of the remote endpoint, as exchanged during the tunnel
+// setup if the initiator enabled identification. It's empty if the tunnel was
+// opened without identification, or the remote endpoint is a simple client.
+//
+// The name is reported by the remote side itself and not verified by the relay,
+// so any endpoint can claim any cluster. It may be used for routing or logging,
+// but must not be used for authorization decisions.
+func (t *Tunnel) RemoteCluster() string {
+	return t.peer
+}
@@ -12,8 +12,12 @@
 package iris
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -90,6 +94,32 @@ func (c *Connection) sendString(data string) error {
 
 // Serializes a packet through a closure into the relay connection.
 func (c *Connection) sendPacket(closure func() error) error {
+	return c.writePacket(context.Background(), closure, true)
+}
+
+// Serializes a packet similarly to sendPacket, but if write coalescing is enabled
+// it is left in the write buffer until the next flush: either explicit, timed or
+// caused by a subsequent eagerly sent packet.
+//
+// If the context is cancellable, the packet is flushed eagerly and the socket
+// writes are aborted upon cancellation. As an aborted packet may be partially
+// written, the relay link is dropped in that case.
+func (c *Connection) sendPacketLazy(ctx context.Context, closure func() error) error {
+	if ctx.Done() != nil {
+		return c.writePacket(ctx, closure, true)
+	}
+	return c.writePacket(ctx, closure, c.opts.FlushInterval == 0)
+}
+
+// Serializes a packet through a closure into the relay connection, flushing the
+// stream after the last pending write if requested by any of the batched ones.
+func (c *Connection) writePacket(ctx context.Context, closure func() error, flush bool) error {
+	// Fail fast if the connection was already torn down
+	select {
+	case <-c.term:
+		return ErrClosed
+	default:
+	}
 	// Increment the pending write count
 	atomic.AddInt32(&c.sockWait, 1)
 
@@ -97,33 +127,102 @@ func (c *Connection) sendPacket(closure func() error) error {
 	c.sockLock.Lock()
 	defer c.sockLock.Unlock()
 
+	// Fail fast if the relay link is being re-established
+	if c.sockDown {
+		atomic.AddInt32(&c.sockWait, -1)
+		return ErrReconnecting
+	}
+	// Abort the socket writes if the context is cancelled meanwhile
+	if done := ctx.Done(); done != nil {
+		if err := ctx.Err(); err != nil {
+			atomic.AddInt32(&c.sockWait, -1)
+			return err
+		}
+		defer c.abortWrites(done)()
+	}
 	// Send the packet itself
 	if err := closure(); err != nil {
 		// Decrement the pending count and error out
 		atomic.AddInt32(&c.sockWait, -1)
-		return err
+		return c.writeFailure(ctx, err)
+	}
+	// Flush the stream if requested and no more messages are pending
+	if flush {
+		c.sockFlush = true
 	}
-	// Flush the stream if no more messages are pending
-	if atomic.AddInt32(&c.sockWait, -1) == 0 {
-		return c.sockBuf.Flush()
+	if atomic.AddInt32(&c.sockWait, -1) == 0 && c.sockFlush {
+		c.sockFlush = false
+		return c.writeFailure(ctx, c.sockBuf.Flush())
 	}
 	return nil
 }
 
-// Sends a connection initiation.
-func (c *Connection) sendInit(cluster string) error {
-	return c.sendPacket(func() error {
-		if err := c.sendByte(opInit); err != nil {
-			return err
+// Starts a watcher expiring the socket write deadline if the abort channel fires.
+// The returned function stops the watcher and lifts the deadline. Must be called
+// with the socket lock held.
+func (c *Connection) abortWrites(abort <-chan struct{}) func() {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-abort:
+			c.sock.SetWriteDeadline(time.Now())
+		case <-quit:
 		}
-		if err := c.sendString(clientMagic); err != nil {
-			return err
-		}
-		if err := c.sendString(protoVersion); err != nil {
-			return err
+	}()
+	return func() {
+		close(quit)
+		<-done
+		c.sock.SetWriteDeadline(time.Time{})
+	}
+}
+
+// Converts a socket write aborted by the context into its error, dropping the
+// relay link since the stream may contain a partial packet. Must be called with
+// the socket lock held.
+func (c *Connection) writeFailure(ctx context.Context, err error) error {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		c.dropLink("write aborted mid-packet")
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		return c.sendString(cluster)
-	})
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+// Tears down the current relay link on behalf of the binding, recording the cause
+// to report the drop with.
+func (c *Connection) dropLink(reason string) {
+	c.sockDrop.Store(reason)
+	c.sock.Close()
+}
+
+// Wraps a relay link failure into the drop reason describing its cause, clearing
+// any locally recorded one for the next link.
+func (c *Connection) dropCause(err error) error {
+	if reason, _ := c.sockDrop.Swap("").(string); reason != "" {
+		return &LocalCloseError{Reason: reason, Err: err}
+	}
+	return &NetworkError{Err: err}
+}
+
+// Sends a connection initiation. Since the link is not yet usable by anyone else
+// during the handshake, the socket is accessed directly, bypassing the locks.
+func (c *Connection) sendInit(cluster string) error {
+	if err := c.sendByte(opInit); err != nil {
+		return err
+	}
+	if err := c.sendString(clientMagic); err != nil {
+		return err
+	}
+	if err := c.sendString(protoVersion); err != nil {
+		return err
+	}
+	if err := c.sendString(cluster); err != nil {
+		return err
+	}
+	return c.sockBuf.Flush()
 }
 
 // Sends a connection tear-down initiation.
@@ -134,8 +233,8 @@ func (c *Connection) sendClose() error {
 }
 
 // Sends an application broadcast initiation.
-func (c *Connection) sendBroadcast(cluster string, message []byte) error {
-	return c.sendPacket(func() error {
+func (c *Connection) sendBroadcast(ctx context.Context, cluster string, message []byte) error {
+	return c.sendPacketLazy(ctx, func() error {
 		if err := c.sendByte(opBroadcast); err != nil {
 			return err
 		}
@@ -207,8 +306,8 @@ func (c *Connection) sendUnsubscribe(topic string) error {
 }
 
 // Sends a topic event publish.
-func (c *Connection) sendPublish(topic string, event []byte) error {
-	return c.sendPacket(func() error {
+func (c *Connection) sendPublish(ctx context.Context, topic string, event []byte) error {
+	return c.sendPacketLazy(ctx, func() error {
 		if err := c.sendByte(opPublish); err != nil {
 			return err
 		}
@@ -219,6 +318,24 @@ func (c *Connection) sendPublish(topic string, event []byte) error {
 	})
 }
 
+// Sends a batch of topic event publishes as a single packet write.
+func (c *Connection) sendPublishBatch(topic string, events [][]byte) error {
+	return c.sendPacketLazy(context.Background(), func() error {
+		for _, event := range events {
+			if err := c.sendByte(opPublish); err != nil {
+				return err
+			}
+			if err := c.sendString(topic); err != nil {
+				return err
+			}
+			if err := c.sendBinary(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Sends a tunnel construction request.
 func (c *Connection) sendTunnelInit(id uint64, cluster string, timeout int) error {
 	return c.sendPacket(func() error {
@@ -331,6 +448,9 @@ func (c *Connection) recvBinary() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if size > uint64(c.opts.MaxMsgSize) {
+		return nil, fmt.Errorf("%w: inbound blob of %d bytes", ErrMsgTooLarge, size)
+	}
 	// Fetch the blob itself
 	data := make([]byte, size)
 	if _, err := io.ReadFull(c.sockBuf, data); err != nil {
@@ -379,6 +499,8 @@ func (c *Connection) procInit() (string, error) {
 		// Read the reason for connection denial
 		if reason, err := c.recvString(); err != nil {
 			return "", err
+		} else if relay, ok := parseVersionDenial(reason); ok {
+			return "", &RelayVersionError{Binding: protoVersion, Relay: relay, Reason: reason}
 		} else {
 			return "", fmt.Errorf("connection denied: %s", reason)
 		}
@@ -387,6 +509,22 @@ func (c *Connection) procInit() (string, error) {
 	}
 }
 
+// Extracts the protocol version of the relay from a handshake denial. Only denials
+// naming both versions as "have <binding>, want <relay>" are recognized, as the
+// free text reason may mention versions for unrelated causes too.
+func parseVersionDenial(reason string) (string, bool) {
+	marker := "have " + protoVersion + ", want "
+	idx := strings.Index(reason, marker)
+	if idx < 0 {
+		return "", false
+	}
+	fields := strings.Fields(reason[idx+len(marker):])
+	if len(fields) == 0 {
+		return "", false
+	}
+	return strings.TrimRight(fields[0], ".,;)"), true
+}
+
 // Retrieves a connection tear-down notification.
 func (c *Connection) procClose() (string, error) {
 	return c.recvString()
@@ -394,7 +532,7 @@ func (c *Connection) procClose() (string, error) {
 
 // Retrieves an application broadcast delivery.
 func (c *Connection) procBroadcast() error {
-	message, err := c.recvBinary()
+	message, err := c.recvBuffer()
 	if err != nil {
 		return err
 	}
@@ -408,7 +546,7 @@ func (c *Connection) procRequest() error {
 	if err != nil {
 		return err
 	}
-	request, err := c.recvBinary()
+	request, err := c.recvBuffer()
 	if err != nil {
 		return err
 	}
@@ -465,7 +603,7 @@ func (c *Connection) procPublish() error {
 	if err != nil {
 		return err
 	}
-	go c.handlePublish(topic, event)
+	c.handlePublish(topic, event)
 	return nil
 }
 
@@ -530,6 +668,9 @@ func (c *Connection) procTunnelTransfer() error {
 	if err != nil {
 		return err
 	}
+	if size > uint64(c.opts.MaxMsgSize) {
+		return fmt.Errorf("%w: inbound tunnel message of %d bytes", ErrMsgTooLarge, size)
+	}
 	payload, err := c.recvBinary()
 	if err != nil {
 		return err
@@ -553,13 +694,47 @@ func (c *Connection) procTunnelClose() error {
 }
 
 // Retrieves messages from the client connection and keeps processing them until
-// either the relay closes (graceful close) or the connection drops.
+// either the relay closes (graceful close) or the connection drops. If enabled,
+// dropped links are re-established before giving up.
 func (c *Connection) process() {
+	err := c.processLink()
+	for err != nil && c.opts.Reconnect && !isRelayShutdown(err) {
+		var restored bool
+		if restored, err = c.reconnect(err); !restored {
+			break
+		}
+		err = c.processLink()
+	}
+	// Close the socket and signal termination to all blocked threads
+	c.sock.Close()
+	close(c.term)
+	c.setState(Closed)
+
+	// Notify the application of the connection closure
+	c.handleClose(err)
+
+	// Wait for termination sync
+	errc := <-c.quit
+	errc <- err
+}
+
+// Checks whether a relay link failure is the relay closing the connection.
+func isRelayShutdown(err error) bool {
+	var shutdown *RelayShutdownError
+	return errors.As(err, &shutdown)
+}
+
+// Retrieves messages from the current relay link and keeps processing them until
+// either the relay closes (graceful close) or the link drops.
+func (c *Connection) processLink() error {
 	var op byte
 	var err error
 	for closed := false; !closed && err == nil; {
 		// Retrieve the next opcode and call the specific handler for the rest
 		if op, err = c.recvByte(); err == nil {
+			if atomic.LoadInt32(&c.reqTraced) > 0 {
+				c.recvStamp = time.Now()
+			}
 			switch op {
 			case opBroadcast:
 				err = c.procBroadcast()
@@ -580,27 +755,97 @@ func (c *Connection) process() {
 			case opTunClose:
 				err = c.procTunnelClose()
 			case opClose:
-				// Retrieve any reason for remote closure
+				// Retrieve any reason for remote closure, graceful only if requested
 				if reason, cerr := c.procClose(); cerr != nil {
 					err = cerr
 				} else if len(reason) > 0 {
-					err = fmt.Errorf("connection dropped: %s", reason)
+					return &RelayShutdownError{Reason: reason}
 				} else {
-					closed = true
+					select {
+					case <-c.detach:
+						closed = true
+					default:
+						return &RelayShutdownError{}
+					}
 				}
 			default:
 				err = fmt.Errorf("protocol violation: unknown opcode: %v", op)
 			}
 		}
 	}
-	// Close the socket and signal termination to all blocked threads
+	if err != nil {
+		c.Log.Debug("relay link processing failed", "reason", err)
+		return c.dropCause(err)
+	}
+	return nil
+}
+
+// Re-establishes a dropped relay link with exponential backoff, restoring the
+// cluster registration and the active topic subscriptions. Returns whether the
+// link was restored, or the error to report if reconnection was abandoned (nil
+// if the user requested a tear-down meanwhile).
+func (c *Connection) reconnect(reason error) (bool, error) {
+	c.Log.Warn("relay link dropped, reconnecting", "reason", reason)
 	c.sock.Close()
-	close(c.term)
 
-	// Notify the application of the connection closure
-	c.handleClose(err)
+	// Block any further sends and fail all pending operations
+	c.sockLock.Lock()
+	c.sockDown = true
+	c.sockUp = make(chan struct{})
+	c.sockLock.Unlock()
+
+	c.setState(Reconnecting)
+	c.handleLinkDrop()
+
+	// Keep dialing the relay until successful or until giving up
+	backoff := reconnectBackoff
+	for attempt := 1; c.opts.MaxRetries == 0 || attempt <= c.opts.MaxRetries; attempt++ {
+		select {
+		case <-c.detach:
+			c.Log.Info("reconnection cancelled")
+			return false, nil
+		case <-time.After(backoff):
+		}
+		if err := c.dial(); err != nil {
+			c.Log.Warn("reconnection attempt failed", "attempt", attempt, "reason", err)
+			if backoff *= 2; backoff > c.opts.MaxBackoff {
+				backoff = c.opts.MaxBackoff
+			}
+			continue
+		}
+		// Link restored, re-enable sends unless the user detached meanwhile
+		c.subLock.RLock()
+		c.sockLock.Lock()
+		select {
+		case <-c.detach:
+			c.sockLock.Unlock()
+			c.subLock.RUnlock()
+			c.Log.Info("reconnection cancelled")
+			return false, nil
+		default:
+		}
+		atomic.AddUint64(&c.sockEpoch, 1)
+		c.sockDown = false
+		close(c.sockUp)
+		c.sockLock.Unlock()
+
+		// Restore all the active subscriptions
+		if c.pingTopic != "" {
+			if err := c.sendSubscribe(c.pingTopic); err != nil {
+				c.Log.Warn("failed to restore keepalive subscription", "reason", err)
+			}
+		}
+		for topic, top := range c.subLive {
+			if err := c.sendSubscribe(topic); err != nil {
+				top.logger.Warn("failed to restore subscription", "reason", err)
+			}
+		}
+		c.subLock.RUnlock()
 
-	// Wait for termination sync
-	errc := <-c.quit
-	errc <- err
+		c.Log.Info("relay link restored", "attempt", attempt)
+		c.setState(Connected)
+		return true, nil
+	}
+	c.Log.Crit("reconnection abandoned", "attempts", c.opts.MaxRetries)
+	return false, reason
 }
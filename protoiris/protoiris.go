@@ -0,0 +1,65 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Package protoiris uses Iris request/reply as the transport of protocol buffer
+// messages, keeping the protobuf dependency out of the core binding.
+package protoiris
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/project-iris/iris-go.v1"
+)
+
+// Returned (wrapped) if the request couldn't be marshalled, before anything was
+// sent to the relay.
+var ErrEncode = errors.New("failed to encode request")
+
+// Returned (wrapped) if the reply couldn't be unmarshalled, after the request was
+// serviced remotely.
+var ErrDecode = errors.New("failed to decode reply")
+
+// Executes a synchronous request, marshalling the request message and unmarshalling
+// the received reply into the reply message.
+func Request(conn *iris.Connection, cluster string, request proto.Message, reply proto.Message, timeout time.Duration) error {
+	req, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEncode, err)
+	}
+	rep, err := conn.Request(cluster, req, timeout)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(rep, reply); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return nil
+}
+
+// Wraps a typed request handler into one operating on protobuf encoded binary
+// blobs, suitable for servicing ServiceHandler.HandleRequest invocations. The
+// request message is allocated anew for each invocation:
+//
+//	handle := protoiris.HandleRequest(func(req *pb.Query) (*pb.Result, error) { ... })
+func HandleRequest[T any, Req interface {
+	*T
+	proto.Message
+}, Rep proto.Message](handler func(Req) (Rep, error)) func([]byte) ([]byte, error) {
+	return func(request []byte) ([]byte, error) {
+		req := Req(new(T))
+		if err := proto.Unmarshal(request, req); err != nil {
+			return nil, fmt.Errorf("failed to decode request: %v", err)
+		}
+		rep, err := handler(req)
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(rep)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package protoiris
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"gopkg.in/project-iris/iris-go.v1"
+	"gopkg.in/project-iris/iris-go.v1/iristest"
+)
+
+// Service handler servicing the requests with the wrapped request handler.
+type testHandler struct {
+	handle func([]byte) ([]byte, error)
+	served int32
+}
+
+func (h *testHandler) Init(conn *iris.Connection) error { return nil }
+func (h *testHandler) HandleBroadcast(msg []byte)       { panic("not implemented") }
+func (h *testHandler) HandleTunnel(tun *iris.Tunnel)    { panic("not implemented") }
+func (h *testHandler) HandleDrop(reason error)          { panic("not implemented") }
+
+func (h *testHandler) HandleRequest(req []byte) ([]byte, error) {
+	atomic.AddInt32(&h.served, 1)
+	return h.handle(req)
+}
+
+// Upper cases the string of a test request.
+func upper(req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return wrapperspb.String(strings.ToUpper(req.GetValue())), nil
+}
+
+// Starts a fake relay with a service registered into the given cluster, and
+// connects a client to it.
+func newTestConn(t *testing.T, cluster string, handler *testHandler) *iris.Connection {
+	relay, err := iristest.NewFakeRelay()
+	if err != nil {
+		t.Fatalf("failed to start fake relay: %v.", err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	serv, err := iris.Register(relay.Port(), cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	t.Cleanup(func() { serv.Unregister() })
+
+	conn, err := iris.Connect(relay.Port())
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Tests the protobuf request/reply wrappers.
+func TestRequest(t *testing.T) {
+	conn := newTestConn(t, "proto", &testHandler{handle: HandleRequest(upper)})
+
+	// Execute a few typed requests and verify the replies
+	for i := 0; i < 10; i++ {
+		reply := new(wrapperspb.StringValue)
+		if err := Request(conn, "proto", wrapperspb.String(fmt.Sprintf("req-%d", i)), reply, time.Second); err != nil {
+			t.Fatalf("request failed: %v.", err)
+		}
+		if want := fmt.Sprintf("REQ-%d", i); reply.GetValue() != want {
+			t.Fatalf("reply mismatch: have %v, want %v.", reply.GetValue(), want)
+		}
+	}
+}
+
+// Tests that unmarshallable requests fail before reaching the relay.
+func TestRequestEncodeFailure(t *testing.T) {
+	handler := &testHandler{handle: HandleRequest(upper)}
+	conn := newTestConn(t, "proto", handler)
+
+	// Proto3 strings must be valid UTF-8, fail marshalling with an invalid one
+	err := Request(conn, "proto", wrapperspb.String("\xff"), new(wrapperspb.StringValue), time.Second)
+	if !errors.Is(err, ErrEncode) {
+		t.Fatalf("encode error mismatch: have %v, want %v.", err, ErrEncode)
+	}
+	if served := atomic.LoadInt32(&handler.served); served != 0 {
+		t.Fatalf("unencodable request serviced %d times.", served)
+	}
+}
+
+// Tests that unparsable replies fail after the request was serviced.
+func TestRequestDecodeFailure(t *testing.T) {
+	handler := &testHandler{handle: func([]byte) ([]byte, error) { return []byte{0xff, 0xff}, nil }}
+	conn := newTestConn(t, "proto", handler)
+
+	err := Request(conn, "proto", wrapperspb.String("req"), new(wrapperspb.StringValue), time.Second)
+	if !errors.Is(err, ErrDecode) {
+		t.Fatalf("decode error mismatch: have %v, want %v.", err, ErrDecode)
+	}
+	if served := atomic.LoadInt32(&handler.served); served != 1 {
+		t.Fatalf("undecodable reply request serviced %d times, want 1.", served)
+	}
+}
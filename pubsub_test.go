@@ -7,6 +7,7 @@
 package iris
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -36,6 +37,16 @@ type publishTestTopicHandler struct {
 
 func (p *publishTestTopicHandler) HandleEvent(event []byte) { p.delivers <- event }
 
+// Topic handler for the publish/subscribe tests, receiving the topic names too.
+type publishNamedTestTopicHandler struct {
+	delivers chan string
+}
+
+func (p *publishNamedTestTopicHandler) HandleEvent(event []byte) { panic("not implemented") }
+func (p *publishNamedTestTopicHandler) HandleEventOn(topic string, event []byte) {
+	p.delivers <- topic + ":" + string(event)
+}
+
 // Multiple connections subscribe to the same batch of topics and publish to all.
 func TestPublish(t *testing.T) {
 	// Test specific configurations
@@ -335,6 +346,554 @@ func TestPublishMemoryLimit(t *testing.T) {
 	}
 }
 
+// Tests that all subscriptions can be torn down in one step.
+func TestUnsubscribeAll(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a few topics, then drop all of them
+	for i := 0; i < 5; i++ {
+		handler := &publishTestTopicHandler{delivers: make(chan []byte, 1)}
+		if err := conn.Subscribe(fmt.Sprintf("%s-%d", config.topic, i), handler, nil); err != nil {
+			t.Fatalf("subscription failed: %v", err)
+		}
+	}
+	if err := conn.UnsubscribeAll(); err != nil {
+		t.Fatalf("unsubscription failed: %v", err)
+	}
+	if topics := conn.Subscriptions(); len(topics) != 0 {
+		t.Fatalf("subscriptions remained: %v.", topics)
+	}
+}
+
+// Tests that ordered subscriptions deliver events in publish order.
+func TestPublishOrdered(t *testing.T) {
+	events := 1000
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic with ordered delivery and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, events),
+	}
+	if err := conn.SubscribeWith(config.topic, handler, SubscribeOpts{Ordered: true}); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish a stream of events and verify they arrive in order
+	for i := 0; i < events; i++ {
+		if err := conn.Publish(config.topic, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+	}
+	for i := 0; i < events; i++ {
+		select {
+		case event := <-handler.delivers:
+			if want := fmt.Sprintf("%d", i); string(event) != want {
+				t.Fatalf("event order mismatch: have %s, want %s.", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event #%d not delivered.", i)
+		}
+	}
+}
+
+// Tests that outbound publishes are throttled according to the rate limit.
+func TestPublishThrottle(t *testing.T) {
+	// Connect to the local relay with a fail fast rate limit
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{PublishRate: 10, PublishFailFast: true})
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Verify that publishes exceeding the rate are rejected and accounted for
+	if err := conn.Publish(config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("event publish failed: %v.", err)
+	}
+	if err := conn.Publish(config.topic, []byte{0x01}); err != ErrThrottled {
+		t.Fatalf("throttled publish error mismatch: have %v, want %v.", err, ErrThrottled)
+	}
+	if throttled := conn.Metrics().MessagesThrottled; throttled != 1 {
+		t.Fatalf("throttled count mismatch: have %d, want %d.", throttled, 1)
+	}
+	// Connect with a blocking rate limit and verify publishes are delayed
+	conn, err = ConnectWith(config.relay, "", nil, &ConnectOpts{PublishRate: 20})
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := conn.Publish(config.topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("publishes not throttled: took %v.", elapsed)
+	}
+}
+
+// Tests that coalesced publishes are held back until flushed.
+func TestPublishFlush(t *testing.T) {
+	// Connect to the local relay with timed flushes effectively disabled
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, 1),
+	}
+	if err := conn.Subscribe(config.topic, handler, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish an event and verify it's held back in the write buffer
+	if err := conn.Publish(config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("event publish failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+		t.Fatalf("event delivered before flush.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Flush the connection and verify the event arrives
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("flush failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("event not delivered after flush.")
+	}
+}
+
+// Tests that context aware publishes honor cancellation.
+func TestPublishContext(t *testing.T) {
+	// Connect to the local relay with a slow rate limit
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{PublishRate: 1})
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, 2),
+	}
+	if err := conn.Subscribe(config.topic, handler, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish within the rate limit and verify the delivery
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.PublishContext(ctx, config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("event publish failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("event not delivered.")
+	}
+	// Verify that a publish waiting for the rate limiter is aborted
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.PublishContext(ctx, config.topic, []byte{0x01}); err != context.DeadlineExceeded {
+		t.Fatalf("aborted publish error mismatch: have %v, want %v.", err, context.DeadlineExceeded)
+	}
+	// Verify that publishes with an already cancelled context are not sent
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := conn.PublishContext(ctx, config.topic, []byte{0x02}); err != context.Canceled {
+		t.Fatalf("cancelled publish error mismatch: have %v, want %v.", err, context.Canceled)
+	}
+	select {
+	case event := <-handler.delivers:
+		t.Fatalf("aborted event delivered: %v.", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Topic handler panicking on every event, counting the attempts.
+type publishPanicTestTopicHandler struct {
+	panics chan struct{}
+}
+
+func (p *publishPanicTestTopicHandler) HandleEvent(event []byte) {
+	p.panics <- struct{}{}
+	panic("event handler failure")
+}
+
+// Tests that a panicking event handler doesn't disrupt other subscriptions.
+func TestPublishPanicIsolation(t *testing.T) {
+	events := 10
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a panicking and a healthy topic, and wait for state propagation
+	faulty := &publishPanicTestTopicHandler{panics: make(chan struct{}, events)}
+	if err := conn.Subscribe(config.topic+"-faulty", faulty, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic + "-faulty")
+
+	healthy := &publishTestTopicHandler{delivers: make(chan []byte, events)}
+	if err := conn.Subscribe(config.topic, healthy, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish to both topics and verify all events are handled
+	for i := 0; i < events; i++ {
+		if err := conn.Publish(config.topic+"-faulty", []byte{byte(i)}); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+		if err := conn.Publish(config.topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+	}
+	for i := 0; i < events; i++ {
+		select {
+		case <-faulty.panics:
+		case <-time.After(time.Second):
+			t.Fatalf("faulty event #%d not handled.", i)
+		}
+		select {
+		case <-healthy.delivers:
+		case <-time.After(time.Second):
+			t.Fatalf("healthy event #%d not delivered.", i)
+		}
+	}
+}
+
+// Tests that batched publishes are delivered in order.
+func TestPublishBatch(t *testing.T) {
+	events := 1000
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic with ordered delivery and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, events),
+	}
+	if err := conn.SubscribeWith(config.topic, handler, SubscribeOpts{Ordered: true}); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Verify that invalid batches are rejected as a whole
+	if err := conn.PublishBatch(config.topic, [][]byte{{0x00}, nil}); err == nil {
+		t.Fatalf("invalid batch published.")
+	}
+	// Publish a batch of events and verify they arrive in order
+	batch := make([][]byte, events)
+	for i := 0; i < events; i++ {
+		batch[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	if err := conn.PublishBatch(config.topic, batch); err != nil {
+		t.Fatalf("batch publish failed: %v.", err)
+	}
+	for i := 0; i < events; i++ {
+		select {
+		case event := <-handler.delivers:
+			if want := fmt.Sprintf("%d", i); string(event) != want {
+				t.Fatalf("event order mismatch: have %s, want %s.", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event #%d not delivered.", i)
+		}
+	}
+}
+
+// Tests that retained publishing and replaying subscriptions are refused by relays
+// not supporting event retention, leaving the topic untouched.
+func TestPublishRetained(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, 1),
+	}
+	if err := conn.SubscribeWith(config.topic, handler, SubscribeOpts{ReplayLast: 10}); !errors.Is(err, ErrFeatureUnavailable) {
+		t.Fatalf("replaying subscription error mismatch: have %v, want %v.", err, ErrFeatureUnavailable)
+	}
+	if subs := conn.Subscriptions(); len(subs) != 0 {
+		t.Fatalf("refused subscription registered: %v.", subs)
+	}
+	// Subscribe plainly and verify that retained events are not published
+	if err := conn.SubscribeWith(config.topic, handler, SubscribeOpts{}); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	if err := conn.PublishRetained(config.topic, []byte{0x42}, 10); !errors.Is(err, ErrFeatureUnavailable) {
+		t.Fatalf("retained publish error mismatch: have %v, want %v.", err, ErrFeatureUnavailable)
+	}
+	select {
+	case event := <-handler.delivers:
+		t.Fatalf("refused retained event delivered: %v.", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Tests that events overflowing a bounded subscription buffer are dropped and
+// accounted for.
+func TestPublishBufferOverflow(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		messages int
+		sleep    time.Duration
+	}{4, 100 * time.Millisecond}
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic with a single slot buffer and wait for state propagation
+	handler := &publishLimitTestTopicHandler{
+		delivers: make(chan []byte, conf.messages),
+		sleep:    conf.sleep,
+	}
+	opts := SubscribeOpts{
+		Limits:     &TopicLimits{EventThreads: 1},
+		BufferSize: 1,
+		OnOverflow: DropOldest,
+	}
+	if err := conn.SubscribeWith(config.topic, handler, opts); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Send a few publishes and wait for all of them to arrive
+	for i := 0; i < conf.messages; i++ {
+		if err := conn.Publish(config.topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+	}
+	time.Sleep(conf.sleep / 2)
+
+	// Verify that the overflowing events were dropped
+	if dropped, err := conn.DroppedEvents(config.topic); err != nil {
+		t.Fatalf("failed to retrieve dropped events: %v.", err)
+	} else if dropped == 0 {
+		t.Fatalf("no events dropped")
+	}
+	// Wait for the processing to finish and verify that the newest event survived
+	time.Sleep(2 * conf.sleep)
+
+	var last []byte
+	for done := false; !done; {
+		select {
+		case last = <-handler.delivers:
+		default:
+			done = true
+		}
+	}
+	if len(last) != 1 || int(last[0]) != conf.messages-1 {
+		t.Fatalf("newest event mismatch: have %v, want %v", last, []byte{byte(conf.messages - 1)})
+	}
+}
+
+// Tests that double subscriptions are rejected and that handlers can be replaced.
+func TestSubscribeTwice(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic, and verify that a second subscription fails
+	first := &publishTestTopicHandler{delivers: make(chan []byte, 1)}
+	if err := conn.Subscribe(config.topic, first, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+
+	second := &publishTestTopicHandler{delivers: make(chan []byte, 1)}
+	if err := conn.Subscribe(config.topic, second, nil); err != ErrAlreadySubscribed {
+		t.Fatalf("double subscription error mismatch: have %v, want %v.", err, ErrAlreadySubscribed)
+	}
+	// Replace the handler and verify only the new one receives events
+	if err := conn.Resubscribe(config.topic, second, SubscribeOpts{}); err != nil {
+		t.Fatalf("resubscription failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := conn.Publish(config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("event publish failed: %v.", err)
+	}
+	select {
+	case <-second.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("event not delivered to the replacement handler.")
+	}
+	select {
+	case <-first.delivers:
+		t.Fatalf("event delivered to the replaced handler.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Verify that resubscribing to an unknown topic fails
+	if err := conn.Resubscribe(config.topic+"-missing", second, SubscribeOpts{}); err == nil {
+		t.Fatalf("resubscription to unknown topic succeeded.")
+	}
+}
+
+// Tests that the live subscriptions and registered cluster can be queried.
+func TestSubscriptions(t *testing.T) {
+	// Register a new service to the relay
+	service := new(publishTestServiceHandler)
+	serv, err := Register(config.relay, config.cluster, service, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+	conn := service.conn
+
+	if cluster := conn.Cluster(); cluster != config.cluster {
+		t.Fatalf("cluster mismatch: have %v, want %v.", cluster, config.cluster)
+	}
+	// Subscribe to a few topics and verify the reported list
+	topics := []string{config.topic + "-b", config.topic + "-a"}
+	for _, topic := range topics {
+		handler := &publishTestTopicHandler{delivers: make(chan []byte)}
+		if err := conn.Subscribe(topic, handler, nil); err != nil {
+			t.Fatalf("subscription failed: %v.", err)
+		}
+	}
+	want := []string{config.topic + "-a", config.topic + "-b"}
+	if subs := conn.Subscriptions(); fmt.Sprint(subs) != fmt.Sprint(want) {
+		t.Fatalf("subscriptions mismatch: have %v, want %v.", subs, want)
+	}
+	// Unsubscribe and verify the removal
+	if err := conn.Unsubscribe(topics[0]); err != nil {
+		t.Fatalf("unsubscription failed: %v.", err)
+	}
+	want = want[:1]
+	if subs := conn.Subscriptions(); fmt.Sprint(subs) != fmt.Sprint(want) {
+		t.Fatalf("subscriptions mismatch: have %v, want %v.", subs, want)
+	}
+}
+
+// Tests that a shared handler receives the names of the originating topics.
+func TestPublishTopicNames(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a few topics with a shared handler and wait for state propagation
+	topics := []string{config.topic + "-a", config.topic + "-b"}
+	handler := &publishNamedTestTopicHandler{
+		delivers: make(chan string, len(topics)),
+	}
+	for _, topic := range topics {
+		if err := conn.Subscribe(topic, handler, nil); err != nil {
+			t.Fatalf("subscription failed: %v", err)
+		}
+		defer conn.Unsubscribe(topic)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish to each topic and verify the delivered names
+	for _, topic := range topics {
+		if err := conn.Publish(topic, []byte("event")); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+		select {
+		case event := <-handler.delivers:
+			if want := topic + ":event"; event != want {
+				t.Fatalf("event mismatch: have %v, want %v.", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event not received")
+		}
+	}
+}
+
+// Tests that plain functions can be subscribed as topic handlers.
+func TestSubscribeFunc(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe a function with and without topic names and wait for state propagation
+	plain, named := config.topic+"-plain", config.topic+"-named"
+	delivers := make(chan string, 2)
+
+	if err := conn.SubscribeFunc(plain, func(event []byte) { delivers <- string(event) }); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(plain)
+
+	if err := conn.SubscribeFuncOn(named, func(topic string, event []byte) { delivers <- topic + ":" + string(event) }); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(named)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish to each topic and verify the deliveries
+	for topic, want := range map[string]string{plain: "event", named: named + ":event"} {
+		if err := conn.Publish(topic, []byte("event")); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+		select {
+		case event := <-delivers:
+			if event != want {
+				t.Fatalf("event mismatch: have %v, want %v.", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event not received")
+		}
+	}
+}
+
 // Benchmarks the latency of a single publish operation.
 func BenchmarkPublishLatency(b *testing.B) {
 	// Connect to the local relay
@@ -437,3 +996,97 @@ func benchmarkPublishThroughput(threads int, b *testing.B) {
 	// Stop the timer (don't measure deferred cleanup)
 	b.StopTimer()
 }
+
+// Benchmarks the throughput of tiny publishes, each flushed individually.
+func BenchmarkPublishTinyEager(b *testing.B) {
+	benchmarkPublishTiny(nil, b)
+}
+
+// Benchmarks the throughput of tiny publishes, coalesced into timed flushes.
+func BenchmarkPublishTinyCoalesced(b *testing.B) {
+	benchmarkPublishTiny(&ConnectOpts{WriteBufferSize: 64 * 1024, FlushInterval: time.Millisecond}, b)
+}
+
+func benchmarkPublishTiny(opts *ConnectOpts, b *testing.B) {
+	// Connect to the local relay
+	conn, err := ConnectWith(config.relay, "", nil, opts)
+	if err != nil {
+		b.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, b.N),
+	}
+	if err := conn.Subscribe(config.topic, handler, nil); err != nil {
+		b.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Reset timer and benchmark the message transfer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.Publish(config.topic, []byte{byte(i)}); err != nil {
+			b.Fatalf("failed to publish: %v.", err)
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		<-handler.delivers
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
+
+// Benchmarks the throughput of a large batch of events published one by one.
+func BenchmarkPublishBatchLoop(b *testing.B) {
+	benchmarkPublishBatch(false, b)
+}
+
+// Benchmarks the throughput of a large batch of events published in one go.
+func BenchmarkPublishBatchSingle(b *testing.B) {
+	benchmarkPublishBatch(true, b)
+}
+
+func benchmarkPublishBatch(batched bool, b *testing.B) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		b.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, b.N),
+	}
+	if err := conn.Subscribe(config.topic, handler, nil); err != nil {
+		b.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	events := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		events[i] = []byte{byte(i)}
+	}
+	// Reset timer and benchmark the message transfer
+	b.ResetTimer()
+	if batched {
+		if err := conn.PublishBatch(config.topic, events); err != nil {
+			b.Fatalf("failed to publish batch: %v.", err)
+		}
+	} else {
+		for _, event := range events {
+			if err := conn.Publish(config.topic, event); err != nil {
+				b.Fatalf("failed to publish: %v.", err)
+			}
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		<-handler.delivers
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
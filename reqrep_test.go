@@ -7,8 +7,15 @@
 package iris
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -157,6 +164,981 @@ func TestRequestFail(t *testing.T) {
 	}
 }
 
+// Tests that the inbound and outbound request interceptors run in order.
+func TestRequestInterceptors(t *testing.T) {
+	// Create interceptors tagging the requests and replies passing through
+	tagger := func(tag string) RequestInterceptor {
+		return func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error) {
+			rep, err := next(append(req, tag...))
+			return append(rep, tag...), err
+		}
+	}
+	opts := &ConnectOpts{
+		RequestInterceptors:  []RequestInterceptor{tagger("a"), tagger("b")},
+		OutboundInterceptors: []RequestInterceptor{tagger("c")},
+	}
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Execute a request and verify the interceptor ordering
+	reply, err := conn.Request(config.cluster, []byte("x"), time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if want := "xcabbac"; string(reply) != want {
+		t.Fatalf("reply mismatch: have %s, want %s.", reply, want)
+	}
+}
+
+// Tests that request metadata flows between the context aware interceptors.
+func TestRequestMetadataInterceptors(t *testing.T) {
+	// Create interceptors attaching and extracting a metadata field
+	outbound := func(ctx context.Context, req []byte, next func(context.Context, []byte) ([]byte, error)) ([]byte, error) {
+		return next(WithOutgoingMetadata(ctx, Metadata{"trace": "abc"}), req)
+	}
+	inbound := func(ctx context.Context, req []byte, next func(context.Context, []byte) ([]byte, error)) ([]byte, error) {
+		rep, err := next(ctx, req)
+		return append(rep, IncomingMetadata(ctx)["trace"]...), err
+	}
+	opts := &ConnectOpts{
+		ContextInterceptors:         []ContextInterceptor{inbound},
+		OutboundContextInterceptors: []ContextInterceptor{outbound},
+	}
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Execute a request and verify that the handler saw only the body
+	reply, err := conn.Request(config.cluster, []byte("x"), time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if want := "xabc"; string(reply) != want {
+		t.Fatalf("reply mismatch: have %s, want %s.", reply, want)
+	}
+}
+
+// Service handler for the request metadata tests, echoing the metadata back.
+type requestMetaTestHandler struct {
+	requestTestHandler
+}
+
+func (r *requestMetaTestHandler) HandleRequestContext(ctx context.Context, req []byte) ([]byte, error) {
+	SetReplyMetadata(ctx, Metadata{"echo": IncomingMetadata(ctx)["trace"]})
+	return req, nil
+}
+
+// Tests that metadata is delivered to context aware handlers and back.
+func TestRequestMeta(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestMetaTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Execute a request and verify the body and metadata round trip
+	reply, meta, err := handler.conn.RequestMeta(config.cluster, []byte("x"), Metadata{"trace": "abc"}, time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if string(reply) != "x" {
+		t.Fatalf("reply mismatch: have %s, want %s.", reply, "x")
+	}
+	if meta["echo"] != "abc" {
+		t.Fatalf("reply metadata mismatch: have %v, want %v.", meta, Metadata{"echo": "abc"})
+	}
+}
+
+// Service handler for the loopback tests, rejecting requests leaking the origin
+// or the loopback opt-in.
+type requestLoopbackTestHandler struct {
+	requestTestHandler
+}
+
+func (r *requestLoopbackTestHandler) HandleRequestContext(ctx context.Context, req []byte) ([]byte, error) {
+	md := IncomingMetadata(ctx)
+	if origin, ok := md[originMetadata]; ok {
+		return nil, fmt.Errorf("origin leaked to handler: %s", origin)
+	}
+	if _, ok := md[LoopbackMetadata]; ok {
+		return nil, errors.New("loopback opt-in leaked to handler")
+	}
+	return req, nil
+}
+
+// Tests that replies served within the requesting process are flagged.
+func TestRequestLoopback(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestLoopbackTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that self-served requests are flagged as loopback if opted in or if
+	// metadata is sent anyway
+	for _, md := range []Metadata{{LoopbackMetadata: "true"}, {"trace": "abc"}} {
+		_, meta, err := handler.conn.RequestMeta(config.cluster, []byte{0x00}, md, time.Second)
+		if err != nil {
+			t.Fatalf("request with metadata %v failed: %v.", md, err)
+		}
+		if meta[LoopbackMetadata] != "true" {
+			t.Fatalf("loopback flag mismatch for %v: have %v, want %v.", md, meta, Metadata{LoopbackMetadata: "true"})
+		}
+	}
+	// Verify that requests without metadata are sent without an envelope (the
+	// origin would get the reply flagged)
+	if reply, meta, err := handler.conn.RequestMeta(config.cluster, []byte{0x00}, nil, time.Second); err != nil || !bytes.Equal(reply, []byte{0x00}) || meta != nil {
+		t.Fatalf("metadata-less request mismatch: have %v/%v/%v, want %v/nil/nil.", reply, meta, err, []byte{0x00})
+	}
+	// Verify that requests from other processes are not flagged
+	sink := new(metadataSink)
+	ctx := WithOutgoingMetadata(context.Background(), Metadata{originMetadata: "remote-process"})
+	ctx = context.WithValue(ctx, replyMetadataKey{}, sink)
+
+	if _, err := handler.conn.request(ctx, config.cluster, []byte{0x00}, time.Second); err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if _, ok := sink.md[LoopbackMetadata]; ok {
+		t.Fatalf("remote request flagged as loopback: %v.", sink.md)
+	}
+	// Verify that plain requests carry no metadata at all
+	if reply, err := handler.conn.Request(config.cluster, []byte{0x00}, time.Second); err != nil || !bytes.Equal(reply, []byte{0x00}) {
+		t.Fatalf("plain request mismatch: have %v/%v, want %v/nil.", reply, err, []byte{0x00})
+	}
+}
+
+// Metadata codec for the codec tests, encoding the entries as "key=value" lines.
+type requestLinesTestCodec struct{}
+
+func (requestLinesTestCodec) MarshalMetadata(md Metadata) ([]byte, error) {
+	var lines []string
+	for key, value := range md {
+		lines = append(lines, key+"="+value)
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+func (requestLinesTestCodec) UnmarshalMetadata(data []byte) (Metadata, error) {
+	md := make(Metadata)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		md[parts[0]] = parts[1]
+	}
+	return md, nil
+}
+
+// Tests that metadata round trips through a custom codec.
+func TestRequestMetaCodec(t *testing.T) {
+	// Register a new service to the relay using the custom codec
+	handler := new(requestMetaTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{MetadataCodec: requestLinesTestCodec{}})
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Execute a request and verify the body and metadata round trip
+	reply, meta, err := conn.RequestMeta(config.cluster, []byte("x"), Metadata{"trace": "abc"}, time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if string(reply) != "x" {
+		t.Fatalf("reply mismatch: have %s, want %s.", reply, "x")
+	}
+	if meta["echo"] != "abc" {
+		t.Fatalf("reply metadata mismatch: have %v, want %v.", meta, Metadata{"echo": "abc"})
+	}
+}
+
+// Service handler for the request deadline tests, waiting for the context.
+type requestDeadlineTestHandler struct {
+	requestTestHandler
+	done chan error
+}
+
+func (r *requestDeadlineTestHandler) HandleRequestContext(ctx context.Context, req []byte) ([]byte, error) {
+	<-ctx.Done()
+	r.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// Tests that inbound request contexts expire along with the requester.
+func TestRequestDeadline(t *testing.T) {
+	// Register a new service to the relay
+	handler := &requestDeadlineTestHandler{done: make(chan error, 1)}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Execute a request timing out and verify the handler's context follows
+	if _, err := handler.conn.Request(config.cluster, []byte{0x00}, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	select {
+	case err := <-handler.done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("context error mismatch: have %v, want %v.", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler context didn't expire.")
+	}
+}
+
+// Service handler for the request router tests, dispatching by request kind.
+type requestRouterTestHandler struct {
+	*Router
+	conn *Connection
+}
+
+func (r *requestRouterTestHandler) Init(conn *Connection) error { r.conn = conn; return nil }
+func (r *requestRouterTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (r *requestRouterTestHandler) HandleTunnel(tun *Tunnel)    { panic("not implemented") }
+func (r *requestRouterTestHandler) HandleDrop(reason error)     { panic("not implemented") }
+
+// Tests that routed requests reach the handler registered for their kind.
+func TestRequestRouter(t *testing.T) {
+	// Create a router with a few kinds and register it as a service
+	handler := &requestRouterTestHandler{Router: NewRouter()}
+	handler.Handle(1, func(req []byte) ([]byte, error) { return append([]byte("one:"), req...), nil })
+	handler.Handle(2, func(req []byte) ([]byte, error) { return append([]byte("two:"), req...), nil })
+
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that known kinds are dispatched and unknown ones fail
+	for kind, want := range map[byte]string{1: "one:x", 2: "two:x"} {
+		reply, err := handler.conn.Request(config.cluster, []byte{kind, 'x'}, time.Second)
+		if err != nil {
+			t.Fatalf("kind %d: request failed: %v.", kind, err)
+		}
+		if string(reply) != want {
+			t.Fatalf("kind %d: reply mismatch: have %s, want %s.", kind, reply, want)
+		}
+	}
+	if _, err := handler.conn.Request(config.cluster, []byte{3, 'x'}, time.Second); err == nil {
+		t.Fatalf("unknown kind request succeeded.")
+	}
+	// Register a fallback and verify that it receives the unknown kinds
+	handler.HandleDefault(func(req []byte) ([]byte, error) { return req, nil })
+	reply, err := handler.conn.Request(config.cluster, []byte{3, 'x'}, time.Second)
+	if err != nil {
+		t.Fatalf("fallback request failed: %v.", err)
+	}
+	if !bytes.Equal(reply, []byte{3, 'x'}) {
+		t.Fatalf("fallback reply mismatch: have %v, want %v.", reply, []byte{3, 'x'})
+	}
+}
+
+// Tests that invalid timeouts are rejected and the default one used if asked.
+func TestRequestDefaultTimeout(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that sub-millisecond timeouts are rejected
+	for _, timeout := range []time.Duration{-time.Second, 0, time.Nanosecond} {
+		if _, err := handler.conn.Request(config.cluster, []byte{0x00}, timeout); !errors.Is(err, ErrInvalidTimeout) {
+			t.Fatalf("timeout %v: error mismatch: have %v, want %v.", timeout, err, ErrInvalidTimeout)
+		}
+	}
+	// Verify that requests with the default timeout go through
+	reply, err := handler.conn.RequestDefault(config.cluster, []byte{0x00})
+	if err != nil {
+		t.Fatalf("default timeout request failed: %v.", err)
+	}
+	if !bytes.Equal(reply, []byte{0x00}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", reply, []byte{0x00})
+	}
+}
+
+// Service handler for the request retry tests, failing the first few attempts.
+type requestRetryTestHandler struct {
+	conn  *Connection
+	fails int32
+	keys  chan string
+}
+
+func (r *requestRetryTestHandler) Init(conn *Connection) error { r.conn = conn; return nil }
+func (r *requestRetryTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (r *requestRetryTestHandler) HandleTunnel(tun *Tunnel)    { panic("not implemented") }
+func (r *requestRetryTestHandler) HandleDrop(reason error)     { panic("not implemented") }
+
+func (r *requestRetryTestHandler) HandleRequest(req []byte) ([]byte, error) {
+	key, payload := ParseIdempotencyKey(req)
+	r.keys <- key
+	if atomic.AddInt32(&r.fails, -1) >= 0 {
+		return nil, errors.New("transient failure")
+	}
+	return payload, nil
+}
+
+// Tests that failed requests are retried according to the policy.
+func TestRequestRetry(t *testing.T) {
+	// Register a new service to the relay, failing the first two requests
+	handler := &requestRetryTestHandler{fails: 2, keys: make(chan string, 10)}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	policy := RetryPolicy{
+		Attempts:       3,
+		Backoff:        time.Millisecond,
+		Retryable:      func(err error) bool { _, ok := err.(*RemoteError); return ok },
+		IdempotencyKey: "retry-key",
+	}
+	reply, err := handler.conn.RequestRetry(config.cluster, []byte("payload"), time.Second, policy)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if string(reply) != "payload" {
+		t.Fatalf("reply mismatch: have %s, want %s.", reply, "payload")
+	}
+	// Verify that all attempts carried the same key
+	for i := 0; i < 3; i++ {
+		if key := <-handler.keys; key != policy.IdempotencyKey {
+			t.Fatalf("attempt %d: key mismatch: have %q, want %q.", i, key, policy.IdempotencyKey)
+		}
+	}
+	// Verify that non-retryable failures are returned immediately
+	atomic.StoreInt32(&handler.fails, 2)
+	if _, err := handler.conn.RequestRetry(config.cluster, []byte("payload"), time.Second, RetryPolicy{}); err == nil {
+		t.Fatalf("non-retryable failure succeeded.")
+	}
+	select {
+	case <-handler.keys:
+	default:
+		t.Fatalf("request not executed.")
+	}
+	select {
+	case <-handler.keys:
+		t.Fatalf("non-retryable failure retried.")
+	default:
+	}
+}
+
+// Service handler for the timeout retry tests, stalling the first few requests.
+type requestStallTestHandler struct {
+	conn   *Connection
+	stalls int32
+	sleep  time.Duration
+}
+
+func (r *requestStallTestHandler) Init(conn *Connection) error { r.conn = conn; return nil }
+func (r *requestStallTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (r *requestStallTestHandler) HandleTunnel(tun *Tunnel)    { panic("not implemented") }
+func (r *requestStallTestHandler) HandleDrop(reason error)     { panic("not implemented") }
+
+func (r *requestStallTestHandler) HandleRequest(req []byte) ([]byte, error) {
+	if atomic.AddInt32(&r.stalls, -1) >= 0 {
+		time.Sleep(r.sleep)
+	}
+	return req, nil
+}
+
+// Tests that traced requests report their timing breakdown on completion.
+func TestRequestTrace(t *testing.T) {
+	// Register a new service to the relay, stalling the first request
+	handler := &requestStallTestHandler{stalls: 1, sleep: 50 * time.Millisecond}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that a successful request stamps all stages in order
+	traces := make(chan RequestTrace, 1)
+	opts := RequestOpts{Trace: func(trace RequestTrace) { traces <- trace }}
+
+	if _, err := handler.conn.RequestWith(config.cluster, []byte{0x00}, time.Second, opts); err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	trace := <-traces
+	if trace.Cluster != config.cluster || trace.Err != nil {
+		t.Fatalf("trace result mismatch: have %s/%v, want %s/nil.", trace.Cluster, trace.Err, config.cluster)
+	}
+	stamps := []time.Time{trace.Start, trace.Sent, trace.FirstByte, trace.Done}
+	for i := 1; i < len(stamps); i++ {
+		if stamps[i].IsZero() || stamps[i].Before(stamps[i-1]) {
+			t.Fatalf("trace stage #%d out of order: %v.", i, stamps)
+		}
+	}
+	if remote := trace.RemoteTime(); remote < handler.sleep {
+		t.Fatalf("remote time mismatch: have %v, want >= %v.", remote, handler.sleep)
+	}
+	// Verify that failures are traced without reply stamps
+	if _, err := handler.conn.RequestWith(config.cluster, []byte{0x00}, 0, opts); err == nil {
+		t.Fatalf("request with invalid timeout succeeded.")
+	}
+	trace = <-traces
+	if !errors.Is(trace.Err, ErrInvalidTimeout) || !trace.Sent.IsZero() || !trace.FirstByte.IsZero() || trace.Done.IsZero() {
+		t.Fatalf("failed trace mismatch: have %+v.", trace)
+	}
+	// Verify that untraced connections don't keep stamping packets
+	if traced := atomic.LoadInt32(&handler.conn.reqTraced); traced != 0 {
+		t.Fatalf("traced request count mismatch: have %d, want 0.", traced)
+	}
+}
+
+// Tests that timed out requests are retried with jittered backoff.
+func TestRequestWithRetries(t *testing.T) {
+	// Register a new service to the relay, stalling the first two requests
+	handler := &requestStallTestHandler{stalls: 2, sleep: 100 * time.Millisecond}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that the request succeeds on the third attempt
+	reply, err := handler.conn.RequestWithRetries(config.cluster, []byte{0x00}, 50*time.Millisecond, 3)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	if !bytes.Equal(reply, []byte{0x00}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", reply, []byte{0x00})
+	}
+	// Verify that exhausted attempts return the last timeout, annotated
+	atomic.StoreInt32(&handler.stalls, 2)
+	_, err = handler.conn.RequestWithRetries(config.cluster, []byte{0x00}, 50*time.Millisecond, 2)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if !strings.Contains(err.Error(), "2 attempt") {
+		t.Fatalf("error not annotated with the attempt count: %v.", err)
+	}
+}
+
+// Tests that the per cluster queue depth tracks the requests in flight.
+func TestQueueDepth(t *testing.T) {
+	// Register a new service to the relay, stalling the requests
+	handler := &requestStallTestHandler{stalls: 3, sleep: 200 * time.Millisecond}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Issue a few concurrent requests and verify the depth while they're pending
+	var pend sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			handler.conn.Request(config.cluster, []byte{0x00}, time.Second)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if depth, err := handler.conn.QueueDepth(config.cluster); err != nil || depth != 3 {
+		t.Fatalf("queue depth mismatch: have %v/%v, want %v/nil.", depth, err, 3)
+	}
+	if depth, err := handler.conn.QueueDepth(config.cluster + "-other"); err != nil || depth != 0 {
+		t.Fatalf("unrelated queue depth mismatch: have %v/%v, want %v/nil.", depth, err, 0)
+	}
+	// Wait for the requests to complete and verify the depth drained
+	pend.Wait()
+	if depth, err := handler.conn.QueueDepth(config.cluster); err != nil || depth != 0 {
+		t.Fatalf("drained queue depth mismatch: have %v/%v, want %v/nil.", depth, err, 0)
+	}
+}
+
+// Service handler for the streaming request tests, replying with a sequence of
+// the requested length and echoing plain tunnels.
+type requestStreamTestHandler struct {
+	requestTestHandler
+}
+
+func (r *requestStreamTestHandler) HandleRequestStream(req []byte, replies ReplyWriter) error {
+	for i := 0; i < int(req[0]); i++ {
+		if err := replies.Write([]byte{byte(i)}); err != nil {
+			return err
+		}
+	}
+	if len(req) > 1 {
+		return errors.New(string(req[1:]))
+	}
+	return nil
+}
+
+func (r *requestStreamTestHandler) HandleTunnel(tun *Tunnel) {
+	defer tun.Close()
+	if msg, err := tun.Recv(time.Second); err == nil {
+		tun.Send(msg, time.Second)
+	}
+}
+
+// Tests that streaming requests deliver all replies and the final result.
+func TestRequestStream(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestStreamTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that a successful stream delivers the replies in order
+	replies, errs := handler.conn.RequestStream(config.cluster, []byte{5}, time.Second)
+	count := 0
+	for reply := range replies {
+		if !bytes.Equal(reply, []byte{byte(count)}) {
+			t.Fatalf("reply #%d mismatch: have %v, want %v.", count, reply, []byte{byte(count)})
+		}
+		count++
+	}
+	if err := <-errs; err != nil || count != 5 {
+		t.Fatalf("stream result mismatch: have %d replies/%v, want %d/nil.", count, err, 5)
+	}
+	// Verify that a failing stream reports the remote error after the replies
+	replies, errs = handler.conn.RequestStream(config.cluster, []byte("\x02failure"), time.Second)
+	count = 0
+	for range replies {
+		count++
+	}
+	var remote *RemoteError
+	if err := <-errs; !errors.As(err, &remote) || err.Error() != "failure" || count != 2 {
+		t.Fatalf("stream result mismatch: have %d replies/%v, want %d/%v.", count, err, 2, "failure")
+	}
+	// Verify that plain tunnels still reach the tunnel handler intact
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	if err := tunnel.Send([]byte{0x42}, time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	if msg, err := tunnel.Recv(time.Second); err != nil || !bytes.Equal(msg, []byte{0x42}) {
+		t.Fatalf("tunnel echo mismatch: have %v/%v, want %v/nil.", msg, err, []byte{0x42})
+	}
+}
+
+// Tests that self-requests target the connection's own cluster.
+func TestRequestSelf(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	if reply, err := handler.conn.RequestSelf([]byte{0x42}, time.Second); err != nil || !bytes.Equal(reply, []byte{0x42}) {
+		t.Fatalf("self-request mismatch: have %v/%v, want %v/nil.", reply, err, []byte{0x42})
+	}
+	// Verify that simple clients are rejected
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.RequestSelf([]byte{0x42}, time.Second); err != ErrNotService {
+		t.Fatalf("client self-request error mismatch: have %v, want %v.", err, ErrNotService)
+	}
+}
+
+// Tests that membership queries fail on relays unable to report membership.
+func TestHasMembers(t *testing.T) {
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.HasMembers(config.cluster); !errors.Is(err, ErrFeatureUnavailable) {
+		t.Fatalf("membership query error mismatch: have %v, want %v.", err, ErrFeatureUnavailable)
+	}
+	if _, err := conn.HasMembers(""); err == nil || errors.Is(err, ErrFeatureUnavailable) {
+		t.Fatalf("empty cluster membership query error mismatch: have %v.", err)
+	}
+}
+
+// Tests that keyed requests fall back to the default routing.
+func TestRequestKeyed(t *testing.T) {
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, new(requestTestHandler), nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	for _, key := range [][]byte{nil, []byte("shard-1"), []byte("shard-2")} {
+		if reply, err := conn.RequestKeyed(config.cluster, key, []byte{0x42}, time.Second); err != nil || !bytes.Equal(reply, []byte{0x42}) {
+			t.Fatalf("keyed request mismatch for %q: have %v/%v, want %v/nil.", key, reply, err, []byte{0x42})
+		}
+	}
+}
+
+// Tests that spurious and duplicate replies are dropped without disrupting the
+// connection.
+func TestRequestSpuriousReply(t *testing.T) {
+	// Register a new service to the relay, stalling the first request
+	handler := &requestStallTestHandler{stalls: 1, sleep: 250 * time.Millisecond}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+	conn := handler.conn
+
+	// Inject a reply to a request id never issued
+	conn.reqLock.RLock()
+	unknown := conn.reqIdx + 1000
+	conn.reqLock.RUnlock()
+	conn.handleReply(unknown, []byte{0xff}, "")
+
+	// Start a stalled request and inject duplicate replies while it's pending
+	result := make(chan []byte, 1)
+	go func() {
+		reply, err := conn.Request(config.cluster, []byte{0x00}, time.Second)
+		if err != nil {
+			t.Errorf("request failed: %v.", err)
+		}
+		result <- reply
+	}()
+	for conn.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.reqLock.RLock()
+	pending := conn.reqIdx - 1
+	conn.reqLock.RUnlock()
+
+	conn.handleReply(pending, []byte{0x01}, "")
+	conn.handleReply(pending, []byte{0x02}, "")
+	conn.handleReply(pending, nil, "spurious failure")
+
+	select {
+	case reply := <-result:
+		if !bytes.Equal(reply, []byte{0x01}) {
+			t.Fatalf("reply mismatch: have %v, want %v.", reply, []byte{0x01})
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not completed.")
+	}
+	// Wait for the genuine reply to arrive late, and verify the connection is healthy
+	time.Sleep(2 * handler.sleep)
+
+	reply, err := conn.Request(config.cluster, []byte{0x03}, time.Second)
+	if err != nil {
+		t.Fatalf("request after spurious replies failed: %v.", err)
+	}
+	if !bytes.Equal(reply, []byte{0x03}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", reply, []byte{0x03})
+	}
+}
+
+// Tests that one-shot requests connect, execute and tear down.
+func TestQuickRequest(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Issue a one-shot request and verify the reply
+	reply, err := QuickRequest(config.relay, config.cluster, []byte{0x00}, time.Second)
+	if err != nil {
+		t.Fatalf("quick request failed: %v.", err)
+	}
+	if !bytes.Equal(reply, []byte{0x00}) {
+		t.Fatalf("reply mismatch: have %v, want %v.", reply, []byte{0x00})
+	}
+	// Verify that an unreachable relay fails fast
+	if _, err := QuickRequest(config.relay+1, config.cluster, []byte{0x00}, time.Second); err == nil {
+		t.Fatalf("quick request through missing relay succeeded.")
+	}
+}
+
+// Tests that one-shot requests whose handshake exhausts the budget time out.
+func TestQuickRequestHandshakeTimeout(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Start a proxy stalling each connection before forwarding it to the relay
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start listener: %v.", err)
+	}
+	defer listener.Close()
+
+	var stall int64
+	go func() {
+		for {
+			sock, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer sock.Close()
+
+				time.Sleep(time.Duration(atomic.LoadInt64(&stall)))
+				relay, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(config.relay)))
+				if err != nil {
+					return
+				}
+				defer relay.Close()
+
+				go io.Copy(relay, sock)
+				io.Copy(sock, relay)
+			}()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Stall the handshakes around the deadline, verifying they never yield an invalid timeout
+	timeout := 50 * time.Millisecond
+	for delay := timeout - 2*time.Millisecond; delay <= timeout; delay += 100 * time.Microsecond {
+		atomic.StoreInt64(&stall, int64(delay))
+		if _, err := QuickRequest(port, config.cluster, []byte{0x00}, timeout); err != nil && !errors.Is(err, ErrTimeout) {
+			t.Fatalf("stall %v: quick request error mismatch: have %v, want %v.", delay, err, ErrTimeout)
+		}
+	}
+}
+
+// Tests that requests exceeding the relay's maximum timeout are rejected upfront.
+func TestRequestTimeoutTooLong(t *testing.T) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Connect with a capped request timeout
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{MaxRequestTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	if max := conn.MaxRequestTimeout(); max != time.Second {
+		t.Fatalf("max request timeout mismatch: have %v, want %v.", max, time.Second)
+	}
+	// Verify that requests within the cap succeed and above it fail
+	if _, err := conn.Request(config.cluster, []byte{0x00}, time.Second); err != nil {
+		t.Fatalf("capped request failed: %v.", err)
+	}
+	if _, err := conn.Request(config.cluster, []byte{0x00}, 2*time.Second); !errors.Is(err, ErrTimeoutTooLong) {
+		t.Fatalf("overlong request error mismatch: have %v, want %v.", err, ErrTimeoutTooLong)
+	}
+}
+
+// Service handler for the deduplication tests, counting the handled requests.
+type requestDedupTestHandler struct {
+	conn  *Connection
+	calls int32
+}
+
+func (r *requestDedupTestHandler) Init(conn *Connection) error { r.conn = conn; return nil }
+func (r *requestDedupTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (r *requestDedupTestHandler) HandleTunnel(tun *Tunnel)    { panic("not implemented") }
+func (r *requestDedupTestHandler) HandleDrop(reason error)     { panic("not implemented") }
+
+func (r *requestDedupTestHandler) HandleRequest(req []byte) ([]byte, error) {
+	return []byte{byte(atomic.AddInt32(&r.calls, 1))}, nil
+}
+
+// Tests that repeated idempotent requests are answered from the cache.
+func TestRequestDedup(t *testing.T) {
+	// Register a new service to the relay with deduplication enabled
+	handler := new(requestDedupTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{DedupTTL: 250 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Issue the same keyed request twice and verify it was handled once
+	meta := Metadata{IdempotencyKeyMetadata: "dedup-key"}
+	for i := 0; i < 2; i++ {
+		reply, _, err := conn.RequestMeta(config.cluster, []byte{0x00}, meta, time.Second)
+		if err != nil {
+			t.Fatalf("request %d failed: %v.", i, err)
+		}
+		if !bytes.Equal(reply, []byte{0x01}) {
+			t.Fatalf("request %d: reply mismatch: have %v, want %v.", i, reply, []byte{0x01})
+		}
+	}
+	// Verify that requests keyed via the retry framing are deduplicated too
+	policy := RetryPolicy{IdempotencyKey: "retry-key"}
+	for i := 0; i < 2; i++ {
+		reply, err := conn.RequestRetry(config.cluster, []byte{0x00}, time.Second, policy)
+		if err != nil {
+			t.Fatalf("retry request %d failed: %v.", i, err)
+		}
+		if !bytes.Equal(reply, []byte{0x02}) {
+			t.Fatalf("retry request %d: reply mismatch: have %v, want %v.", i, reply, []byte{0x02})
+		}
+	}
+	// Verify that unkeyed and expired requests are handled again
+	if reply, err := conn.Request(config.cluster, []byte{0x00}, time.Second); err != nil || !bytes.Equal(reply, []byte{0x03}) {
+		t.Fatalf("unkeyed request mismatch: have %v/%v, want %v/%v.", reply, err, []byte{0x03}, nil)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if reply, _, err := conn.RequestMeta(config.cluster, []byte{0x00}, meta, time.Second); err != nil || !bytes.Equal(reply, []byte{0x04}) {
+		t.Fatalf("expired request mismatch: have %v/%v, want %v/%v.", reply, err, []byte{0x04}, nil)
+	}
+}
+
+// Service handler for the deduplication buffer tests, echoing the request payload.
+type requestDedupEchoTestHandler struct{}
+
+func (r *requestDedupEchoTestHandler) Init(conn *Connection) error { return nil }
+func (r *requestDedupEchoTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (r *requestDedupEchoTestHandler) HandleTunnel(tun *Tunnel)    { panic("not implemented") }
+func (r *requestDedupEchoTestHandler) HandleDrop(reason error)     { panic("not implemented") }
+
+func (r *requestDedupEchoTestHandler) HandleRequest(req []byte) ([]byte, error) {
+	_, payload := ParseIdempotencyKey(req)
+	return payload, nil
+}
+
+// Tests that cached replies aliasing a recycled request buffer are not corrupted.
+func TestRequestDedupReuseBuffers(t *testing.T) {
+	// Pin the scheduler to a single thread so released buffers are reused in order
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	// Register a new service to the relay with deduplication and buffer reuse
+	opts := &ConnectOpts{DedupTTL: time.Second, ReuseBuffers: true}
+	conn, err := ConnectWith(config.relay, config.cluster, new(requestDedupEchoTestHandler), opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Issue a keyed request, then a duplicate overwriting the recycled buffer
+	policy := RetryPolicy{IdempotencyKey: "dedup-echo-key"}
+	original := bytes.Repeat([]byte{0x01}, 128)
+	if reply, err := conn.RequestRetry(config.cluster, original, time.Second, policy); err != nil || !bytes.Equal(reply, original) {
+		t.Fatalf("original request mismatch: have %v/%v, want %v/%v.", reply, err, original, nil)
+	}
+	if reply, err := conn.RequestRetry(config.cluster, bytes.Repeat([]byte{0x02}, 128), time.Second, policy); err != nil || !bytes.Equal(reply, original) {
+		t.Fatalf("duplicate request mismatch: have %v/%v, want %v/%v.", reply, err, original, nil)
+	}
+}
+
+// Tests that the request activity counters are maintained.
+func TestRequestMetrics(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		requests int
+	}{25}
+
+	// Create the service handler
+	handler := new(requestTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Execute a batch of requests and verify the counters
+	for i := 0; i < conf.requests; i++ {
+		if _, err := handler.conn.Request(config.cluster, []byte{0x00}, time.Second); err != nil {
+			t.Fatalf("request failed: %v.", err)
+		}
+	}
+	metrics := handler.conn.Metrics()
+	if metrics.RequestsSent != uint64(conf.requests) {
+		t.Fatalf("sent request count mismatch: have %v, want %v.", metrics.RequestsSent, conf.requests)
+	}
+	if metrics.RequestsReceived != uint64(conf.requests) {
+		t.Fatalf("received request count mismatch: have %v, want %v.", metrics.RequestsReceived, conf.requests)
+	}
+	completed := uint64(0)
+	for _, count := range metrics.LatencyCounts {
+		completed += count
+	}
+	if completed != uint64(conf.requests) {
+		t.Fatalf("latency sample count mismatch: have %v, want %v.", completed, conf.requests)
+	}
+}
+
+// Service handler for the request/reply panic tests.
+type requestPanicTestHandler struct {
+	conn *Connection
+}
+
+func (r *requestPanicTestHandler) Init(conn *Connection) error { r.conn = conn; return nil }
+func (r *requestPanicTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (r *requestPanicTestHandler) HandleTunnel(tun *Tunnel)    { panic("not implemented") }
+func (r *requestPanicTestHandler) HandleDrop(reason error)     { panic("not implemented") }
+
+func (r *requestPanicTestHandler) HandleRequest(req []byte) ([]byte, error) {
+	panic(string(req))
+}
+
+// Tests that remote handler panics are reported back as typed errors.
+func TestRequestPanic(t *testing.T) {
+	for _, stack := range []bool{false, true} {
+		// Register a new service to the relay
+		handler := new(requestPanicTestHandler)
+		conn, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{PanicStack: stack})
+		if err != nil {
+			t.Fatalf("registration failed: %v.", err)
+		}
+		// Request a panic and verify the returned error
+		_, err = conn.Request(config.cluster, []byte("boom"), time.Second)
+
+		var perr *PanicError
+		if !errors.As(err, &perr) {
+			t.Fatalf("error type mismatch: have %T (%v), want %T.", err, err, perr)
+		}
+		if perr.Value != "boom" {
+			t.Fatalf("panic value mismatch: have %v, want %v.", perr.Value, "boom")
+		}
+		if (perr.Stack != "") != stack {
+			t.Fatalf("stack trace presence mismatch: have %v, want %v.", perr.Stack != "", stack)
+		}
+		conn.Close()
+	}
+}
+
 // Service handler for the request/reply limit tests.
 type requestTestTimedHandler struct {
 	conn  *Connection
@@ -200,6 +1182,152 @@ func TestRequestTimeout(t *testing.T) {
 	}
 }
 
+// Tests that context cancellations and deadlines abort pending requests.
+func TestRequestContext(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		sleep time.Duration
+	}{50 * time.Millisecond}
+
+	// Create the service handler
+	handler := &requestTestTimedHandler{
+		sleep: conf.sleep,
+	}
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Check that an uncancelled context behaves as a plain request
+	if _, err := handler.conn.RequestContext(context.Background(), config.cluster, []byte{0x00}, conf.sleep*2); err != nil {
+		t.Fatalf("background context request failed: %v.", err)
+	}
+	// Check that cancelling the context aborts the request
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(conf.sleep/2, cancel)
+	if rep, err := handler.conn.RequestContext(ctx, config.cluster, []byte{0x00}, conf.sleep*2); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled request result mismatch: have %v/%v, want %v/%v.", rep, err, nil, context.Canceled)
+	}
+	// Check that an earlier context deadline overrides the timeout
+	ctx, cancel = context.WithTimeout(context.Background(), conf.sleep/2)
+	defer cancel()
+	if rep, err := handler.conn.RequestContext(ctx, config.cluster, []byte{0x00}, conf.sleep*2); err == nil {
+		t.Fatalf("expired context request succeeded: %v.", rep)
+	}
+	// Check that the aborted requests were cleaned up
+	handler.conn.reqLock.RLock()
+	pending := len(handler.conn.reqReps)
+	handler.conn.reqLock.RUnlock()
+	if pending != 0 {
+		t.Fatalf("pending request count mismatch: have %v, want %v.", pending, 0)
+	}
+}
+
+// Tests that asynchronous requests can be waited on and cancelled.
+func TestRequestAsync(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		sleep time.Duration
+	}{50 * time.Millisecond}
+
+	// Create the service handler
+	handler := &requestTestTimedHandler{
+		sleep: conf.sleep,
+	}
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Check that an uncancelled request delivers the reply
+	req := handler.conn.RequestAsync(config.cluster, []byte{0x01}, conf.sleep*2)
+	if rep, err := req.Reply(); err != nil || !bytes.Equal(rep, []byte{0x01}) {
+		t.Fatalf("async request result mismatch: have %v/%v, want %v/%v.", rep, err, []byte{0x01}, nil)
+	}
+	// Check that cancelling a request releases it and fails the reply
+	req = handler.conn.RequestAsync(config.cluster, []byte{0x02}, conf.sleep*2)
+	time.Sleep(conf.sleep / 2)
+	req.Cancel()
+
+	handler.conn.reqLock.RLock()
+	pending := len(handler.conn.reqReps)
+	handler.conn.reqLock.RUnlock()
+	if pending != 0 {
+		t.Fatalf("pending request count mismatch: have %v, want %v.", pending, 0)
+	}
+	if rep, err := req.Reply(); err != ErrCancelled {
+		t.Fatalf("cancelled request result mismatch: have %v/%v, want %v/%v.", rep, err, nil, ErrCancelled)
+	}
+}
+
+// Tests that pipelined future requests all deliver their replies.
+func TestRequestFuture(t *testing.T) {
+	// Create the service handler
+	handler := new(requestTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Launch a batch of requests and collect the results
+	futures := make([]<-chan RequestResult, 100)
+	for i := 0; i < len(futures); i++ {
+		futures[i] = handler.conn.RequestFuture(config.cluster, []byte{byte(i)}, time.Second)
+	}
+	for i, future := range futures {
+		res := <-future
+		if res.Err != nil {
+			t.Fatalf("request #%d failed: %v.", i, res.Err)
+		}
+		if !bytes.Equal(res.Reply, []byte{byte(i)}) {
+			t.Fatalf("request #%d reply mismatch: have %v, want %v.", i, res.Reply, []byte{byte(i)})
+		}
+	}
+}
+
+// Tests that draining a service waits for the pending requests to complete.
+func TestRequestDrain(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		sleep time.Duration
+	}{50 * time.Millisecond}
+
+	// Register a slow service and a client to send requests with
+	handler := &requestTestTimedHandler{
+		sleep: conf.sleep,
+	}
+	conn, err := ConnectWith(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	client, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer client.Close()
+
+	// Start a request and drain the service while it's being processed
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Request(config.cluster, []byte{0x00}, 4*conf.sleep)
+		errc <- err
+	}()
+	time.Sleep(conf.sleep / 2)
+	if err := conn.Drain(4 * conf.sleep); err != nil {
+		t.Fatalf("drain failed: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("pending request failed: %v.", err)
+	}
+}
+
 // Tests the request thread limitation.
 func TestRequestThreadLimit(t *testing.T) {
 	// Test specific configurations
@@ -273,9 +1401,11 @@ func TestRequestMemoryLimit(t *testing.T) {
 	if _, err := handler.conn.Request(config.cluster, []byte{0x00}, 25*time.Millisecond); err != nil {
 		t.Fatalf("small request failed: %v.", err)
 	}
-	// Check that a 2 byte request is dropped
-	if rep, err := handler.conn.Request(config.cluster, []byte{0x00, 0x00}, 25*time.Millisecond); err != ErrTimeout {
-		t.Fatalf("large request didn't time out: %v : %v.", rep, err)
+	// Check that a 2 byte request is rejected
+	if rep, err := handler.conn.Request(config.cluster, []byte{0x00, 0x00}, 25*time.Millisecond); err == nil {
+		t.Fatalf("large request didn't fail: %v.", rep)
+	} else if _, ok := err.(*RemoteError); !ok || err.Error() != faultBusy {
+		t.Fatalf("large request failure mismatch: have %v, want %v.", err, faultBusy)
 	}
 	// Check that space freed gets replenished
 	if _, err := handler.conn.Request(config.cluster, []byte{0x00}, 25*time.Millisecond); err != nil {
@@ -341,20 +1471,60 @@ func TestRequestExpiration(t *testing.T) {
 
 // Benchmarks the latency of a single request/reply operation.
 func BenchmarkRequestLatency(b *testing.B) {
-	// Create the service handler
+	benchmarkRequestLatency(nil, b)
+}
+
+// Benchmarks the latency of a single request/reply operation with Nagle's algorithm
+// enabled on the relay link.
+func BenchmarkRequestLatencyNagle(b *testing.B) {
+	benchmarkRequestLatency(&ConnectOpts{Nagle: true}, b)
+}
+
+func benchmarkRequestLatency(opts *ConnectOpts, b *testing.B) {
+	// Register a new service to the relay
 	handler := new(requestTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		b.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Reset timer and benchmark the message transfer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Request(config.cluster, []byte{byte(i)}, time.Second); err != nil {
+			b.Fatalf("request failed: %v.", err)
+		}
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
+
+// Benchmarks the allocations of request processing with fresh inbound buffers.
+func BenchmarkRequestBuffers(b *testing.B) {
+	benchmarkRequestBuffers(false, b)
+}
+
+// Benchmarks the allocations of request processing with reused inbound buffers.
+func BenchmarkRequestBuffersReused(b *testing.B) {
+	benchmarkRequestBuffers(true, b)
+}
 
+func benchmarkRequestBuffers(reuse bool, b *testing.B) {
 	// Register a new service to the relay
-	serv, err := Register(config.relay, config.cluster, handler, nil)
+	handler := new(requestTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{ReuseBuffers: reuse})
 	if err != nil {
 		b.Fatalf("registration failed: %v.", err)
 	}
-	defer serv.Unregister()
+	defer conn.Close()
 
 	// Reset timer and benchmark the message transfer
+	request := make([]byte, 16*1024)
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if _, err := handler.conn.Request(config.cluster, []byte{byte(i)}, time.Second); err != nil {
+		if _, err := conn.Request(config.cluster, request, time.Second); err != nil {
 			b.Fatalf("request failed: %v.", err)
 		}
 	}
@@ -423,3 +1593,24 @@ func benchmarkRequestThroughput(threads int, b *testing.B) {
 	// Stop the timer (don't measure deferred cleanup)
 	b.StopTimer()
 }
+
+// Benchmarks the end-to-end latency of one-shot requests, including the connect.
+func BenchmarkQuickRequest(b *testing.B) {
+	// Register a new service to the relay
+	handler := new(requestTestHandler)
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		b.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Reset timer and benchmark the connect and request round-trips
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := QuickRequest(config.relay, config.cluster, []byte{byte(i)}, time.Second); err != nil {
+			b.Fatalf("iteration %d: quick request failed: %v.", i, err)
+		}
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the streaming requests, answered by multiple replies. The relay only
+// supports a single reply per request, so streams are carried over tunnels: the
+// initiator sends the request as the first message, marked with a magic prefix,
+// and the acceptor answers with type tagged frames, the last one terminating the
+// stream either successfully or with a fault.
+
+package iris
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Magic prefix of the tunnel message carrying a streaming request.
+var streamMagic = []byte("\x00iris-stream\x00")
+
+// Frame types of the replies to a streaming request.
+const (
+	streamReply byte = iota + 1 // Reply chunk of the stream
+	streamEnd                   // Successful end of the stream
+	streamFault                 // Failed end of the stream, followed by the fault
+)
+
+// Sink of the replies to a streaming request, passed to HandleRequestStream.
+type ReplyWriter interface {
+	// Sends a single reply to the requester, blocking while the requester is
+	// not consuming them fast enough.
+	Write(reply []byte) error
+}
+
+// Reply writer of a streaming request, framing the replies into the tunnel.
+type tunnelReplyWriter struct {
+	tun *Tunnel
+}
+
+// Implements ReplyWriter, sending a reply frame through the tunnel.
+func (w *tunnelReplyWriter) Write(reply []byte) error {
+	return w.tun.Send(append([]byte{streamReply}, reply...), 0)
+}
+
+// Sends a request to be serviced by a member of the specified cluster, which may
+// answer with any number of replies (see StreamRequestHandler). The replies are
+// delivered in order on the first channel, which is closed when the stream ends.
+// The second channel then yields the failure, if any, and is closed too.
+//
+// The timeout bounds the stream setup and the wait for each subsequent reply, so
+// long streams stay alive as long as they make progress. The reply channel must
+// be drained, otherwise the stream stalls.
+func (c *Connection) RequestStream(cluster string, request []byte, timeout time.Duration) (<-chan []byte, <-chan error) {
+	replies, errs := make(chan []byte), make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(replies)
+
+		if err := c.requestStream(cluster, request, timeout, replies); err != nil {
+			errs <- err
+		}
+	}()
+	return replies, errs
+}
+
+// Opens a tunnel to the remote cluster, sends the streaming request and forwards
+// the replies until the stream terminates.
+func (c *Connection) requestStream(cluster string, request []byte, timeout time.Duration, replies chan<- []byte) error {
+	// Sanity check on the arguments
+	if request == nil || len(request) == 0 {
+		return errors.New("nil or empty request")
+	}
+	tun, err := c.initTunnel(context.Background(), cluster, timeout, finalizeTunnelOpts(nil))
+	if err != nil {
+		return err
+	}
+	defer tun.Close()
+
+	// Send the request and process the reply frames
+	if err := tun.Send(append(append([]byte{}, streamMagic...), request...), timeout); err != nil {
+		return err
+	}
+	for {
+		frame, err := tun.Recv(timeout)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(frame) > 0 && frame[0] == streamReply:
+			replies <- frame[1:]
+		case len(frame) == 1 && frame[0] == streamEnd:
+			return nil
+		case len(frame) > 0 && frame[0] == streamFault:
+			return newRemoteError(string(frame[1:]))
+		default:
+			return fmt.Errorf("protocol violation: invalid stream frame %q", frame)
+		}
+	}
+}
+
+// Checks whether the first message of an accepted tunnel, already awaited while
+// negotiating the tunnel features, carries a streaming request. Otherwise the
+// message is left queued for the application.
+func (t *Tunnel) peekStream() ([]byte, bool) {
+	msg := t.peekMessage(0)
+	if msg == nil {
+		return nil, false
+	}
+	msg, err := t.decompress(msg)
+	if err != nil || !bytes.HasPrefix(msg, streamMagic) {
+		return nil, false
+	}
+	t.fetchMessage()
+	return msg[len(streamMagic):], true
+}
+
+// Serves a streaming request arrived through a tunnel, terminating the stream
+// with the handler's result. The tunnel is left to the requester to close after
+// consuming the final frame, torn down locally only if it fails to do so.
+func (c *Connection) serveStream(handler StreamRequestHandler, tun *Tunnel, request []byte) {
+	tun.Log.Debug("serving streaming request", "data", logLazyBlob(request))
+
+	frame := []byte{streamEnd}
+	if fault := c.runStream(handler, tun, request); fault != "" {
+		frame = append([]byte{streamFault}, fault...)
+	}
+	if err := tun.Send(frame, 0); err != nil {
+		tun.Log.Warn("failed to terminate reply stream", "reason", err)
+	}
+	select {
+	case <-tun.term:
+	case <-time.After(compressionTimeout):
+		tun.Close()
+	}
+}
+
+// Runs the streaming request handler, converting any returned error or panic into
+// a fault message for the requester.
+func (c *Connection) runStream(handler StreamRequestHandler, tun *Tunnel, request []byte) (fault string) {
+	defer func() {
+		if r := recover(); r != nil {
+			tun.Log.Error("stream handler panicked", "panic", r)
+			fault = faultPanic + fmt.Sprint(r)
+			if c.opts.PanicStack {
+				fault += "\n\n" + string(debug.Stack())
+			}
+		}
+	}()
+	if err := handler.HandleRequestStream(request, &tunnelReplyWriter{tun: tun}); err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the request retry helpers and the idempotency key framing allowing
+// remote handlers to deduplicate retried requests.
+
+package iris
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Policy controlling the re-execution of failed requests.
+type RetryPolicy struct {
+	Attempts   int              // Total number of attempts, including the first (0 = 3)
+	Backoff    time.Duration    // Delay before the first retry, doubled after each (0 = 100ms)
+	MaxBackoff time.Duration    // Upper bound of the delay between retries (0 = unbounded)
+	Retryable  func(error) bool // Predicate selecting retryable failures (nil = timeouts only)
+	Jitter     bool             // Randomize each delay uniformly below the backoff (full jitter)
+
+	// Key identifying the logical request across retries. If set, it is carried
+	// in front of the request payload, which remote handlers can extract with
+	// ParseIdempotencyKey to deduplicate requests processed but not replied in
+	// time. Handlers not aware of the framing will see it as part of the data.
+	IdempotencyKey string
+}
+
+// User options of a single request.
+type RequestOpts struct {
+	// Re-issue the request on the restored relay link if the link drops while the
+	// request is pending, instead of failing with ErrReconnecting. The request may
+	// get processed twice, so only enable it for idempotent ones. The total wait is
+	// still bounded by the original timeout.
+	ResendOnReconnect bool
+
+	// Callback notified of the timing breakdown of the request once it completes
+	// (nil = not traced). It runs on the requesting goroutine, so keep it fast.
+	Trace func(RequestTrace)
+}
+
+// Default policy of retrying requests.
+var defaultRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	Backoff:  100 * time.Millisecond,
+}
+
+// Magic prefix of requests carrying an idempotency key.
+var idempotencyMagic = []byte("\x00iris-idem\x00")
+
+// Merges the user requested retry policy with the defaults.
+func finalizeRetryPolicy(policy RetryPolicy) RetryPolicy {
+	if policy.Attempts == 0 {
+		policy.Attempts = defaultRetryPolicy.Attempts
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = defaultRetryPolicy.Backoff
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = func(err error) bool { return errors.Is(err, ErrTimeout) }
+	}
+	return policy
+}
+
+// Executes a synchronous request similarly to Request, but retries it according
+// to the policy if it fails with a retryable error. The error of the last attempt
+// is returned if all fail.
+//
+// Note, a timed out request might have been processed nonetheless, so retrying
+// is only safe for idempotent handlers, or ones deduplicating via the key.
+func (c *Connection) RequestRetry(cluster string, request []byte, timeout time.Duration, policy RetryPolicy) ([]byte, error) {
+	reply, _, err := c.requestRetry(cluster, request, timeout, policy)
+	return reply, err
+}
+
+// Executes a synchronous request similarly to Request, retrying it on timeouts up
+// to the given number of attempts, with full jitter backoff between them. If all
+// attempts fail, the last error is returned annotated with the attempt count.
+func (c *Connection) RequestWithRetries(cluster string, request []byte, perTry time.Duration, attempts int) ([]byte, error) {
+	if attempts < 1 {
+		return nil, errors.New("non-positive retry attempts")
+	}
+	reply, done, err := c.requestRetry(cluster, request, perTry, RetryPolicy{Attempts: attempts, Jitter: true})
+	if err != nil {
+		return nil, fmt.Errorf("request failed after %d attempt(s): %w", done, err)
+	}
+	return reply, nil
+}
+
+// Executes the retry loop of RequestRetry, additionally returning the number of
+// attempts made.
+func (c *Connection) requestRetry(cluster string, request []byte, timeout time.Duration, policy RetryPolicy) ([]byte, int, error) {
+	policy = finalizeRetryPolicy(policy)
+	if policy.Attempts < 0 {
+		return nil, 0, errors.New("negative retry attempts")
+	}
+	if policy.IdempotencyKey != "" && len(request) > 0 {
+		request = frameIdempotencyKey(policy.IdempotencyKey, request)
+	}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		reply, err := c.Request(cluster, request, timeout)
+		if err == nil || attempt >= policy.Attempts || !policy.Retryable(err) {
+			return reply, attempt, err
+		}
+		delay := backoff
+		if policy.Jitter && backoff > 0 {
+			delay = time.Duration(rand.Int63n(int64(backoff)))
+		}
+		c.Log.Debug("retrying failed request", "cluster", cluster, "attempt", attempt, "backoff", delay, "reason", err)
+
+		// Wait for the backoff, aborting if the connection is torn down
+		select {
+		case <-c.term:
+			return nil, attempt, ErrClosed
+		case <-time.After(delay):
+		}
+		if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// Executes a synchronous request similarly to Request, but with the additional
+// options applied.
+func (c *Connection) RequestWith(cluster string, request []byte, timeout time.Duration, opts RequestOpts) ([]byte, error) {
+	ctx := context.Background()
+	if opts.Trace != nil {
+		trace := &RequestTrace{Cluster: cluster, Start: time.Now()}
+		ctx = context.WithValue(ctx, requestTraceKey{}, trace)
+
+		defer func() { opts.Trace(*trace) }()
+		return c.requestWith(ctx, trace, cluster, request, timeout, opts)
+	}
+	return c.requestWith(ctx, nil, cluster, request, timeout, opts)
+}
+
+// Executes the resend loop of RequestWith, filling in the trace (if any) upon
+// completion.
+func (c *Connection) requestWith(ctx context.Context, trace *RequestTrace, cluster string, request []byte, timeout time.Duration, opts RequestOpts) (reply []byte, err error) {
+	if trace != nil {
+		defer func() { trace.Err, trace.Done = err, time.Now() }()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		reply, err := c.request(ctx, cluster, request, timeout)
+		if !opts.ResendOnReconnect || !errors.Is(err, ErrReconnecting) {
+			return reply, err
+		}
+		// Wait for the relay link to be restored, within the original timeout
+		wait := time.NewTimer(time.Until(deadline))
+		select {
+		case <-c.term:
+			wait.Stop()
+			return nil, ErrClosed
+		case <-wait.C:
+			return nil, ErrTimeout
+		case <-c.linkRestored():
+			wait.Stop()
+		}
+		if timeout = time.Until(deadline); timeout < time.Millisecond {
+			return nil, ErrTimeout
+		}
+		c.Log.Debug("resending request on restored link", "cluster", cluster, "timeout", timeout)
+	}
+}
+
+// Retrieves a channel that is closed once the relay link is up (already closed
+// if it's currently up).
+func (c *Connection) linkRestored() <-chan struct{} {
+	c.sockLock.Lock()
+	defer c.sockLock.Unlock()
+
+	if !c.sockDown {
+		up := make(chan struct{})
+		close(up)
+		return up
+	}
+	return c.sockUp
+}
+
+// Prefixes the request payload with the idempotency key.
+func frameIdempotencyKey(key string, request []byte) []byte {
+	size := make([]byte, binary.MaxVarintLen64)
+	size = size[:binary.PutUvarint(size, uint64(len(key)))]
+
+	framed := make([]byte, 0, len(idempotencyMagic)+len(size)+len(key)+len(request))
+	framed = append(framed, idempotencyMagic...)
+	framed = append(framed, size...)
+	framed = append(framed, key...)
+	return append(framed, request...)
+}
+
+// Extracts the idempotency key of a request sent via RequestRetry, returning it
+// along with the original payload. Requests without a key are returned as is,
+// with an empty key.
+func ParseIdempotencyKey(request []byte) (string, []byte) {
+	if !bytes.HasPrefix(request, idempotencyMagic) {
+		return "", request
+	}
+	rest := request[len(idempotencyMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return "", request
+	}
+	rest = rest[n:]
+	return string(rest[:size]), rest[size:]
+}
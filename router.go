@@ -0,0 +1,72 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the request router, dispatching the requests of a cluster serving
+// many request kinds based on a leading kind byte.
+
+package iris
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Request dispatcher selecting the handler of a request by its first byte. The
+// kind byte is stripped before the handler is invoked.
+//
+// The router implements the HandleRequest method of ServiceHandler, so it can be
+// embedded into a service handler to serve its requests.
+type Router struct {
+	routes   map[byte]func([]byte) ([]byte, error) // Handlers of the registered request kinds
+	fallback func([]byte) ([]byte, error)          // Handler of the unregistered kinds (nil = fail)
+	lock     sync.RWMutex                          // Mutex protecting the handler registrations
+}
+
+// Creates a new request router with no routes registered.
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[byte]func([]byte) ([]byte, error)),
+	}
+}
+
+// Registers the handler for requests of the given kind, replacing any previous one.
+func (r *Router) Handle(kind byte, handler func([]byte) ([]byte, error)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.routes[kind] = handler
+}
+
+// Registers the handler for requests of kinds without a dedicated one. As opposed
+// to the kind handlers, the fallback receives the request including the kind byte.
+func (r *Router) HandleDefault(handler func([]byte) ([]byte, error)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.fallback = handler
+}
+
+// Dispatches a request to the handler registered for its kind, or the fallback
+// one if no dedicated handler exists. Without a fallback, unknown kinds fail with
+// an error.
+func (r *Router) HandleRequest(request []byte) ([]byte, error) {
+	if len(request) == 0 {
+		return nil, fmt.Errorf("%w: empty request", ErrRouteNotFound)
+	}
+	r.lock.RLock()
+	handler, ok := r.routes[request[0]]
+	fallback := r.fallback
+	r.lock.RUnlock()
+
+	switch {
+	case ok:
+		return handler(request[1:])
+	case fallback != nil:
+		return fallback(request)
+	default:
+		return nil, fmt.Errorf("%w: kind %d", ErrRouteNotFound, request[0])
+	}
+}
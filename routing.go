@@ -0,0 +1,34 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the advisory routing hints of requests. The relay picks the member
+// serving a request on its own, so the hints are only forwarded where supported.
+
+package iris
+
+import (
+	"context"
+	"time"
+)
+
+// Executes a synchronous request to be serviced by a member of the specified
+// cluster, asking the relay to consistently route requests of the same key to
+// the same member (e.g. for cache locality in sharded services).
+//
+// The key is an advisory hint: relays speaking v1.0-draft2 have no keyed member
+// selection, so it is ignored and the request is load-balanced as with Request.
+func (c *Connection) RequestKeyed(cluster string, key []byte, request []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(context.Background(), cluster, request, timeout)
+}
+
+// Advertises the capacity of the local member, asking the relay to favor higher
+// weight members of the cluster when load-balancing requests.
+//
+// The weight is an advisory hint: relays speaking v1.0-draft2 accept no weights
+// at registration and select members uniformly, so the call is a no-op.
+func (c *Connection) SetMemberWeight(weight int) {
+	c.Log.Debug("ignoring member weight, unsupported by relay", "weight", weight, "relay_version", c.RelayVersion())
+}
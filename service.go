@@ -7,9 +7,8 @@
 package iris
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"sync/atomic"
 
 	"gopkg.in/inconshreveable/log15.v2"
 )
@@ -38,13 +37,45 @@ type ServiceHandler interface {
 	HandleRequest(request []byte) ([]byte, error)
 
 	// Callback invoked whenever a tunnel designated to the service's cluster is
-	// constructed from a remote node to this particular instance.
+	// constructed from a remote node to this particular instance. The first
+	// message of the tunnel is awaited (up to a second) to answer any feature
+	// negotiation, so tunnels whose initiator doesn't speak first are handed over
+	// with that delay.
 	HandleTunnel(tunnel *Tunnel)
 
 	// Callback notifying the service that the local relay dropped its connection.
+	// The reason is a *RelayShutdownError, *NetworkError or *LocalCloseError.
 	HandleDrop(reason error)
 }
 
+// Optional extension of the service handler, receiving the context of inbound
+// requests. The context carries the request metadata (IncomingMetadata) and
+// allows attaching metadata to the reply (SetReplyMetadata). Its deadline is set
+// to when the requester times out, so handlers can abandon work nobody waits
+// for anymore. If implemented, it is invoked instead of HandleRequest.
+type ContextRequestHandler interface {
+	ServiceHandler
+
+	// Callback invoked whenever a request designated to the service's cluster is
+	// load-balanced to the local node, along with the context of the request.
+	HandleRequestContext(ctx context.Context, request []byte) ([]byte, error)
+}
+
+// Optional extension of the service handler, answering requests with a stream of
+// replies (see Connection.RequestStream). Streaming requests travel over tunnels,
+// so if implemented, the first message of each inbound tunnel is checked to tell
+// them apart from plain tunnels, which are then passed on to HandleTunnel with
+// the message intact.
+type StreamRequestHandler interface {
+	ServiceHandler
+
+	// Callback invoked whenever a streaming request designated to the service's
+	// cluster is load-balanced to the local node. The replies are sent through the
+	// writer, and the stream ends when the method returns. A non-nil error is
+	// delivered to the requester after the replies already sent.
+	HandleRequestStream(request []byte, replies ReplyWriter) error
+}
+
 // Service instance belonging to a particular cluster in the network.
 type Service struct {
 	conn *Connection  // Network connection to the local Iris relay
@@ -61,43 +92,15 @@ func Register(port int, cluster string, handler ServiceHandler, limits *ServiceL
 	if len(cluster) == 0 {
 		return nil, errors.New("empty cluster identifier")
 	}
-	if handler == nil {
-		return nil, errors.New("nil service handler")
-	}
-	// Make sure the service limits have valid values
-	limits = finalizeServiceLimits(limits)
-
-	logger := Log.New("service", atomic.AddUint64(&nextServId, 1))
-	logger.Info("registering new service", "relay_port", port, "cluster", cluster,
-		"broadcast_limits", log15.Lazy{func() string {
-			return fmt.Sprintf("%dT|%dB", limits.BroadcastThreads, limits.BroadcastMemory)
-		}},
-		"request_limits", log15.Lazy{func() string {
-			return fmt.Sprintf("%dT|%dB", limits.RequestThreads, limits.RequestMemory)
-		}})
-
-	// Connect to the Iris relay as a service
-	conn, err := newConnection(port, cluster, handler, limits, logger)
+	// Connect to the Iris relay as a service and wrap it
+	conn, err := ConnectWith(port, cluster, handler, &ConnectOpts{Limits: limits})
 	if err != nil {
-		logger.Warn("failed to register new service", "reason", err)
 		return nil, err
 	}
-	// Assemble the service object and initialize it
 	serv := &Service{
 		conn: conn,
-		Log:  logger,
+		Log:  conn.Log,
 	}
-	if err := handler.Init(conn); err != nil {
-		logger.Warn("user failed to initialize service", "reason", err)
-		conn.Close()
-		return nil, err
-	}
-	logger.Info("service registration completed")
-
-	// Start the handler pools
-	conn.bcastPool.Start()
-	conn.reqPool.Start()
-
 	return serv, nil
 }
 
@@ -131,13 +134,6 @@ func finalizeServiceLimits(user *ServiceLimits) *ServiceLimits {
 //
 // The call blocks until the tear-down is confirmed by the Iris node.
 func (s *Service) Unregister() error {
-	// Tear-down the connection
-	err := s.conn.Close()
-
-	// Stop all the thread pools (drop unprocessed messages)
-	s.conn.reqPool.Terminate(true)
-	s.conn.bcastPool.Terminate(true)
-
-	// Return the result of the connection close
-	return err
+	// Tear-down the connection (stops the thread pools too)
+	return s.conn.Close()
 }
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the life-cycle states of a relay connection.
+
+package iris
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Number of recoverable read errors buffered until the application drains them.
+const readErrorBuffer = 64
+
+// Life-cycle state of a connection to the local relay.
+type ConnState int32
+
+const (
+	Connecting   ConnState = iota // Relay link is being established
+	Connected                     // Relay link is up and operational
+	Reconnecting                  // Relay link dropped, trying to re-establish
+	Closed                        // Connection permanently torn down
+)
+
+// Implements the fmt.Stringer interface.
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int32(s))
+	}
+}
+
+// Retrieves the current life-cycle state of the connection.
+func (c *Connection) State() ConnState {
+	return ConnState(atomic.LoadInt32(&c.state))
+}
+
+// Retrieves a channel that is closed exactly once, when the connection is torn
+// down permanently: either via Close, the relay closing it, or after all the
+// reconnection attempts failed. Transient link drops don't fire it.
+func (c *Connection) Closed() <-chan struct{} {
+	return c.term
+}
+
+// Retrieves a channel reporting the recoverable protocol violations of the relay,
+// such as replies to requests or transfers to tunnels never issued. These are
+// dropped without affecting the connection, so they're only of interest to alert
+// on a misbehaving relay. A limited number of reports are buffered, later ones
+// are discarded while the channel isn't drained. The channel is never closed.
+//
+// Framing errors (malformed fields, unknown opcodes, oversized blobs) leave the
+// inbound stream undecodable and remain fatal: the link is dropped and, if the
+// reconnection fails or wasn't requested, HandleDrop is notified.
+func (c *Connection) ReadErrors() <-chan error {
+	return c.readErrs
+}
+
+// Transitions the connection into a new state, notifying the user if requested.
+// All transitions are made sequentially by the connection setup and the relay
+// receiver, so notifications never run concurrently and arrive in order.
+func (c *Connection) setState(state ConnState) {
+	atomic.StoreInt32(&c.state, int32(state))
+
+	c.Log.Debug("connection state changed", "state", state)
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(state)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the stream oriented adapter of the message oriented tunnels.
+
+package iris
+
+import "io"
+
+// Stream oriented view of a tunnel, implementing io.ReadWriteCloser.
+type tunnelStream struct {
+	tun *Tunnel // Message oriented tunnel being wrapped
+	buf []byte  // Unread remainder of the last received message
+}
+
+// Returns a stream oriented view of the tunnel, implementing io.ReadWriteCloser
+// so that it may be used with any io based utility (bufio, compression, TLS).
+// Reads may return less data than a tunnel message carried, keeping the rest
+// buffered for subsequent calls, whereas writes are split into chunk sized
+// tunnel messages. Closing the stream closes the underlying tunnel.
+//
+// Reads and writes block indefinitely, mixing them with direct message based
+// tunnel operations results in undefined stream contents.
+func (t *Tunnel) Stream() io.ReadWriteCloser {
+	return &tunnelStream{tun: t}
+}
+
+// Implements io.Reader, retrieving data from the tunnel. A graceful close of the
+// tunnel is reported as io.EOF.
+func (s *tunnelStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Fetch a new message if everything was consumed already
+	if len(s.buf) == 0 {
+		msg, err := s.tun.Recv(0)
+		if err != nil {
+			if err == ErrClosed && s.tun.stat == nil {
+				err = io.EOF
+			} else if err == ErrClosed {
+				err = s.tun.stat
+			}
+			return 0, err
+		}
+		s.buf = msg
+	}
+	// Return as much as possible and buffer the rest
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Implements io.Writer, sending the data into the tunnel in chunk sized messages.
+func (s *tunnelStream) Write(p []byte) (int, error) {
+	for pos := 0; pos < len(p); pos += s.tun.chunkLimit {
+		end := pos + s.tun.chunkLimit
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.tun.Send(p[pos:end], 0); err != nil {
+			return pos, err
+		}
+	}
+	return len(p), nil
+}
+
+// Implements io.Closer, tearing down the underlying tunnel.
+func (s *tunnelStream) Close() error {
+	return s.tun.Close()
+}
+
+// Half-closes the stream, signalling the remote side the end of the written data
+// while still allowing reads.
+func (s *tunnelStream) CloseWrite() error {
+	return s.tun.CloseSend()
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the optional rate limiting of the outbound publishes and broadcasts,
+// protecting the relay and the recipients from accidental message floods.
+
+package iris
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Creates the outbound message rate limiter requested by the options, or nil if
+// the rate is not limited.
+func newPublishLimiter(opts *ConnectOpts) *rate.Limiter {
+	if opts.PublishRate == 0 || opts.PublishRate == rate.Inf {
+		return nil
+	}
+	burst := opts.PublishBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(opts.PublishRate, burst)
+}
+
+// Enforces the outbound message rate limit, either waiting until the message is
+// allowed (or the context is cancelled), or failing with ErrThrottled if fail fast
+// was requested.
+func (c *Connection) throttle(ctx context.Context) error {
+	if c.pubLimit == nil || c.pubLimit.Allow() {
+		return nil
+	}
+	atomic.AddUint64(&c.stats.throttled, 1)
+	if c.opts.PublishFailFast {
+		return ErrThrottled
+	}
+	// Wait for the send allowance, aborting if the connection is torn down
+	reservation := c.pubLimit.Reserve()
+
+	wait := time.NewTimer(reservation.Delay())
+	defer wait.Stop()
+
+	select {
+	case <-c.term:
+		reservation.Cancel()
+		return ErrClosed
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	case <-wait.C:
+		return nil
+	}
+}
@@ -7,8 +7,10 @@
 package iris
 
 import (
+	"sync"
 	"sync/atomic"
 
+	"github.com/project-iris/iris/container/queue"
 	"github.com/project-iris/iris/pool"
 	"gopkg.in/inconshreveable/log15.v2"
 )
@@ -20,35 +22,121 @@ type TopicHandler interface {
 	HandleEvent(event []byte)
 }
 
+// Optional extension of the topic handler, receiving the name of the topic each
+// event was published to. This allows a single handler instance to serve many
+// subscriptions. If implemented, it is invoked instead of HandleEvent.
+type TopicEventHandler interface {
+	TopicHandler
+
+	// Callback invoked whenever an event is published to the topic subscribed to
+	// by this particular handler, along with the name of the topic.
+	HandleEventOn(topic string, event []byte)
+}
+
+// Adapter to use an ordinary function as a topic handler.
+type TopicHandlerFunc func(event []byte)
+
+// Calls f(event).
+func (f TopicHandlerFunc) HandleEvent(event []byte) {
+	f(event)
+}
+
+// Adapter to use an ordinary function as a topic handler also receiving the name
+// of the topic each event was published to.
+type TopicEventHandlerFunc func(topic string, event []byte)
+
+// Calls f("", event). The bindings always deliver through HandleEventOn, so the
+// empty topic is only seen if the handler is invoked directly as a TopicHandler
+// by user code.
+func (f TopicEventHandlerFunc) HandleEvent(event []byte) {
+	f("", event)
+}
+
+// Calls f(topic, event).
+func (f TopicEventHandlerFunc) HandleEventOn(topic string, event []byte) {
+	f(topic, event)
+}
+
+// Policy to handle inbound events overflowing the pending queue of a topic.
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota // Discard the arriving event
+	DropOldest                       // Discard the oldest pending events to make room
+	Block                            // Wait until enough pending events are processed
+)
+
+// User options of a topic subscription.
+type SubscribeOpts struct {
+	Limits     *TopicLimits   // Limits on the inbound event processing
+	BufferSize int            // Maximum number of pending events (0 = memory limited only)
+	OnOverflow OverflowPolicy // Policy to handle events overflowing the pending queue
+
+	// Deliver the events sequentially, in the order they were published. This caps
+	// the event handling to a single thread, and events are queued inline with the
+	// relay receiver, so a Block overflow policy stalls the whole connection.
+	Ordered bool
+
+	// Number of recently retained events (see PublishRetained) to replay on
+	// subscription. If the relay doesn't support retention, subscribing with a
+	// non-zero value fails with an error wrapping ErrFeatureUnavailable, as it
+	// does on every v1.0-draft2 relay.
+	ReplayLast int
+}
+
 // Topic subscription, responsible for enforcing the quality of service limits.
 type topic struct {
 	// Application layer fields
+	name    string       // Name of the subscribed topic
 	handler TopicHandler // Handler for topic events
 
 	// Quality of service fields
-	limits *TopicLimits // Limits on the inbound message processing
+	limits   *TopicLimits   // Limits on the inbound message processing
+	buffer   int            // Maximum number of pending events (0 = unlimited)
+	overflow OverflowPolicy // Policy to handle events overflowing the pending queue
+	ordered  bool           // Whether the events are delivered in publish order
+	recovery bool           // Whether handler panics are recovered instead of propagated
 
 	eventIdx  uint64           // Index to assign to inbound events for logging purposes
-	eventPool *pool.ThreadPool // Queue and concurrency limiter for the event handlers
-	eventUsed int32            // Actual memory usage of the event queue
+	eventPool *pool.ThreadPool // Concurrency limiter for the event handlers
+	eventQueu *queue.Queue     // Queue of events pending processing
+	eventPend int              // Number of processing tasks scheduled, not yet started
+	eventUsed int              // Actual memory usage of the event queue
+	eventDrop uint64           // Number of events dropped due to overflows
+	eventLock sync.Mutex       // Mutex to protect the event queue
+	eventCond *sync.Cond       // Signaler for event queue space (blocking overflow)
 
 	// Bookkeeping fields
 	logger log15.Logger
 }
 
+// Inbound event pending processing.
+type topicEvent struct {
+	id   int    // Index of the event for logging purposes
+	data []byte // Event payload
+}
+
 // Creates a new topic subscription.
-func newTopic(handler TopicHandler, limits *TopicLimits, logger log15.Logger) *topic {
+func newTopic(name string, handler TopicHandler, opts SubscribeOpts, recovery bool, logger log15.Logger) *topic {
 	top := &topic{
 		// Application layer
+		name:    name,
 		handler: handler,
 
 		// Quality of service
-		limits:    limits,
-		eventPool: pool.NewThreadPool(limits.EventThreads),
+		limits:    opts.Limits,
+		buffer:    opts.BufferSize,
+		overflow:  opts.OnOverflow,
+		ordered:   opts.Ordered,
+		recovery:  recovery,
+		eventPool: pool.NewThreadPool(opts.Limits.EventThreads),
+		eventQueu: queue.New(),
 
 		// Bookkeeping
 		logger: logger,
 	}
+	top.eventCond = sync.NewCond(&top.eventLock)
+
 	// Start the event processing and return
 	top.eventPool.Start()
 	return top
@@ -73,26 +161,95 @@ func finalizeTopicLimits(user *TopicLimits) *TopicLimits {
 	return limits
 }
 
+// Merges the user requested subscription options with the defaults.
+func finalizeSubscribeOpts(opts SubscribeOpts) SubscribeOpts {
+	opts.Limits = finalizeTopicLimits(opts.Limits)
+	if opts.Ordered && opts.Limits.EventThreads != 1 {
+		limits := *opts.Limits
+		limits.EventThreads = 1
+		opts.Limits = &limits
+	}
+	return opts
+}
+
+// Checks whether an event of the given size would overflow the pending queue.
+// The method assumes the event lock is held.
+func (t *topic) overflows(size int) bool {
+	if t.buffer > 0 && t.eventQueu.Size() >= t.buffer {
+		return true
+	}
+	return t.eventUsed+size > t.limits.EventMemory
+}
+
 // Schedules a topic event for the subscription handler to process.
 func (t *topic) handlePublish(event []byte) {
 	id := int(atomic.AddUint64(&t.eventIdx, 1))
 	t.logger.Debug("scheduling arrived event", "event", id, "data", logLazyBlob(event))
 
-	// Make sure there is enough memory for the event
-	used := int(atomic.LoadInt32(&t.eventUsed)) // Safe, since only 1 thread increments!
-	if used+len(event) <= t.limits.EventMemory {
-		// Increment the memory usage of the queue and schedule the event
-		atomic.AddInt32(&t.eventUsed, int32(len(event)))
-		t.eventPool.Schedule(func() {
-			// Start the processing by decrementing the memory usage
-			atomic.AddInt32(&t.eventUsed, -int32(len(event)))
-			t.logger.Debug("handling scheduled event", "event", id)
-			t.handler.HandleEvent(event)
-		})
+	t.eventLock.Lock()
+	defer t.eventLock.Unlock()
+
+	// Make room for the event according to the overflow policy
+	for t.overflows(len(event)) {
+		// If the event doesn't fit even into an empty queue, or the policy is to drop
+		// the new event, discard it
+		if t.eventQueu.Empty() || t.overflow == DropNewest {
+			atomic.AddUint64(&t.eventDrop, 1)
+			t.logger.Error("event exceeded queue allowance", "event", id, "limit", t.limits.EventMemory, "used", t.eventUsed, "size", len(event), "buffer", t.buffer)
+			return
+		}
+		// Otherwise either discard the oldest pending event, or wait for processing
+		if t.overflow == DropOldest {
+			old := t.eventQueu.Pop().(*topicEvent)
+			t.eventUsed -= len(old.data)
+
+			atomic.AddUint64(&t.eventDrop, 1)
+			t.logger.Warn("discarding oldest queued event", "event", old.id, "size", len(old.data))
+		} else {
+			t.eventCond.Wait()
+		}
+	}
+	// Queue the event and schedule a processing task if there's none for it
+	t.eventQueu.Push(&topicEvent{id: id, data: event})
+	t.eventUsed += len(event)
+
+	if t.eventPend < t.eventQueu.Size() {
+		t.eventPend++
+		t.eventPool.Schedule(t.handleEvent)
+	}
+}
+
+// Pops the oldest pending event and delivers it to the subscription handler.
+func (t *topic) handleEvent() {
+	t.eventLock.Lock()
+	t.eventPend--
+	if t.eventQueu.Empty() {
+		t.eventLock.Unlock()
 		return
 	}
-	// Not enough memory in the event queue
-	t.logger.Error("event exceeded memory allowance", "event", id, "limit", t.limits.EventMemory, "used", used, "size", len(event))
+	event := t.eventQueu.Pop().(*topicEvent)
+	t.eventUsed -= len(event.data)
+	t.eventCond.Broadcast()
+	t.eventLock.Unlock()
+
+	t.logger.Debug("handling scheduled event", "event", event.id)
+	if t.recovery {
+		defer func() {
+			if r := recover(); r != nil {
+				t.logger.Error("event handler panicked", "event", event.id, "panic", r)
+			}
+		}()
+	}
+	if handler, ok := t.handler.(TopicEventHandler); ok {
+		handler.HandleEventOn(t.name, event.data)
+	} else {
+		t.handler.HandleEvent(event.data)
+	}
+}
+
+// Retrieves the number of events dropped due to queue overflows.
+func (t *topic) dropped() uint64 {
+	return atomic.LoadUint64(&t.eventDrop)
 }
 
 // Terminates a topic subscription's internal processing pool.
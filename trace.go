@@ -0,0 +1,61 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the timing breakdown of traced requests.
+
+package iris
+
+import (
+	"context"
+	"time"
+)
+
+// Timing breakdown of a single request, passed to RequestOpts.Trace when the
+// request completes. Timestamps of stages not reached are left zero. If a request
+// was resent on a restored relay link, Sent and FirstByte refer to the last send.
+type RequestTrace struct {
+	Cluster string // Target cluster of the request
+	Err     error  // Failure of the request, nil if it succeeded
+
+	Start     time.Time // Request issued by the application
+	Sent      time.Time // Request written to the relay link
+	FirstByte time.Time // First byte of the reply read from the relay link
+	Done      time.Time // Reply (or failure) handed back to the application
+}
+
+// Returns the time spent writing the request to the relay link.
+func (t *RequestTrace) WriteTime() time.Duration {
+	return since(t.Start, t.Sent)
+}
+
+// Returns the time spent in the relay and the remote handler, from writing the
+// request until the reply started arriving.
+func (t *RequestTrace) RemoteTime() time.Duration {
+	return since(t.Sent, t.FirstByte)
+}
+
+// Returns the time spent reading and delivering the reply.
+func (t *RequestTrace) ReadTime() time.Duration {
+	return since(t.FirstByte, t.Done)
+}
+
+// Returns the time between two stages, zero if either was not reached (or if
+// they were stamped out of order by concurrent goroutines).
+func since(from, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// Context key of the trace collecting the timings of an outbound request.
+type requestTraceKey struct{}
+
+// Retrieves the trace attached to a request context, nil if it isn't traced.
+func requestTraceFrom(ctx context.Context) *RequestTrace {
+	trace, _ := ctx.Value(requestTraceKey{}).(*RequestTrace)
+	return trace
+}
@@ -7,9 +7,12 @@
 package iris
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/container/queue"
@@ -19,24 +22,48 @@ import (
 // Communication stream between the local application and a remote endpoint. The
 // ordered delivery of messages is guaranteed and the message flow between the
 // peers is throttled.
+//
+// Sends and receives may be used concurrently with each other and with Close.
+// Concurrent sends however need external synchronization, since the chunks of
+// messages larger than the relay's chunk limit would get interleaved.
 type Tunnel struct {
 	id   uint64      // Tunnel identifier for de/multiplexing
 	conn *Connection // Connection to the local relay
 
 	// Chunking fields
-	chunkLimit int    // Maximum length of a data payload
-	chunkBuf   []byte // Current message being assembled
+	chunkLimit int         // Maximum length of a data payload
+	chunkBuf   []byte      // Current message being assembled
+	comp       Compression // Negotiated compression of the messages
+	maxMsg     int         // Negotiated maximum message size (0 = connection limit)
+	peer       string      // Cluster of the remote endpoint, if identified
 
 	// Quality of service fields
 	itoaBuf  *queue.Queue  // Iris to application message buffer
 	itoaSign chan struct{} // Message arrival signaler
 	itoaLock sync.Mutex    // Protects the buffer and signaler
+	itoaDone bool          // Flag whether the remote side half-closed its sends
+	itoaHeld []byte        // Message not fitting into the last RecvInto buffer
 
 	atoiSpace int           // Application to Iris space allowance
 	atoiSign  chan struct{} // Allowance grant signaler
 	atoiLock  sync.Mutex    // Protects the allowance and signaler
+	atoiDone  int32         // Flag whether the local side half-closed its sends
+	atoiBusy  int           // Number of sends currently in progress
+	atoiIdle  chan struct{} // Signaler of the in-progress sends completing (lingering close)
+
+	fragSend sync.Mutex // Serializes fragmented sends, keeping their fragments contiguous
+	fragRecv sync.Mutex // Serializes fragmented receives, guarding the reassembly state
+	fragBuf  []byte     // Logical message being reassembled
+	fragNext uint32     // Index of the next fragment expected (0 = none in progress)
+
+	pushOnce sync.Once   // Guard for starting the push based receiver
+	pushData chan []byte // Messages delivered by the push based receiver
+	pushErrs chan error  // Failures reported by the push based receiver
 
 	// Bookkeeping fields
+	stats tunnelStats // Traffic counters of the tunnel
+	start time.Time   // Construction time of the tunnel
+
 	init chan bool     // Initialization channel for outbound tunnels
 	term chan struct{} // Channel to signal termination to blocked go-routines
 	stat error         // Failure reason, if any received
@@ -44,7 +71,27 @@ type Tunnel struct {
 	Log log15.Logger // Logger with connection and tunnel ids injected
 }
 
-func (c *Connection) newTunnel() (*Tunnel, error) {
+// Snapshot of the traffic counters of a tunnel.
+type TunnelStats struct {
+	BytesSent        uint64        // Payload bytes sent to the remote endpoint
+	BytesReceived    uint64        // Payload bytes received from the remote endpoint
+	MessagesSent     uint64        // Messages sent to the remote endpoint
+	MessagesReceived uint64        // Messages received from the remote endpoint
+	SendsBlocked     uint64        // Non-blocking sends rejected due to backpressure
+	SendAllowance    int           // Bytes sendable without waiting for the remote pair
+	Age              time.Duration // Time elapsed since the tunnel was constructed
+}
+
+// Traffic counters of a tunnel, updated atomically inline the data paths.
+type tunnelStats struct {
+	bytesSent uint64
+	bytesRecv uint64
+	msgsSent  uint64
+	msgsRecv  uint64
+	sendBlock uint64
+}
+
+func (c *Connection) newTunnel(outbound bool) (*Tunnel, error) {
 	c.tunLock.Lock()
 	defer c.tunLock.Unlock()
 
@@ -52,6 +99,10 @@ func (c *Connection) newTunnel() (*Tunnel, error) {
 	if c.tunLive == nil {
 		return nil, ErrClosed
 	}
+	// Cap the outbound tunnels only, inbound ones are initiated by the relay
+	if max := c.opts.MaxTunnels; outbound && max > 0 && len(c.tunLive) >= max {
+		return nil, ErrTooManyTunnels
+	}
 	// Assign a new locally unique id to the tunnel
 	tunId := c.tunIdx
 	c.tunIdx++
@@ -65,8 +116,9 @@ func (c *Connection) newTunnel() (*Tunnel, error) {
 		itoaSign: make(chan struct{}, 1),
 		atoiSign: make(chan struct{}, 1),
 
-		init: make(chan bool),
-		term: make(chan struct{}),
+		start: time.Now(),
+		init:  make(chan bool),
+		term:  make(chan struct{}),
 
 		Log: c.Log.New("tunnel", tunId),
 	}
@@ -76,21 +128,27 @@ func (c *Connection) newTunnel() (*Tunnel, error) {
 }
 
 // Initiates a new tunnel to a remote cluster.
-func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
+func (c *Connection) initTunnel(ctx context.Context, cluster string, timeout time.Duration, opts *TunnelOpts) (*Tunnel, error) {
 	// Sanity check on the arguments
 	if len(cluster) == 0 {
 		return nil, errors.New("empty cluster identifier")
 	}
+	if opts.Window < 0 {
+		return nil, fmt.Errorf("invalid tunnel window %d < 0", opts.Window)
+	}
+	if opts.MaxMessageSize < 0 {
+		return nil, fmt.Errorf("invalid tunnel message size %d < 0", opts.MaxMessageSize)
+	}
 	timeoutms := int(timeout.Nanoseconds() / 1000000)
 	if timeoutms < 1 {
-		return nil, fmt.Errorf("invalid timeout %v < 1ms", timeout)
+		return nil, fmt.Errorf("%w: %v < 1ms", ErrInvalidTimeout, timeout)
 	}
 	// Create a potential tunnel
-	tun, err := c.newTunnel()
+	tun, err := c.newTunnel(true)
 	if err != nil {
 		return nil, err
 	}
-	tun.Log.Info("constructing outbound tunnel", "cluster", cluster, "timeout", timeout)
+	tun.Log.Info("constructing outbound tunnel", "cluster", cluster, "timeout", timeout, "window", opts.Window)
 
 	// Try and construct the tunnel
 	err = c.sendTunnelInit(tun.id, cluster, timeoutms)
@@ -100,15 +158,36 @@ func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel,
 		case init := <-tun.init:
 			if init {
 				// Send the data allowance
-				if err = c.sendTunnelAllowance(tun.id, defaultTunnelBuffer); err == nil {
-					tun.Log.Info("tunnel construction completed", "chunk_limit", tun.chunkLimit)
+				if err = c.sendTunnelAllowance(tun.id, opts.Window); err == nil {
+					// Agree on the optional features if requested
+					if err := tun.offerFeatures(opts, timeout); err != nil {
+						tun.Log.Warn("tunnel construction failed", "reason", err)
+						tun.Close()
+						return nil, err
+					}
+					tun.Log.Info("tunnel construction completed", "chunk_limit", tun.chunkLimit, "compression", tun.comp, "max_msg", tun.MaxMessageSize())
+					atomic.AddUint64(&c.stats.tunOpen, 1)
 					return tun, nil
 				}
 			} else {
 				err = ErrTimeout
 			}
+		case <-tun.term:
+			// Relay link dropped, check whether permanently or not
+			select {
+			case <-c.term:
+				err = ErrClosed
+			default:
+				err = ErrReconnecting
+			}
 		case <-c.term:
 			err = ErrClosed
+		case <-ctx.Done():
+			// Construction abandoned, make sure a late confirmation gets torn down
+			err = fmt.Errorf("tunnel construction aborted: %w", ctx.Err())
+			tun.Log.Warn("tunnel construction failed", "reason", err)
+			go c.abandonTunnel(tun)
+			return nil, err
 		}
 	}
 	// Clean up and return the failure
@@ -120,23 +199,46 @@ func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel,
 	return nil, err
 }
 
+// Waits for the outcome of an abandoned tunnel construction, closing the tunnel
+// if the relay confirms it nonetheless, so no dangling tunnel remains.
+func (c *Connection) abandonTunnel(tun *Tunnel) {
+	select {
+	case init := <-tun.init:
+		if init {
+			tun.Log.Info("closing abandoned tunnel")
+			tun.Close()
+		}
+	case <-tun.term:
+	}
+	c.tunLock.Lock()
+	delete(c.tunLive, tun.id)
+	c.tunLock.Unlock()
+}
+
 // Accepts an incoming tunneling request and confirms its local id.
 func (c *Connection) acceptTunnel(initId uint64, chunkLimit int) (*Tunnel, error) {
 	// Create the local tunnel endpoint
-	tun, err := c.newTunnel()
+	tun, err := c.newTunnel(false)
 	if err != nil {
 		return nil, err
 	}
 	tun.chunkLimit = chunkLimit
-	tun.Log.Info("accepting inbound tunnel", "chunk_limit", chunkLimit)
+	tun.Log.Info("accepting inbound tunnel", "chunk_limit", chunkLimit, "window", c.opts.Tunnels.Window)
 
 	// Confirm the tunnel creation to the relay node
 	err = c.sendTunnelConfirm(initId, tun.id)
 	if err == nil {
 		// Send the data allowance
-		err = c.sendTunnelAllowance(tun.id, defaultTunnelBuffer)
+		err = c.sendTunnelAllowance(tun.id, c.opts.Tunnels.Window)
 		if err == nil {
-			tun.Log.Info("tunnel acceptance completed")
+			// Answer the optional features offered by the initiator
+			if err := tun.answerFeatures(c.opts.Tunnels, compressionTimeout); err != nil {
+				tun.Log.Warn("tunnel acceptance failed", "reason", err)
+				tun.Close()
+				return nil, err
+			}
+			tun.Log.Info("tunnel acceptance completed", "compression", tun.comp, "max_msg", tun.MaxMessageSize(), "peer", tun.peer)
+			atomic.AddUint64(&c.stats.tunOpen, 1)
 			return tun, nil
 		}
 	}
@@ -155,15 +257,102 @@ func (c *Connection) acceptTunnel(initId uint64, chunkLimit int) (*Tunnel, error
 func (t *Tunnel) Send(message []byte, timeout time.Duration) error {
 	t.Log.Debug("sending message", "data", logLazyBlob(message), "timeout", logLazyTimeout(timeout))
 
-	// Sanity check on the arguments
-	if message == nil || len(message) == 0 {
-		return errors.New("nil or empty message")
-	}
 	// Create timeout signaler
 	var deadline <-chan time.Time
 	if timeout != 0 {
 		deadline = time.After(timeout)
 	}
+	return t.send(context.Background(), message, deadline)
+}
+
+// Sends a message over the tunnel to the remote pair, blocking until the local
+// Iris node receives the message or the context is cancelled.
+//
+// Cancelling the context only aborts the current message, the tunnel remains
+// usable for subsequent operations.
+func (t *Tunnel) SendContext(ctx context.Context, message []byte) error {
+	t.Log.Debug("sending message", "data", logLazyBlob(message), "timeout", "context")
+	return t.send(ctx, message, nil)
+}
+
+// Sends a message over the tunnel to the remote pair if it can be done without
+// blocking, failing with ErrWouldBlock otherwise. This allows producers to detect
+// a slowly reading remote pair (backpressure) and shed load instead of piling up
+// blocked sends.
+//
+// The message needs to fit into the current space allowance as a whole, so one
+// larger than the tunnel's window can only be sent via Send.
+func (t *Tunnel) TrySend(message []byte) error {
+	// Sanity check on the arguments
+	if message == nil || len(message) == 0 {
+		return errors.New("nil or empty message")
+	}
+	if len(message) > t.MaxMessageSize() {
+		return ErrMsgTooLarge
+	}
+	if atomic.LoadInt32(&t.atoiDone) != 0 {
+		return ErrSendClosed
+	}
+	select {
+	case <-t.term:
+		return ErrClosed
+	default:
+	}
+	t.beginSend()
+	defer t.endSend()
+
+	size := len(message)
+
+	// Compress the message if negotiated and reserve the allowance for all of it
+	message, err := t.compress(message)
+	if err != nil {
+		return err
+	}
+	if !t.drainAllowance(len(message)) {
+		atomic.AddUint64(&t.stats.sendBlock, 1)
+		return ErrWouldBlock
+	}
+	for pos := 0; pos < len(message); pos += t.chunkLimit {
+		end := pos + t.chunkLimit
+		if end > len(message) {
+			end = len(message)
+		}
+		sizeOrCont := len(message)
+		if pos != 0 {
+			sizeOrCont = 0
+		}
+		if err := t.conn.sendTunnelTransfer(t.id, sizeOrCont, message[pos:end]); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&t.stats.msgsSent, 1)
+	atomic.AddUint64(&t.stats.bytesSent, uint64(size))
+	return nil
+}
+
+// Sends a message over the tunnel, until it's done or aborted by either the
+// context or the deadline.
+func (t *Tunnel) send(ctx context.Context, message []byte, deadline <-chan time.Time) error {
+	// Sanity check on the arguments
+	if message == nil || len(message) == 0 {
+		return errors.New("nil or empty message")
+	}
+	if len(message) > t.MaxMessageSize() {
+		return ErrMsgTooLarge
+	}
+	if atomic.LoadInt32(&t.atoiDone) != 0 {
+		return ErrSendClosed
+	}
+	t.beginSend()
+	defer t.endSend()
+
+	size := len(message)
+
+	// Compress the message if negotiated
+	message, err := t.compress(message)
+	if err != nil {
+		return err
+	}
 	// Split the original message into bounded chunks
 	for pos := 0; pos < len(message); pos += t.chunkLimit {
 		end := pos + t.chunkLimit
@@ -174,15 +363,17 @@ func (t *Tunnel) Send(message []byte, timeout time.Duration) error {
 		if pos != 0 {
 			sizeOrCont = 0
 		}
-		if err := t.sendChunk(message[pos:end], sizeOrCont, deadline); err != nil {
+		if err := t.sendChunk(ctx, message[pos:end], sizeOrCont, deadline); err != nil {
 			return err
 		}
 	}
+	atomic.AddUint64(&t.stats.msgsSent, 1)
+	atomic.AddUint64(&t.stats.bytesSent, uint64(size))
 	return nil
 }
 
 // Sends a single message chunk to the remote endpoint.
-func (t *Tunnel) sendChunk(chunk []byte, sizeOrCont int, deadline <-chan time.Time) error {
+func (t *Tunnel) sendChunk(ctx context.Context, chunk []byte, sizeOrCont int, deadline <-chan time.Time) error {
 	for {
 		// Short circuit if there's enough space allowance already
 		if t.drainAllowance(len(chunk)) {
@@ -194,6 +385,8 @@ func (t *Tunnel) sendChunk(chunk []byte, sizeOrCont int, deadline <-chan time.Ti
 			return ErrClosed
 		case <-deadline:
 			return ErrTimeout
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-t.atoiSign:
 			// Potentially enough space allowance, retry
 			continue
@@ -201,6 +394,26 @@ func (t *Tunnel) sendChunk(chunk []byte, sizeOrCont int, deadline <-chan time.Ti
 	}
 }
 
+// Marks a send as in progress, to be waited for by a lingering close.
+func (t *Tunnel) beginSend() {
+	t.atoiLock.Lock()
+	defer t.atoiLock.Unlock()
+
+	t.atoiBusy++
+}
+
+// Marks a send as finished, signalling a lingering close if it was the last.
+func (t *Tunnel) endSend() {
+	t.atoiLock.Lock()
+	defer t.atoiLock.Unlock()
+
+	t.atoiBusy--
+	if t.atoiBusy == 0 && t.atoiIdle != nil {
+		close(t.atoiIdle)
+		t.atoiIdle = nil
+	}
+}
+
 // Checks whether there is enough space allowance available to send a message.
 // If yes, the allowance is reduced accordingly.
 func (t *Tunnel) drainAllowance(need int) bool {
@@ -219,34 +432,139 @@ func (t *Tunnel) drainAllowance(need int) bool {
 	return false
 }
 
+// Retrieves the currently available space allowance.
+func (t *Tunnel) allowance() int {
+	t.atoiLock.Lock()
+	defer t.atoiLock.Unlock()
+
+	return t.atoiSpace
+}
+
 // Retrieves a message from the tunnel, blocking until one is available or the
 // operation times out.
 //
+// Timing out never loses data: chunked messages are reassembled in the background
+// regardless of pending receives, and only ever delivered whole. A message still
+// arriving when a receive times out is returned by a subsequent one. (Messages are
+// only discarded if their sender's Send times out mid-way.)
+//
 // Infinite blocking is supported with by setting the timeout to zero (0).
 func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
-	// Short circuit if there's a message already buffered
-	if msg := t.fetchMessage(); msg != nil {
-		return msg, nil
+	// Create the timeout signaler
+	var after <-chan time.Time
+	if timeout != 0 {
+		after = time.After(timeout)
 	}
+	return t.recv(context.Background(), after)
+}
+
+// Retrieves a message from the tunnel, blocking until one is available or the
+// context is cancelled.
+//
+// Cancelling the context leaves the tunnel usable for subsequent operations.
+func (t *Tunnel) RecvContext(ctx context.Context) ([]byte, error) {
+	return t.recv(ctx, nil)
+}
+
+// Retrieves a message from the tunnel into a caller provided buffer, blocking
+// until one is available or the operation times out. The number of bytes copied
+// is returned. Bulk consumers can thus reuse a single buffer; if ReuseBuffers is
+// enabled on the connection, the internal message buffers are recycled too.
+//
+// If the message doesn't fit into the buffer, an error wrapping io.ErrShortBuffer
+// is returned and the message is retained for the next receive.
+//
+// Infinite blocking is supported with by setting the timeout to zero (0).
+func (t *Tunnel) RecvInto(buf []byte, timeout time.Duration) (int, error) {
 	// Create the timeout signaler
 	var after <-chan time.Time
 	if timeout != 0 {
 		after = time.After(timeout)
 	}
+	msg, err := t.recv(context.Background(), after)
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(buf) {
+		t.itoaLock.Lock()
+		t.itoaHeld = msg
+		t.itoaLock.Unlock()
+		return 0, fmt.Errorf("%w: message of %d bytes, buffer of %d", io.ErrShortBuffer, len(msg), len(buf))
+	}
+	n := copy(buf, msg)
+	if t.comp == NoCompression {
+		t.conn.releaseBuffer(msg)
+	}
+	return n, nil
+}
+
+// Retrieves a message from the tunnel, until one arrives or the wait is aborted
+// by either the context or the deadline.
+func (t *Tunnel) recv(ctx context.Context, deadline <-chan time.Time) ([]byte, error) {
+	// Short circuit if a message was retained by RecvInto
+	if msg := t.fetchHeld(); msg != nil {
+		return msg, nil
+	}
+	// Short circuit if there's a message already buffered, or none will arrive
+	if msg := t.fetchMessage(); msg != nil {
+		return t.deliver(msg)
+	}
+	if t.drained() {
+		return nil, io.EOF
+	}
 	// Wait for a message to arrive
 	select {
 	case <-t.term:
 		return nil, ErrClosed
-	case <-after:
+	case <-deadline:
 		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-t.itoaSign:
 		if msg := t.fetchMessage(); msg != nil {
-			return msg, nil
+			return t.deliver(msg)
+		}
+		if t.drained() {
+			return nil, io.EOF
 		}
 		panic("signal raised but message unavailable")
 	}
 }
 
+// Decompresses a fetched message and accounts it in the traffic counters.
+func (t *Tunnel) deliver(message []byte) ([]byte, error) {
+	message, err := t.decompress(message)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&t.stats.msgsRecv, 1)
+	atomic.AddUint64(&t.stats.bytesRecv, uint64(len(message)))
+	return message, nil
+}
+
+// Retrieves a snapshot of the tunnel's traffic counters.
+func (t *Tunnel) Stats() *TunnelStats {
+	return &TunnelStats{
+		BytesSent:        atomic.LoadUint64(&t.stats.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&t.stats.bytesRecv),
+		MessagesSent:     atomic.LoadUint64(&t.stats.msgsSent),
+		MessagesReceived: atomic.LoadUint64(&t.stats.msgsRecv),
+		SendsBlocked:     atomic.LoadUint64(&t.stats.sendBlock),
+		SendAllowance:    t.allowance(),
+		Age:              time.Since(t.start),
+	}
+}
+
+// Fetches the message retained by a failed RecvInto, or nil if there is none.
+func (t *Tunnel) fetchHeld() []byte {
+	t.itoaLock.Lock()
+	defer t.itoaLock.Unlock()
+
+	msg := t.itoaHeld
+	t.itoaHeld = nil
+	return msg
+}
+
 // Fetches the next buffered message, or nil if none is available. If a message
 // was available, grants the remote side the space allowance just consumed.
 func (t *Tunnel) fetchMessage() []byte {
@@ -268,8 +586,33 @@ func (t *Tunnel) fetchMessage() []byte {
 	return nil
 }
 
+// Checks whether the remote side half-closed its sends and all its messages were
+// already consumed.
+func (t *Tunnel) drained() bool {
+	t.itoaLock.Lock()
+	defer t.itoaLock.Unlock()
+
+	return t.itoaDone && t.itoaBuf.Empty()
+}
+
+// Half-closes the tunnel, signalling the remote pair that no more messages will
+// be sent. Its Recv returns io.EOF after consuming the already sent messages,
+// whereas the opposite direction remains usable until Close.
+//
+// The method must not be called concurrently with Send.
+func (t *Tunnel) CloseSend() error {
+	if !atomic.CompareAndSwapInt32(&t.atoiDone, 0, 1) {
+		return nil
+	}
+	t.Log.Info("half-closing tunnel")
+
+	// An empty transfer can't be produced by Send, so it marks the end of stream
+	return t.conn.sendTunnelTransfer(t.id, 0, nil)
+}
+
 // Closes the tunnel between the pair. Any blocked read and write operation will
-// terminate with a failure.
+// terminate with a failure, so messages still being sent are lost (CloseLinger
+// flushes them first).
 //
 // The method blocks until the local relay node acknowledges the tear-down.
 func (t *Tunnel) Close() error {
@@ -288,6 +631,46 @@ func (t *Tunnel) Close() error {
 	return t.stat
 }
 
+// Closes the tunnel between the pair after waiting for the sends already in
+// progress to be flushed to the local relay. If the flush doesn't complete within
+// the timeout, the tunnel is torn down anyway and ErrTimeout is returned.
+//
+// As opposed to Close, which aborts any blocked send immediately, this should be
+// used when the final messages sent concurrently must not be lost. Sends started
+// after the call are not waited for.
+func (t *Tunnel) CloseLinger(timeout time.Duration) error {
+	t.Log.Info("lingering tunnel close", "timeout", timeout)
+
+	// Register for the completion of the in-progress sends, if any
+	t.atoiLock.Lock()
+	var idle chan struct{}
+	if t.atoiBusy > 0 {
+		if t.atoiIdle == nil {
+			t.atoiIdle = make(chan struct{})
+		}
+		idle = t.atoiIdle
+	}
+	t.atoiLock.Unlock()
+
+	// Wait for the flush to complete, tearing down if it doesn't
+	if idle != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-idle:
+		case <-t.term:
+		case <-timer.C:
+			t.Log.Warn("tunnel flush timed out", "timeout", timeout)
+			if err := t.Close(); err != nil {
+				return err
+			}
+			return ErrTimeout
+		}
+	}
+	return t.Close()
+}
+
 // Finalizes the tunnel construction.
 func (t *Tunnel) handleInitResult(chunkLimit int) {
 	if chunkLimit > 0 {
@@ -311,6 +694,19 @@ func (t *Tunnel) handleAllowance(space int) {
 // Adds the chunk to the currently building message and delivers it upon
 // completion. If a new message starts, the old is discarded.
 func (t *Tunnel) handleTransfer(size int, chunk []byte) {
+	// If the remote side half-closed, mark the end of stream
+	if size == 0 && len(chunk) == 0 {
+		t.itoaLock.Lock()
+		defer t.itoaLock.Unlock()
+
+		t.Log.Info("tunnel half-closed remotely")
+		t.itoaDone = true
+		select {
+		case t.itoaSign <- struct{}{}:
+		default:
+		}
+		return
+	}
 	// If a new message is arriving, dump anything stored before
 	if size != 0 {
 		if t.chunkBuf != nil {
@@ -319,7 +715,7 @@ func (t *Tunnel) handleTransfer(size int, chunk []byte) {
 			// A large transfer timed out, new started, grant the partials allowance
 			go t.conn.sendTunnelAllowance(t.id, len(t.chunkBuf))
 		}
-		t.chunkBuf = make([]byte, 0, size)
+		t.chunkBuf = t.conn.allocBuffer(size)
 	}
 	// Append the new chunk and check completion
 	t.chunkBuf = append(t.chunkBuf, chunk...)
@@ -8,7 +8,10 @@ package iris
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"testing"
 	"time"
@@ -175,40 +178,938 @@ func TestTunnelTimeout(t *testing.T) {
 	}
 }
 
+// Tests that cancelling the context abandons the tunnel construction.
+func TestTunnelContextOpen(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Open a new tunnel to a non existent server, cancelling midway
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if tun, err := conn.TunnelContext(ctx, config.cluster, 250*time.Millisecond); !errors.Is(err, context.Canceled) {
+		t.Fatalf("mismatching tunneling result: have %v/%v, want %v/%v", tun, err, nil, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("cancellation took too long: %v", elapsed)
+	}
+	// Verify that the abandoned tunnel is cleaned up after the relay timeout
+	time.Sleep(500 * time.Millisecond)
+
+	conn.tunLock.RLock()
+	live := len(conn.tunLive)
+	conn.tunLock.RUnlock()
+	if live != 0 {
+		t.Fatalf("live tunnel count mismatch: have %v, want %v", live, 0)
+	}
+}
+
 // Tests that large messages get delivered properly.
 func TestTunnelChunking(t *testing.T) {
 	// Create the service handler
 	handler := new(tunnelTestHandler)
 
-	// Register a new service to the relay
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Create and transfer a huge message
+	blob := make([]byte, 16*1024*1024)
+	for i := 0; i < len(blob); i++ {
+		blob[i] = byte(i)
+	}
+	if err := tunnel.Send(blob, 10*time.Second); err != nil {
+		t.Fatalf("failed to send blob: %v.", err)
+	}
+	back, err := tunnel.Recv(10 * time.Second)
+	if err != nil {
+		t.Fatalf("failed to retrieve blob: %v.", err)
+	}
+	// Verify that they indeed match
+	if bytes.Compare(back, blob) != 0 {
+		t.Fatalf("data blob mismatch")
+	}
+}
+
+// Tests that receives timing out mid-reassembly don't lose or corrupt data.
+func TestTunnelRecvTimeoutPartial(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Transfer a huge message, and chase it with short receives timing out
+	blob := make([]byte, 16*1024*1024)
+	for i := 0; i < len(blob); i++ {
+		blob[i] = byte(i)
+	}
+	go tunnel.Send(blob, 10*time.Second)
+
+	timeouts := 0
+	for {
+		back, err := tunnel.Recv(time.Millisecond)
+		if err == ErrTimeout {
+			if timeouts++; timeouts > 10000 {
+				t.Fatalf("blob not delivered.")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to retrieve blob: %v.", err)
+		}
+		if !bytes.Equal(back, blob) {
+			t.Fatalf("data blob mismatch")
+		}
+		break
+	}
+	if timeouts == 0 {
+		t.Fatalf("receive never timed out mid-message.")
+	}
+	// Verify that a follow-up message arrives intact too
+	if err := tunnel.Send([]byte{0x01}, time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	if msg, err := tunnel.Recv(time.Second); err != nil || !bytes.Equal(msg, []byte{0x01}) {
+		t.Fatalf("follow-up message mismatch: have %v/%v, want %v/nil.", msg, err, []byte{0x01})
+	}
+}
+
+// Tests that context cancellations abort tunnel operations, but leave the tunnel
+// itself operational.
+func TestTunnelContext(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Check that an expiring context aborts a pending receive
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Millisecond)
+	defer cancel()
+	if msg, err := tunnel.RecvContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expired receive result mismatch: have %v/%v, want %v/%v.", msg, err, nil, context.DeadlineExceeded)
+	}
+	// Verify that the tunnel is still operational
+	data := []byte{0x00, 0x01, 0x02, 0x03}
+	if err := tunnel.SendContext(context.Background(), data); err != nil {
+		t.Fatalf("failed to send data: %v.", err)
+	}
+	back, err := tunnel.RecvContext(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve data: %v.", err)
+	}
+	if bytes.Compare(back, data) != 0 {
+		t.Fatalf("data mismatch: have %v, want %v.", back, data)
+	}
+}
+
+// Tests that the stream adapter transfers data properly.
+func TestTunnelStream(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel and wrap it into a stream
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	stream := tunnel.Stream()
+	defer stream.Close()
+
+	// Write a blob larger than a chunk and read it back in small pieces
+	blob := make([]byte, 4*tunnel.chunkLimit+1)
+	for i := 0; i < len(blob); i++ {
+		blob[i] = byte(i)
+	}
+	go func() {
+		if _, err := stream.Write(blob); err != nil {
+			panic(fmt.Sprintf("stream write failed: %v", err))
+		}
+	}()
+	back := make([]byte, len(blob))
+	for pos := 0; pos < len(back); {
+		end := pos + 1000
+		if end > len(back) {
+			end = len(back)
+		}
+		n, err := stream.Read(back[pos:end])
+		if err != nil {
+			t.Fatalf("stream read failed: %v.", err)
+		}
+		pos += n
+	}
+	// Verify that they indeed match
+	if bytes.Compare(back, blob) != 0 {
+		t.Fatalf("data blob mismatch")
+	}
+}
+
+// Tests that the tunnel traffic counters track the exchanged messages.
+func TestTunnelStats(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel and exchange a few messages
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	for i := 1; i <= 10; i++ {
+		if err := tunnel.Send(make([]byte, i), time.Second); err != nil {
+			t.Fatalf("tunnel send failed: %v.", err)
+		}
+		if _, err := tunnel.Recv(time.Second); err != nil {
+			t.Fatalf("tunnel receive failed: %v.", err)
+		}
+	}
+	// Verify the reported counters
+	stats := tunnel.Stats()
+	if stats.MessagesSent != 10 || stats.MessagesReceived != 10 {
+		t.Fatalf("message count mismatch: have %d/%d, want %d/%d.", stats.MessagesSent, stats.MessagesReceived, 10, 10)
+	}
+	if stats.BytesSent != 55 || stats.BytesReceived != 55 {
+		t.Fatalf("byte count mismatch: have %d/%d, want %d/%d.", stats.BytesSent, stats.BytesReceived, 55, 55)
+	}
+	if stats.Age <= 0 {
+		t.Fatalf("invalid tunnel age: %v.", stats.Age)
+	}
+}
+
+// Tests that non-blocking sends report backpressure instead of waiting.
+func TestTunnelTrySend(t *testing.T) {
+	// Register a new service to the relay, accepting small windowed tunnels and
+	// never reading from them
+	handler := &tunnelAcceptTestHandler{tunnels: make(chan *Tunnel, 1)}
+	serv, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{Tunnels: &TunnelOpts{Window: 1024}})
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Close()
+
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Construct the tunnel
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	remote := <-handler.tunnels
+	defer remote.Close()
+
+	// Verify that messages within the allowance pass and ones exceeding the rest
+	// of it are rejected
+	if err := tunnel.TrySend(make([]byte, 1000)); err != nil {
+		t.Fatalf("non-blocking send failed: %v.", err)
+	}
+	if err := tunnel.TrySend(make([]byte, 100)); err != ErrWouldBlock {
+		t.Fatalf("non-blocking send error mismatch: have %v, want %v.", err, ErrWouldBlock)
+	}
+	if stats := tunnel.Stats(); stats.SendsBlocked != 1 || stats.MessagesSent != 1 {
+		t.Fatalf("send stats mismatch: have %d/%d blocked/sent, want %d/%d.", stats.SendsBlocked, stats.MessagesSent, 1, 1)
+	}
+}
+
+// Service handler for the tunnel half-close tests, replying with the received
+// messages only after the remote side finished sending.
+type tunnelHalfCloseTestHandler struct {
+	conn *Connection
+}
+
+func (t *tunnelHalfCloseTestHandler) Init(conn *Connection) error { t.conn = conn; return nil }
+func (t *tunnelHalfCloseTestHandler) HandleBroadcast(msg []byte)  { panic("not implemented") }
+func (t *tunnelHalfCloseTestHandler) HandleRequest(req []byte) ([]byte, error) {
+	panic("not implemented")
+}
+func (t *tunnelHalfCloseTestHandler) HandleDrop(reason error) { panic("not implemented") }
+
+func (t *tunnelHalfCloseTestHandler) HandleTunnel(tun *Tunnel) {
+	defer tun.Close()
+
+	var msgs [][]byte
+	for {
+		msg, err := tun.Recv(time.Second)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(fmt.Sprintf("tunnel receive failed: %v", err))
+		}
+		msgs = append(msgs, msg)
+	}
+	for _, msg := range msgs {
+		if err := tun.Send(msg, time.Second); err != nil {
+			panic(fmt.Sprintf("tunnel send failed: %v", err))
+		}
+	}
+}
+
+// Tests that half-closing a tunnel ends the remote stream but keeps receiving.
+func TestTunnelHalfClose(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelHalfCloseTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel, send a few messages and half-close it
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := tunnel.Send([]byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("tunnel send failed: %v.", err)
+		}
+	}
+	if err := tunnel.CloseSend(); err != nil {
+		t.Fatalf("tunnel half-close failed: %v.", err)
+	}
+	if err := tunnel.Send([]byte{0x00}, time.Second); err != ErrSendClosed {
+		t.Fatalf("send after half-close error mismatch: have %v, want %v.", err, ErrSendClosed)
+	}
+	// Verify that the replies still arrive
+	for i := 0; i < 10; i++ {
+		msg, err := tunnel.Recv(time.Second)
+		if err != nil {
+			t.Fatalf("tunnel receive failed: %v.", err)
+		}
+		if !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Fatalf("message mismatch: have %v, want %v.", msg, []byte{byte(i)})
+		}
+	}
+}
+
+// Tests that lingering closes flush the in-progress sends, or time out.
+func TestTunnelCloseLinger(t *testing.T) {
+	// Register a new service to the relay, accepting small windowed tunnels
+	handler := new(tunnelTestHandler)
+	serv, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{Tunnels: &TunnelOpts{Window: 1024}})
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Close()
+
+	// Verify that a tunnel with completed sends closes cleanly
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	if err := tunnel.Send([]byte{0x00}, time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	if err := tunnel.CloseLinger(time.Second); err != nil {
+		t.Fatalf("lingering close failed: %v.", err)
+	}
+	// Verify that a send stuck on the allowance times out the flush
+	tunnel, err = handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tunnel.Send(make([]byte, 2048), 0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := tunnel.CloseLinger(50 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("lingering close error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if err := <-errc; err != ErrClosed {
+		t.Fatalf("pending send error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+}
+
+// Service handler for the tunnel shutdown tests, handing out accepted tunnels.
+type tunnelAcceptTestHandler struct {
+	tunnels chan *Tunnel
+}
+
+func (t *tunnelAcceptTestHandler) Init(conn *Connection) error              { return nil }
+func (t *tunnelAcceptTestHandler) HandleBroadcast(msg []byte)               { panic("not implemented") }
+func (t *tunnelAcceptTestHandler) HandleRequest(req []byte) ([]byte, error) { panic("not implemented") }
+func (t *tunnelAcceptTestHandler) HandleTunnel(tun *Tunnel)                 { t.tunnels <- tun }
+func (t *tunnelAcceptTestHandler) HandleDrop(reason error)                  { panic("not implemented") }
+
+// Tests that closing a connection gracefully closes its live tunnels.
+func TestTunnelCloseOnShutdown(t *testing.T) {
+	// Register a new service to the relay
+	handler := &tunnelAcceptTestHandler{tunnels: make(chan *Tunnel, 1)}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Open a tunnel from a client connection and retrieve the remote end
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	if _, err := conn.Tunnel(config.cluster, time.Second); err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	// The initiator stays silent, so the tunnel is only handed over after the peek
+	var remote *Tunnel
+	select {
+	case remote = <-handler.tunnels:
+	case <-time.After(tunnelPeekTimeout + time.Second):
+		t.Fatalf("tunnel not accepted.")
+	}
+	// Close the client connection and verify the remote end closed gracefully
+	if err := conn.Close(); err != nil {
+		t.Fatalf("connection close failed: %v.", err)
+	}
+	if _, err := remote.Recv(time.Second); err != ErrClosed {
+		t.Fatalf("remote receive error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+	if err := remote.Close(); err != nil {
+		t.Fatalf("remote tunnel closed with failure: %v.", err)
+	}
+}
+
+// Tests that messages can be received into caller provided buffers.
+func TestTunnelRecvInto(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel and send a message through
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	data := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+	if err := tunnel.Send(data, time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	// Verify that a short buffer is rejected, retaining the message
+	if _, err := tunnel.RecvInto(make([]byte, 4), time.Second); !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatalf("short buffer error mismatch: have %v, want %v.", err, io.ErrShortBuffer)
+	}
+	buf := make([]byte, 16)
+	n, err := tunnel.RecvInto(buf, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel receive failed: %v.", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatalf("message mismatch: have %v, want %v.", buf[:n], data)
+	}
+}
+
+// Tests the push based tunnel receiver and its shutdown.
+func TestTunnelIncoming(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	// Send a few messages and verify they are pushed back in order
+	for i := 0; i < 10; i++ {
+		if err := tunnel.Send([]byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("tunnel send failed: %v.", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case msg := <-tunnel.Incoming():
+			if !bytes.Equal(msg, []byte{byte(i)}) {
+				t.Fatalf("message mismatch: have %v, want %v.", msg, []byte{byte(i)})
+			}
+		case err := <-tunnel.Errors():
+			t.Fatalf("tunnel receive failed: %v.", err)
+		case <-time.After(time.Second):
+			t.Fatalf("message #%d not delivered.", i)
+		}
+	}
+	// Close the tunnel and verify the channels are closed too
+	if err := tunnel.Close(); err != nil {
+		t.Fatalf("tunnel close failed: %v.", err)
+	}
+	select {
+	case msg, ok := <-tunnel.Incoming():
+		if ok {
+			t.Fatalf("message delivered after close: %v.", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("incoming channel not closed.")
+	}
+	select {
+	case _, ok := <-tunnel.Errors():
+		if ok {
+			t.Fatalf("error reported after graceful close.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("error channel not closed.")
+	}
+}
+
+// Tests that large streams get delivered via the bulk transfer helpers.
+func TestTunnelBulk(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Stream a blob through the echo tunnel
+	blob := make([]byte, 4*1024*1024+123)
+	for i := 0; i < len(blob); i++ {
+		blob[i] = byte(i)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tunnel.SendReader(bytes.NewReader(blob), 100*1024, 10*time.Second)
+	}()
+	back := new(bytes.Buffer)
+	if err := tunnel.RecvWriter(back, 10*time.Second); err != nil {
+		t.Fatalf("bulk receive failed: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("bulk send failed: %v.", err)
+	}
+	if !bytes.Equal(back.Bytes(), blob) {
+		t.Fatalf("data blob mismatch")
+	}
+}
+
+// Tests that compressed tunnels exchange messages and reject mismatched peers.
+func TestTunnelCompression(t *testing.T) {
+	// Register a new service to the relay, accepting gzip tunnels
+	handler := new(tunnelTestHandler)
+	opts := &ConnectOpts{Tunnels: &TunnelOpts{Compression: Gzip}}
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Construct a compressed tunnel and verify the echoed messages
+	tunnel, err := conn.TunnelWith(config.cluster, time.Second, &TunnelOpts{Compression: Gzip})
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	blob := bytes.Repeat([]byte("compressible payload "), 1024)
+	for i := 0; i < 10; i++ {
+		if err := tunnel.Send(blob, time.Second); err != nil {
+			t.Fatalf("tunnel send failed: %v.", err)
+		}
+		msg, err := tunnel.Recv(time.Second)
+		if err != nil {
+			t.Fatalf("tunnel receive failed: %v.", err)
+		}
+		if !bytes.Equal(msg, blob) {
+			t.Fatalf("message mismatch: have %d bytes, want %d bytes.", len(msg), len(blob))
+		}
+	}
+	// Verify that a compressed tunnel to a plain service fails
+	plain := new(tunnelTestHandler)
+	serv, err := Register(config.relay, config.cluster+"-plain", plain, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	if _, err := conn.TunnelWith(config.cluster+"-plain", time.Second, &TunnelOpts{Compression: Gzip}); !errors.Is(err, ErrCompressionMismatch) {
+		t.Fatalf("mismatched tunnel error mismatch: have %v, want %v.", err, ErrCompressionMismatch)
+	}
+	// Verify that a plain tunnel to the compressing service is torn down promptly
+	tunnel, err = serv.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("plain tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	if err := tunnel.Send([]byte{0x00}, time.Second); err != nil {
+		t.Fatalf("plain tunnel send failed: %v.", err)
+	}
+	if _, err := tunnel.Recv(time.Second); err != ErrClosed {
+		t.Fatalf("plain tunnel receive error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+}
+
+// Tests that tunnels agree on the smaller message size limit and enforce it.
+func TestTunnelMaxMessageSize(t *testing.T) {
+	// Register a new service to the relay, accepting tunnels with a small limit
+	handler := new(tunnelTestHandler)
+	opts := &ConnectOpts{Tunnels: &TunnelOpts{MaxMessageSize: 1024}}
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Construct a tunnel offering a larger limit and verify the agreed one
+	tunnel, err := conn.TunnelWith(config.cluster, time.Second, &TunnelOpts{MaxMessageSize: 4096})
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	if size := tunnel.MaxMessageSize(); size != 1024 {
+		t.Fatalf("message size limit mismatch: have %d, want %d.", size, 1024)
+	}
+	// Verify that messages within the limit pass and larger ones are rejected
+	if err := tunnel.Send(make([]byte, 1024), time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	if msg, err := tunnel.Recv(time.Second); err != nil || len(msg) != 1024 {
+		t.Fatalf("tunnel receive mismatch: have %d bytes/%v, want %d bytes/nil.", len(msg), err, 1024)
+	}
+	if err := tunnel.Send(make([]byte, 1025), time.Second); err != ErrMsgTooLarge {
+		t.Fatalf("oversized send error mismatch: have %v, want %v.", err, ErrMsgTooLarge)
+	}
+	// Verify that a per-call limit is agreed on with an acceptor setting none
+	plain := new(tunnelTestHandler)
+	serv, err := Register(config.relay, config.cluster+"-plain", plain, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	limited, err := conn.TunnelWith(config.cluster+"-plain", time.Second, &TunnelOpts{MaxMessageSize: 4096})
+	if err != nil {
+		t.Fatalf("per-call limited tunnel construction failed: %v.", err)
+	}
+	defer limited.Close()
+
+	if size := limited.MaxMessageSize(); size != 4096 {
+		t.Fatalf("per-call limit mismatch: have %d, want %d.", size, 4096)
+	}
+	if err := limited.Send(make([]byte, 4096), time.Second); err != nil {
+		t.Fatalf("per-call limited send failed: %v.", err)
+	}
+	if msg, err := limited.Recv(time.Second); err != nil || len(msg) != 4096 {
+		t.Fatalf("per-call limited receive mismatch: have %d bytes/%v, want %d bytes/nil.", len(msg), err, 4096)
+	}
+}
+
+// Tests that logical messages larger than the tunnel limit are fragmented and
+// reassembled with their boundaries intact.
+func TestTunnelFragmentation(t *testing.T) {
+	// Register a new service to the relay, accepting tunnels with a small limit
+	handler := new(tunnelTestHandler)
+	opts := &ConnectOpts{Tunnels: &TunnelOpts{MaxMessageSize: 1024}}
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	tunnel, err := conn.TunnelWith(config.cluster, time.Second, &TunnelOpts{MaxMessageSize: 1024})
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Send a few logical messages, the first spanning many fragments
+	messages := [][]byte{make([]byte, 10*1024+7), {0x01}, make([]byte, 1024-fragmentHeader)}
+	for i := 0; i < len(messages[0]); i++ {
+		messages[0][i] = byte(i)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for _, message := range messages {
+			if err := tunnel.SendMessage(message, time.Second); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	// Verify that each is received whole, one per call
+	for i, want := range messages {
+		have, err := tunnel.RecvMessage(time.Second)
+		if err != nil {
+			t.Fatalf("message #%d: receive failed: %v.", i, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("message #%d: mismatch: have %d bytes, want %d bytes.", i, len(have), len(want))
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("fragmented send failed: %v.", err)
+	}
+	// Verify that stray plain messages are rejected
+	if err := tunnel.Send([]byte("plain message"), time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	if _, err := tunnel.RecvMessage(time.Second); err == nil {
+		t.Fatalf("plain message accepted as a fragment.")
+	}
+}
+
+// Tests that the live tunnels are counted and capped at the configured limit.
+func TestTunnelLimit(t *testing.T) {
+	// Register a new service to the relay and connect a capped client
+	handler := new(tunnelTestHandler)
 	serv, err := Register(config.relay, config.cluster, handler, nil)
 	if err != nil {
 		t.Fatalf("registration failed: %v.", err)
 	}
 	defer serv.Unregister()
 
-	// Construct the tunnel
-	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	conn, err := ConnectWith(config.relay, "", nil, &ConnectOpts{MaxTunnels: 2})
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Open tunnels up to the limit and verify that further ones are rejected
+	tunnels := make([]*Tunnel, 2)
+	for i := range tunnels {
+		if tunnels[i], err = conn.Tunnel(config.cluster, time.Second); err != nil {
+			t.Fatalf("tunnel #%d construction failed: %v.", i, err)
+		}
+		defer tunnels[i].Close()
+	}
+	if n := conn.OpenTunnels(); n != 2 {
+		t.Fatalf("open tunnel count mismatch: have %d, want %d.", n, 2)
+	}
+	if _, err := conn.Tunnel(config.cluster, time.Second); err != ErrTooManyTunnels {
+		t.Fatalf("tunnel error mismatch: have %v, want %v.", err, ErrTooManyTunnels)
+	}
+	// Close one and verify that its slot is freed
+	if err := tunnels[0].Close(); err != nil {
+		t.Fatalf("tunnel close failed: %v.", err)
+	}
+	if n := conn.OpenTunnels(); n != 1 {
+		t.Fatalf("open tunnel count mismatch: have %d, want %d.", n, 1)
+	}
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction within limit failed: %v.", err)
+	}
+	tunnel.Close()
+}
+
+// Tests that tunnel endpoints can identify each other's clusters.
+func TestTunnelIdentify(t *testing.T) {
+	// Register a new service to the relay, accepting identified tunnels
+	handler := &tunnelAcceptTestHandler{tunnels: make(chan *Tunnel, 1)}
+	opts := &ConnectOpts{Tunnels: &TunnelOpts{Identify: true}}
+	serv, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Close()
+
+	// Connect as a separate service and open an identified tunnel
+	client, err := ConnectWith(config.relay, config.cluster+"-client", new(tunnelTestHandler), nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer client.Close()
+
+	tunnel, err := client.TunnelWith(config.cluster, time.Second, &TunnelOpts{Identify: true})
 	if err != nil {
 		t.Fatalf("tunnel construction failed: %v.", err)
 	}
 	defer tunnel.Close()
 
-	// Create and transfer a huge message
-	blob := make([]byte, 16*1024*1024)
-	for i := 0; i < len(blob); i++ {
-		blob[i] = byte(i)
+	// Verify that both endpoints see the other's cluster
+	if peer := tunnel.RemoteCluster(); peer != config.cluster {
+		t.Fatalf("initiator peer mismatch: have %q, want %q.", peer, config.cluster)
 	}
-	if err := tunnel.Send(blob, 10*time.Second); err != nil {
-		t.Fatalf("failed to send blob: %v.", err)
+	select {
+	case accepted := <-handler.tunnels:
+		if peer := accepted.RemoteCluster(); peer != config.cluster+"-client" {
+			t.Fatalf("acceptor peer mismatch: have %q, want %q.", peer, config.cluster+"-client")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("tunnel not accepted.")
 	}
-	back, err := tunnel.Recv(10 * time.Second)
+	// Verify that an acceptor without identification enabled answers too
+	ident, err := serv.TunnelWith(config.cluster+"-client", time.Second, &TunnelOpts{Identify: true})
 	if err != nil {
-		t.Fatalf("failed to retrieve blob: %v.", err)
+		t.Fatalf("identified tunnel to plain acceptor failed: %v.", err)
 	}
-	// Verify that they indeed match
-	if bytes.Compare(back, blob) != 0 {
-		t.Fatalf("data blob mismatch")
+	defer ident.Close()
+
+	if peer := ident.RemoteCluster(); peer != config.cluster+"-client" {
+		t.Fatalf("plain acceptor peer mismatch: have %q, want %q.", peer, config.cluster+"-client")
+	}
+	// Verify that plain initiators are accepted by an identifying acceptor
+	plain, err := client.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("plain tunnel construction failed: %v.", err)
+	}
+	defer plain.Close()
+
+	if err := plain.Send([]byte{0x00}, time.Second); err != nil {
+		t.Fatalf("plain tunnel send failed: %v.", err)
+	}
+	select {
+	case accepted := <-handler.tunnels:
+		if peer := accepted.RemoteCluster(); peer != "" {
+			t.Fatalf("plain initiator peer mismatch: have %q, want %q.", peer, "")
+		}
+		if msg, err := accepted.Recv(time.Second); err != nil || !bytes.Equal(msg, []byte{0x00}) {
+			t.Fatalf("plain tunnel message mismatch: have %v/%v, want %v/nil.", msg, err, []byte{0x00})
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("plain tunnel not accepted.")
+	}
+}
+
+// Tests that pooled tunnels are reused, and unclean or stale ones recycled.
+func TestTunnelPool(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	pool := handler.conn.TunnelPool(config.cluster, &TunnelPoolOpts{MaxIdle: 1, MaxLifetime: 500 * time.Millisecond})
+	defer pool.Close()
+
+	// Open a tunnel through the pool and return it after an exchange
+	first, err := pool.Get(time.Second)
+	if err != nil {
+		t.Fatalf("pooled tunnel construction failed: %v.", err)
+	}
+	if err := first.Send([]byte{0x01}, time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	if _, err := first.Recv(time.Second); err != nil {
+		t.Fatalf("tunnel receive failed: %v.", err)
+	}
+	pool.Put(first)
+	if idle := pool.Idle(); idle != 1 {
+		t.Fatalf("idle tunnel count mismatch: have %v, want %v.", idle, 1)
+	}
+	// Verify that the tunnel is reused, and that a dirty one is discarded
+	second, err := pool.Get(time.Second)
+	if err != nil {
+		t.Fatalf("pooled tunnel retrieval failed: %v.", err)
+	}
+	if second != first {
+		t.Fatalf("idle tunnel not reused.")
+	}
+	if err := second.Send([]byte{0x02}, time.Second); err != nil {
+		t.Fatalf("tunnel send failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	pool.Put(second)
+	if idle := pool.Idle(); idle != 0 {
+		t.Fatalf("tunnel with pending data retained: %v idle.", idle)
+	}
+	// Verify that tunnels exceeding their lifetime are evicted
+	third, err := pool.Get(time.Second)
+	if err != nil {
+		t.Fatalf("pooled tunnel construction failed: %v.", err)
+	}
+	if third == first {
+		t.Fatalf("discarded tunnel reused.")
+	}
+	pool.Put(third)
+	time.Sleep(time.Second)
+	if idle := pool.Idle(); idle != 0 {
+		t.Fatalf("expired tunnel retained: %v idle.", idle)
+	}
+	// Verify that a closed pool rejects further requests
+	pool.Close()
+	if _, err := pool.Get(time.Second); err != ErrClosed {
+		t.Fatalf("closed pool get mismatch: have %v, want %v.", err, ErrClosed)
 	}
 }
 
@@ -312,17 +1213,244 @@ func BenchmarkTunnelThroughput(b *testing.B) {
 
 	// Reset the timer and measure the throughput
 	b.ResetTimer()
+	errc := make(chan error, 1)
 	go func() {
 		for i := 0; i < b.N/2; i++ {
 			if err := tunnel.Send([]byte{byte(i)}, time.Second); err != nil {
-				b.Fatalf("tunnel send failed: %v.", err)
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < b.N/2; i++ {
+		if _, err := tunnel.Recv(time.Second); err != nil {
+			b.Fatalf("tunnel receive failed: %v.", err)
+		}
+	}
+	if err := <-errc; err != nil {
+		b.Fatalf("tunnel send failed: %v.", err)
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
+
+// Benchmarks the allocations of receiving tunnel messages into new slices versus
+// a reused buffer (with the internal buffers recycled).
+func BenchmarkTunnelRecv(b *testing.B) {
+	benchmarkTunnelRecv(false, b)
+}
+
+func BenchmarkTunnelRecvInto(b *testing.B) {
+	benchmarkTunnelRecv(true, b)
+}
+
+func benchmarkTunnelRecv(into bool, b *testing.B) {
+	// Register a new service to the relay, recycling the message buffers
+	handler := new(tunnelTestHandler)
+	conn, err := ConnectWith(config.relay, config.cluster, handler, &ConnectOpts{ReuseBuffers: true})
+	if err != nil {
+		b.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Construct the tunnel
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		b.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Reset the timer and measure the receive allocations
+	msg, buf := make([]byte, 4096), make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := tunnel.Send(msg, time.Second); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < b.N; i++ {
+		if into {
+			_, err = tunnel.RecvInto(buf, time.Second)
+		} else {
+			_, err = tunnel.Recv(time.Second)
+		}
+		if err != nil {
+			b.Fatalf("tunnel receive failed: %v.", err)
+		}
+	}
+	if err := <-errc; err != nil {
+		b.Fatalf("tunnel send failed: %v.", err)
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
+
+// Measures the throughput of bulk tunnel data transfers with various flow-control
+// windows (actually two ways, so halves it).
+func BenchmarkTunnelWindow256KB(b *testing.B) {
+	benchmarkTunnelWindow(256*1024, b)
+}
+
+func BenchmarkTunnelWindow4MB(b *testing.B) {
+	benchmarkTunnelWindow(4*1024*1024, b)
+}
+
+func BenchmarkTunnelWindow64MB(b *testing.B) {
+	benchmarkTunnelWindow(64*1024*1024, b)
+}
+
+func benchmarkTunnelWindow(window int, b *testing.B) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		b.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel
+	tunnel, err := handler.conn.TunnelWith(config.cluster, time.Second, &TunnelOpts{Window: window})
+	if err != nil {
+		b.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Reset the timer and measure the throughput
+	blob := make([]byte, 64*1024)
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N/2; i++ {
+			if err := tunnel.Send(blob, 10*time.Second); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < b.N/2; i++ {
+		if _, err := tunnel.Recv(10 * time.Second); err != nil {
+			b.Fatalf("tunnel receive failed: %v.", err)
+		}
+	}
+	if err := <-errc; err != nil {
+		b.Fatalf("tunnel send failed: %v.", err)
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
+
+// Benchmarks the throughput of a plain tunnel on a compressible payload.
+func BenchmarkTunnelCompressionNone(b *testing.B) {
+	benchmarkTunnelCompression(NoCompression, b)
+}
+
+// Benchmarks the throughput of a gzip tunnel on a compressible payload.
+func BenchmarkTunnelCompressionGzip(b *testing.B) {
+	benchmarkTunnelCompression(Gzip, b)
+}
+
+func benchmarkTunnelCompression(comp Compression, b *testing.B) {
+	// Register a new service to the relay
+	handler := new(tunnelTestHandler)
+	opts := &ConnectOpts{Tunnels: &TunnelOpts{Compression: comp}}
+	conn, err := ConnectWith(config.relay, config.cluster, handler, opts)
+	if err != nil {
+		b.Fatalf("registration failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Construct the tunnel
+	tunnel, err := conn.TunnelWith(config.cluster, time.Second, &TunnelOpts{Compression: comp})
+	if err != nil {
+		b.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Reset the timer and measure the throughput
+	blob := bytes.Repeat([]byte(`{"key": "value", "number": 12345}`), 2048)
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N/2; i++ {
+			if err := tunnel.Send(blob, 10*time.Second); err != nil {
+				errc <- err
+				return
 			}
 		}
+		errc <- nil
 	}()
 	for i := 0; i < b.N/2; i++ {
+		if _, err := tunnel.Recv(10 * time.Second); err != nil {
+			b.Fatalf("tunnel receive failed: %v.", err)
+		}
+	}
+	if err := <-errc; err != nil {
+		b.Fatalf("tunnel send failed: %v.", err)
+	}
+	// Stop the timer (don't measure deferred cleanup)
+	b.StopTimer()
+}
+
+// Benchmarks the cost of an exchange over a freshly opened tunnel.
+func BenchmarkTunnelPerCall(b *testing.B) {
+	benchmarkTunnelPool(false, b)
+}
+
+// Benchmarks the cost of an exchange over a pooled tunnel.
+func BenchmarkTunnelPooled(b *testing.B) {
+	benchmarkTunnelPool(true, b)
+}
+
+func benchmarkTunnelPool(pooled bool, b *testing.B) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		b.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	pool := handler.conn.TunnelPool(config.cluster, nil)
+	defer pool.Close()
+
+	// Reset the timer and measure the exchanges
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var tunnel *Tunnel
+		if pooled {
+			tunnel, err = pool.Get(time.Second)
+		} else {
+			tunnel, err = handler.conn.Tunnel(config.cluster, time.Second)
+		}
+		if err != nil {
+			b.Fatalf("tunnel construction failed: %v.", err)
+		}
+		if err := tunnel.Send([]byte{byte(i)}, time.Second); err != nil {
+			b.Fatalf("tunnel send failed: %v.", err)
+		}
 		if _, err := tunnel.Recv(time.Second); err != nil {
 			b.Fatalf("tunnel receive failed: %v.", err)
 		}
+		if pooled {
+			pool.Put(tunnel)
+		} else {
+			tunnel.Close()
+		}
 	}
 	// Stop the timer (don't measure deferred cleanup)
 	b.StopTimer()
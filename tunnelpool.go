@@ -0,0 +1,211 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the pool of reusable tunnels to a remote cluster.
+
+package iris
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool of pre-opened tunnels to a remote cluster, allowing tunnel-heavy clients
+// to skip the construction handshake on every exchange. Tunnels are handed out
+// by Get and handed back by Put after use; tunnels that failed or were left in
+// an unclean state are closed instead of being reused.
+//
+// The pool is safe for concurrent use. Tunnels consumed via Incoming must not be
+// returned, since the push based receiver cannot be stopped.
+type TunnelPool struct {
+	conn    *Connection     // Connection to the local relay
+	cluster string          // Remote cluster to open the tunnels to
+	opts    *TunnelPoolOpts // Finalized options of the pool
+
+	idle []*pooledTunnel // Idle tunnels, the most recently used last
+	lock sync.Mutex      // Protects the idle list and the closed flag
+	done bool            // Flag whether the pool was closed
+
+	quit chan struct{} // Quit channel of the idle tunnel evictor
+}
+
+// Idle tunnel retained by a pool, along with the time it was returned.
+type pooledTunnel struct {
+	tun   *Tunnel
+	since time.Time
+}
+
+// Creates a pool of reusable tunnels to a member of the specified cluster. No
+// tunnels are opened up front; they are constructed on demand by Get.
+func (c *Connection) TunnelPool(cluster string, opts *TunnelPoolOpts) *TunnelPool {
+	pool := &TunnelPool{
+		conn:    c,
+		cluster: cluster,
+		opts:    finalizeTunnelPoolOpts(opts),
+		quit:    make(chan struct{}),
+	}
+	if period := pool.evictPeriod(); period > 0 {
+		go pool.evictor(period)
+	}
+	return pool
+}
+
+// Retrieves an idle tunnel from the pool, or opens a new one if none is available,
+// waiting at most timeout for the construction to complete.
+func (p *TunnelPool) Get(timeout time.Duration) (*Tunnel, error) {
+	p.lock.Lock()
+	if p.done {
+		p.lock.Unlock()
+		return nil, ErrClosed
+	}
+	// Pop the most recently used idle tunnel still fit for reuse
+	now := time.Now()
+	for len(p.idle) > 0 {
+		pooled := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if p.expired(pooled, now) || !pooled.tun.reusable() {
+			go pooled.tun.Close()
+			continue
+		}
+		p.lock.Unlock()
+		return pooled.tun, nil
+	}
+	p.lock.Unlock()
+
+	// No idle tunnel available, open a new one
+	return p.conn.initTunnel(context.Background(), p.cluster, timeout, p.opts.Tunnel)
+}
+
+// Returns a tunnel retrieved via Get to the pool. If the tunnel failed, was half-
+// closed, still holds unconsumed data, or the pool is already full, the tunnel is
+// closed instead.
+func (p *TunnelPool) Put(tun *Tunnel) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pooled := &pooledTunnel{tun: tun, since: time.Now()}
+	if p.done || len(p.idle) >= p.opts.MaxIdle || p.expired(pooled, pooled.since) || !tun.reusable() {
+		go tun.Close()
+		return
+	}
+	p.idle = append(p.idle, pooled)
+}
+
+// Closes a tunnel retrieved via Get without returning it to the pool. It should
+// be used if an operation on the tunnel failed in a way that may have left stale
+// data in flight (e.g. a timed out send or receive).
+func (p *TunnelPool) Discard(tun *Tunnel) {
+	go tun.Close()
+}
+
+// Returns the number of idle tunnels currently retained by the pool.
+func (p *TunnelPool) Idle() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.idle)
+}
+
+// Closes all the idle tunnels of the pool. Tunnels handed out are closed when
+// returned, and any subsequent Get fails with ErrClosed.
+func (p *TunnelPool) Close() error {
+	p.lock.Lock()
+	if p.done {
+		p.lock.Unlock()
+		return nil
+	}
+	p.done = true
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+
+	close(p.quit)
+
+	var failure error
+	for _, pooled := range idle {
+		if err := pooled.tun.Close(); err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
+// Checks whether an idle tunnel exceeded either its idle timeout or its lifetime.
+func (p *TunnelPool) expired(pooled *pooledTunnel, now time.Time) bool {
+	if p.opts.IdleTimeout > 0 && now.Sub(pooled.since) >= p.opts.IdleTimeout {
+		return true
+	}
+	if p.opts.MaxLifetime > 0 && now.Sub(pooled.tun.start) >= p.opts.MaxLifetime {
+		return true
+	}
+	return false
+}
+
+// Calculates the period of the idle tunnel eviction, zero if none is needed.
+func (p *TunnelPool) evictPeriod() time.Duration {
+	period := p.opts.IdleTimeout
+	if period == 0 || (p.opts.MaxLifetime > 0 && p.opts.MaxLifetime < period) {
+		period = p.opts.MaxLifetime
+	}
+	return period / 2
+}
+
+// Periodically closes the idle tunnels that expired, until the pool or the
+// connection is closed.
+func (p *TunnelPool) evictor(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-p.conn.Closed():
+			return
+		case now := <-ticker.C:
+			p.lock.Lock()
+			live := p.idle[:0]
+			for _, pooled := range p.idle {
+				if p.expired(pooled, now) || !pooled.tun.reusable() {
+					go pooled.tun.Close()
+					continue
+				}
+				live = append(live, pooled)
+			}
+			for i := len(live); i < len(p.idle); i++ {
+				p.idle[i] = nil
+			}
+			p.idle = live
+			p.lock.Unlock()
+		}
+	}
+}
+
+// Checks whether the tunnel is in a clean state to be handed out again: still
+// open in both directions, with no sends in progress and no data pending.
+func (t *Tunnel) reusable() bool {
+	select {
+	case <-t.term:
+		return false
+	default:
+	}
+	if atomic.LoadInt32(&t.atoiDone) != 0 {
+		return false
+	}
+	t.atoiLock.Lock()
+	busy := t.atoiBusy
+	t.atoiLock.Unlock()
+	if busy > 0 {
+		return false
+	}
+	t.itoaLock.Lock()
+	defer t.itoaLock.Unlock()
+
+	return !t.itoaDone && t.itoaBuf.Empty() && t.itoaHeld == nil
+}
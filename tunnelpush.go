@@ -0,0 +1,83 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the push based tunnel receiver, allowing inbound messages to be
+// selected on alongside other events instead of blocking in Recv.
+
+package iris
+
+import (
+	"context"
+	"io"
+)
+
+// Retrieves a channel delivering the inbound messages of the tunnel. The channel
+// is closed when the tunnel is closed or the remote side half-closes it, after
+// which Errors reports the reason, if any.
+//
+// The first call to Incoming or Errors starts a single background receiver that
+// consumes all inbound messages, so the pull based Recv methods must not be used
+// on the tunnel afterwards.
+func (t *Tunnel) Incoming() <-chan []byte {
+	t.pushOnce.Do(t.startPush)
+	return t.pushData
+}
+
+// Retrieves a channel reporting the receive failures of the tunnel: messages that
+// couldn't be decompressed, io.EOF on remote half-close and the drop reason if the
+// tunnel was torn down remotely. The channel is closed along with Incoming.
+func (t *Tunnel) Errors() <-chan error {
+	t.pushOnce.Do(t.startPush)
+	return t.pushErrs
+}
+
+// Creates the push channels and starts the receiver feeding them.
+func (t *Tunnel) startPush() {
+	t.pushData = make(chan []byte)
+	t.pushErrs = make(chan error, 1)
+
+	go t.push()
+}
+
+// Fetches the inbound messages one by one and pushes them into the delivery
+// channel, until the tunnel is closed or the inbound stream ends.
+func (t *Tunnel) push() {
+	defer close(t.pushErrs)
+	defer close(t.pushData)
+
+	for {
+		msg, err := t.recv(context.Background(), nil)
+		switch {
+		case err == nil:
+			select {
+			case t.pushData <- msg:
+			case <-t.term:
+				return
+			}
+		case err == io.EOF:
+			select {
+			case t.pushErrs <- err:
+			case <-t.term:
+			}
+			return
+		case err == ErrClosed:
+			if t.stat != nil {
+				select {
+				case t.pushErrs <- t.stat:
+				default:
+				}
+			}
+			return
+		default:
+			// Message level failure (e.g. corrupt compression), report and go on
+			select {
+			case t.pushErrs <- err:
+			case <-t.term:
+				return
+			}
+		}
+	}
+}